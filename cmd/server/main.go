@@ -1,8 +1,8 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -13,12 +13,20 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
 	"github.com/joho/godotenv"
+	"github.com/nicolas-camacho/thrg/internal/apitoken"
+	"github.com/nicolas-camacho/thrg/internal/audit"
 	"github.com/nicolas-camacho/thrg/internal/character"
+	"github.com/nicolas-camacho/thrg/internal/csrf"
+	"github.com/nicolas-camacho/thrg/internal/database"
+	"github.com/nicolas-camacho/thrg/internal/game"
+	"github.com/nicolas-camacho/thrg/internal/migrate"
+	"github.com/nicolas-camacho/thrg/internal/oidc"
+	"github.com/nicolas-camacho/thrg/internal/password"
+	"github.com/nicolas-camacho/thrg/internal/ratelimit"
+	"github.com/nicolas-camacho/thrg/internal/session"
 	"github.com/nicolas-camacho/thrg/internal/story"
 	"github.com/nicolas-camacho/thrg/internal/token"
 	"github.com/nicolas-camacho/thrg/internal/user"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
 )
 
 const (
@@ -26,18 +34,6 @@ const (
 	playerSessionName = "player_session"
 )
 
-var store *sessions.CookieStore
-
-func getDBConnectionString() string {
-	host := os.Getenv("DB_HOST")
-	user := os.Getenv("DB_USER")
-	password := os.Getenv("DB_PASSWORD")
-	dbname := os.Getenv("DB_NAME")
-	port := os.Getenv("DB_PORT")
-
-	return fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable", host, user, password, dbname, port)
-}
-
 func main() {
 	err := godotenv.Load()
 	if err != nil {
@@ -47,38 +43,63 @@ func main() {
 	gob.Register(uuid.UUID{})
 	log.Println("Type uuid.UUID registered with gob.")
 
-	connStr := getDBConnectionString()
-
-	db, err := gorm.Open(postgres.Open(connStr), &gorm.Config{})
+	dbConfig, err := database.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid database settings: %v", err)
+	}
+	db, err := database.Open(dbConfig)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
-	log.Println("Successfully connected to PostgreSQL!")
+	log.Printf("Successfully connected to %s!", dbConfig.Driver)
 
-	log.Println("Verifying extension 'uuid-ossp'...")
-	err = db.Exec("CREATE EXTENSION IF NOT EXISTS \"uuid-ossp\";").Error
+	migrator, err := migrate.New(db, dbConfig.Driver)
 	if err != nil {
-		log.Fatalf("Failed to create extension 'uuid-ossp': %v", err)
+		log.Fatalf("Failed to load migrations: %v", err)
+	}
+	if len(os.Args) > 1 {
+		if os.Args[1] != "migrate" {
+			log.Fatalf("Unknown command %q. %s", os.Args[1], migrateUsage)
+		}
+		if err := runMigrate(context.Background(), migrator, os.Args[2:]); err != nil {
+			log.Fatalf("Migration command failed: %v", err)
+		}
+		return
 	}
-	log.Println("Extension 'uuid-ossp' is available.")
 
-	log.Println("Running database migrations...")
+	// Instances apply pending migrations as they start unless
+	// MIGRATE_ON_START=false, in which case they are applied with
+	// "migrate up" beforehand and an instance only checks it has nothing
+	// left to apply.
+	if os.Getenv("MIGRATE_ON_START") == "false" {
+		pending, err := migrator.Pending(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to check migrations: %v", err)
+		}
+		if len(pending) > 0 {
+			log.Fatalf("The database has %d pending migration(s); run \"migrate up\" first.", len(pending))
+		}
+	} else {
+		log.Println("Running database migrations...")
+		applied, err := migrator.Up(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to migrate database: %v", err)
+		}
+		for _, m := range applied {
+			log.Printf("Applied migration %s.", m)
+		}
+		log.Println("Database migrated successfully!")
+	}
 
-	err = db.AutoMigrate(
-		&user.User{},
-		&token.RegistrationToken{},
-		&story.Story{},
-		&story.Act{},
-		&story.Option{},
-		&story.Consequence{},
-		&character.Character{},
-	)
-	if err != nil {
-		log.Fatalf("Failed to migrate database: %v", err)
+	var sessionBackend session.Backend
+	if os.Getenv("SESSION_BACKEND") == "memory" {
+		sessionBackend = session.NewMemoryBackend()
+		log.Println("Using in-memory session storage.")
+	} else {
+		sessionBackend = session.NewRepository(db)
 	}
-	log.Println("Database migrated successfully!")
 
-	store = sessions.NewCookieStore([]byte(os.Getenv("SESSION_SECRET")))
+	store := session.NewStore(sessionBackend)
 	store.Options = &sessions.Options{
 		Path:     "/",
 		MaxAge:   int((time.Hour * 24).Seconds()),
@@ -88,14 +109,91 @@ func main() {
 	}
 
 	user.Store = store
+	go store.CleanupExpired(context.Background(), time.Hour)
 	log.Println("Session store initialized.")
 
+	// Rate limits, sessions and the audit log key on the client address, so
+	// behind a proxy it must come from X-Forwarded-For, but only when the
+	// proxy itself sent it.
+	if session.TrustedProxies, err = session.TrustedProxiesFromEnv(); err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
+	if len(session.TrustedProxies) > 0 {
+		log.Printf("Reading client addresses from X-Forwarded-For behind %d trusted proxy range(s).", len(session.TrustedProxies))
+	}
+
+	if user.PasswordPolicy, err = password.PolicyFromEnv(); err != nil {
+		log.Fatalf("Invalid password policy: %v", err)
+	}
+	if user.PasswordHasher, err = password.HasherFromEnv(); err != nil {
+		log.Fatalf("Invalid password hashing settings: %v", err)
+	}
+	log.Printf("Hashing passwords with %s.", user.PasswordHasher.Algorithm)
+
+	// Failed attempts are counted in memory unless several instances share
+	// the load, in which case they must share the counts too.
+	var attempts ratelimit.Store = ratelimit.NewMemoryStore()
+	if os.Getenv("RATE_LIMIT_STORE") == "postgres" {
+		attempts = ratelimit.NewPostgresStore(db)
+		log.Println("Using PostgreSQL for login rate limiting.")
+	}
+	adminLoginGuard := ratelimit.NewGuard(attempts, "admin-login", ratelimit.IPPolicy, ratelimit.UsernamePolicy)
+	playerLoginGuard := ratelimit.NewGuard(attempts, "player-login", ratelimit.IPPolicy, ratelimit.UsernamePolicy)
+	registerGuard := ratelimit.NewGuard(attempts, "register", ratelimit.TokenPolicy, ratelimit.UsernamePolicy)
+	passwordResetGuard := ratelimit.NewGuard(attempts, "password-reset", ratelimit.TokenPolicy, ratelimit.UsernamePolicy)
+
+	// With ADMIN_2FA_REQUIRED=true, admins without two-factor
+	// authentication must set it up before their first login completes.
+	require2FA := os.Getenv("ADMIN_2FA_REQUIRED") == "true"
+
+	// Token batch exports print registration links, so they need the address
+	// players open the app at. BATCH_EXPORT=false turns them off instead.
+	batchExportURL, err := token.PublicURLFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid public URL: %v", err)
+	}
+	if os.Getenv("BATCH_EXPORT") == "false" {
+		batchExportURL = nil
+		log.Println("Token batch export disabled.")
+	} else if batchExportURL == nil {
+		log.Fatal("PUBLIC_URL is required to export token batches; set it to the address players open the app at, or set BATCH_EXPORT=false")
+	}
+
+	// Admins can also log in with an OpenID Connect provider when
+	// OIDC_ISSUER is set.
+	oidcConfig, err := oidc.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid OIDC settings: %v", err)
+	}
+	if oidcConfig != nil {
+		for value, role := range oidcConfig.RoleMap {
+			if !user.IsValidRole(role) || role == user.RolePlayer {
+				log.Fatalf("OIDC_ROLE_MAP gives %q the role %q; it must be owner, game_master or author", value, role)
+			}
+		}
+		user.OIDC = oidc.NewProvider(*oidcConfig)
+		log.Printf("OIDC login enabled with %s.", oidcConfig.Issuer)
+	}
+
 	userRepo := user.NewRepository(db)
+	if n, err := userRepo.MigrateLegacyRoles(context.Background()); err != nil {
+		log.Fatalf("Failed to migrate user roles: %v", err)
+	} else if n > 0 {
+		log.Printf("Gave the owner role to %d legacy admin(s).", n)
+	}
+	if n, err := userRepo.BackfillInviters(context.Background()); err != nil {
+		log.Fatalf("Failed to backfill player inviters: %v", err)
+	} else if n > 0 {
+		log.Printf("Recorded the inviter of %d player(s).", n)
+	}
 	tokenRepo := token.NewRepository(db)
+	accessTokenRepo := apitoken.NewRepository(db)
 	storyRepo := story.NewRepository(db)
-	//characterRepo := character.NewRepository(db)
+	characterRepo := character.NewRepository(db)
 
-	storyLoader := story.NewLoaderService(storyRepo)
+	auditLog := audit.NewLog(db)
+	storyLoader := story.NewLoaderService(storyRepo, auditLog)
+	gameService := game.NewService(storyRepo, characterRepo)
 
 	log.Println("Starting server...")
 
@@ -108,36 +206,105 @@ func main() {
 		w.Write([]byte("pong"))
 	})
 
+	// Every browser-facing route goes through the CSRF check; the setup
+	// endpoint is meant for curl before any account or cookie exists.
+	protect := csrf.Middleware(os.Getenv("APP_ENV") == "production")
+
 	//API ROUTES
-	r.Post("/api/player/register", user.RegisterPlayerHandler(userRepo, tokenRepo))
-	r.Post("/api/player/login", user.PlayerLoginHandler(userRepo, playerSessionName))
 	r.Post("/api/admin/setup", user.SetupAdminHandler(userRepo))
+	r.Group(func(r chi.Router) {
+		r.Use(protect)
+
+		r.Post("/api/player/register", user.RegisterPlayerHandler(userRepo, registerGuard, auditLog))
+		r.Get("/api/player/invite", token.InviteHandler(tokenRepo, registerGuard))
+		r.Post("/api/player/login", user.PlayerLoginHandler(userRepo, playerSessionName, playerLoginGuard, auditLog))
+		r.Post("/api/password/reset", user.ResetPasswordHandler(userRepo, store, passwordResetGuard))
+		r.Get("/password/reset", user.ServePageHandler("password_reset.html"))
+	})
 
 	// Admin routes
-	r.Handle("/admin/login", user.ServeLoginPageHandler(userRepo))
+	r.With(protect).Handle("/admin/login", user.ServeLoginPageHandler(userRepo, adminLoginGuard, require2FA, auditLog))
+	if user.OIDC != nil {
+		r.With(protect).Get("/admin/login/oidc", user.OIDCLoginHandler())
+		r.With(protect).Get("/admin/login/oidc/callback", user.OIDCCallbackHandler(userRepo, adminLoginGuard, require2FA, auditLog))
+	}
 	r.Get("/admin/logout", func(w http.ResponseWriter, r *http.Request) {
 		if err := user.LogoutUser(w, r, adminSessionName); err != nil {
 			log.Printf("Failed to log out user: %v", err)
 		}
 		http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
 	})
+	can := func(perm user.Permission) func(http.Handler) http.Handler {
+		return user.RequirePermission(userRepo, perm)
+	}
 	r.Group(func(r chi.Router) {
-		r.Use(user.AdminAuthMiddleware(adminSessionName))
+		r.Use(protect)
+		r.Use(user.AdminAuthMiddleware(adminSessionName, accessTokenRepo))
 
-		r.Get("/admin/dashboard", user.DashboardHandler())
-		r.Post("/admin/api/tokens", token.GenerateTokenHandler(tokenRepo))
-		r.Get("/admin/api/tokens", token.ListTokensHandler(tokenRepo, userRepo))
-		r.Get("/admin/api/players", user.ListPlayersHandler(userRepo))
-		r.Post("/admin/api/stories/load", storyLoader.LoadStoriesHandler)
+		r.Group(func(r chi.Router) {
+			r.Use(can(user.PermDashboardView))
+
+			r.Get("/admin/dashboard", user.DashboardHandler())
+
+			r.Group(func(r chi.Router) {
+				r.Use(user.SessionOnly)
+
+				r.Get("/admin/api/account/2fa", user.TwoFactorStatusHandler(userRepo, require2FA))
+				r.Post("/admin/api/account/2fa/setup", user.SetupTwoFactorHandler(userRepo))
+				r.Post("/admin/api/account/2fa/enable", user.EnableTwoFactorHandler(userRepo))
+				r.Post("/admin/api/account/2fa/recovery-codes", user.RegenerateRecoveryCodesHandler(userRepo))
+				r.Delete("/admin/api/account/2fa", user.DisableTwoFactorHandler(userRepo, require2FA))
+				r.Get("/admin/api/account/oidc", user.OIDCStatusHandler(userRepo))
+				r.Post("/admin/api/account/oidc/link", user.LinkOIDCHandler(userRepo))
+				r.Delete("/admin/api/account/oidc", user.UnlinkOIDCHandler(userRepo, auditLog))
+				r.Get("/admin/api/account/tokens", apitoken.ListTokensHandler(accessTokenRepo))
+				r.Post("/admin/api/account/tokens", apitoken.CreateTokenHandler(accessTokenRepo, userRepo))
+				r.Delete("/admin/api/account/tokens/{tokenID}", apitoken.RevokeTokenHandler(accessTokenRepo))
+			})
+		})
+
+		r.With(can(user.PermTokensCreate)).Post("/admin/api/tokens", token.GenerateTokenHandler(tokenRepo, userRepo, storyRepo, auditLog))
+		r.With(can(user.PermTokensCreate)).Get("/admin/api/tokens", token.ListTokensHandler(tokenRepo, userRepo))
+		r.With(can(user.PermTokensCreate)).Post("/admin/api/tokens/{tokenID}/revoke", token.RevokeTokenHandler(tokenRepo))
+		r.With(can(user.PermTokensCreate)).Post("/admin/api/tokens/batch", token.GenerateTokenBatchHandler(tokenRepo, userRepo, storyRepo, auditLog))
+		r.With(can(user.PermTokensCreate)).Get("/admin/api/tokens/batch", token.ListBatchesHandler(tokenRepo, userRepo))
+		r.With(can(user.PermTokensCreate)).Get("/admin/api/tokens/batch/{batchID}/export", token.ExportBatchHandler(tokenRepo, batchExportURL))
+		r.With(can(user.PermTokensCreate)).Post("/admin/api/tokens/batch/{batchID}/revoke", token.RevokeBatchHandler(tokenRepo, auditLog))
+		r.With(can(user.PermPlayersView)).Get("/admin/api/players", user.ListPlayersHandler(userRepo))
+		r.With(can(user.PermCharactersOverride)).Patch("/admin/api/players/{userID}/character", character.OverrideCharacterHandler(characterRepo, auditLog))
+		r.With(can(user.PermAuditView)).Get("/admin/api/audit", audit.ListEventsHandler(auditLog, userRepo))
+		r.With(can(user.PermAuditView)).Get("/admin/api/audit/export", audit.ExportEventsHandler(auditLog, userRepo))
+
+		r.Group(func(r chi.Router) {
+			r.Use(can(user.PermUsersManage))
+
+			r.Get("/admin/api/roles", user.ListRolesHandler())
+			r.Get("/admin/api/users", user.ListUsersHandler(userRepo))
+			r.Post("/admin/api/users", user.CreateUserHandler(userRepo))
+			r.Post("/admin/api/users/{userID}/password-reset", user.ForcePasswordResetHandler(userRepo, store))
+			r.Post("/admin/api/users/{userID}/2fa/reset", user.ResetTwoFactorHandler(userRepo, store))
+			r.Put("/admin/api/users/{userID}/role", user.SetUserRoleHandler(userRepo))
+			r.Post("/admin/api/users/{userID}/disable", user.SetUserDisabledHandler(userRepo, store, true))
+			r.Post("/admin/api/users/{userID}/enable", user.SetUserDisabledHandler(userRepo, store, false))
+			r.Delete("/admin/api/users/{userID}", user.DeleteUserHandler(userRepo, store))
+			r.Get("/admin/api/users/{userID}/sessions", session.ListUserSessionsHandler(store))
+			r.Delete("/admin/api/users/{userID}/sessions", session.RevokeUserSessionsHandler(store))
+			r.Delete("/admin/api/users/{userID}/sessions/{sessionID}", session.RevokeSessionHandler(store))
+		})
+
+		r.With(can(user.PermStoriesImport)).Post("/admin/api/stories/load", storyLoader.LoadStoriesHandler)
+		r.With(can(user.PermStoriesImport)).Post("/admin/api/stories/import/ink", storyLoader.ImportInkHandler)
+		r.With(can(user.PermStoriesView)).Get("/admin/api/stories", story.ListStoriesHandler(storyRepo, characterRepo))
+		r.With(can(user.PermStoriesView)).Get("/admin/api/stories/{storyID}", story.GetStoryHandler(storyRepo))
+		r.With(can(user.PermStoriesEdit)).Patch("/admin/api/stories/{storyID}", story.UpdateStoryHandler(storyRepo))
+		r.With(can(user.PermStoriesEdit)).Delete("/admin/api/stories/{storyID}", story.DeleteStoryHandler(storyRepo))
+		r.With(can(user.PermStoriesEdit)).Patch("/admin/api/stories/{storyID}/acts/{actID}", story.UpdateActHandler(storyRepo))
+		r.With(can(user.PermStoriesEdit)).Patch("/admin/api/stories/{storyID}/options/{optionID}", story.UpdateOptionHandler(storyRepo))
 	})
 
 	// Player routes
-	r.Get("/player/register", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "web/player_register.html")
-	})
-	r.Get("/player/login", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "web/player_login.html")
-	})
+	r.With(protect).Get("/player/register", user.ServePageHandler("player_register.html"))
+	r.With(protect).Get("/player/login", user.ServePageHandler("player_login.html"))
 	r.Get("/player/logout", func(w http.ResponseWriter, r *http.Request) {
 		if err := user.LogoutUser(w, r, playerSessionName); err != nil {
 			log.Printf("Failed to log out user: %v", err)
@@ -145,11 +312,22 @@ func main() {
 		http.Redirect(w, r, "/player/login", http.StatusSeeOther)
 	})
 	r.Group(func(r chi.Router) {
+		r.Use(protect)
 		r.Use(user.PlayerAuthMiddleware(playerSessionName))
+		r.Use(can(user.PermGamePlay))
 
-		r.Get("/player/game", func(w http.ResponseWriter, r *http.Request) {
-			http.ServeFile(w, r, "web/game.html")
-		})
+		r.Get("/player/game", game.PageHandler(gameService))
+		r.Get("/player/api/game", game.StateHandler(gameService))
+		r.Post("/player/api/game/choices", game.ChooseHandler(gameService))
+		r.Get("/player/api/stories", story.ListOpenStoriesHandler(storyRepo))
+		r.Post("/player/api/stories/{storyID}/start", game.StartStoryHandler(gameService))
+
+		r.Get("/player/account", user.ServePageHandler("player_account.html"))
+		r.Get("/player/api/account", user.PlayerAccountHandler(userRepo))
+		r.Put("/player/api/account/password", user.ChangePasswordHandler(userRepo, store, playerLoginGuard, playerSessionName, auditLog))
+		r.Put("/player/api/account/display-name", user.SetDisplayNameHandler(userRepo))
+		r.Get("/player/api/account/export", user.ExportAccountDataHandler(userRepo, characterRepo))
+		r.Delete("/player/api/account", user.DeleteAccountHandler(userRepo, store, playerLoginGuard, playerSessionName, auditLog))
 	})
 
 	port := os.Getenv("PORT")
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/nicolas-camacho/thrg/internal/migrate"
+)
+
+const migrateUsage = "Usage: server [migrate up | migrate down [n] | migrate status]"
+
+// runMigrate runs the migrate subcommand: up applies every pending
+// migration, down rolls back the last n (one by default) and status lists
+// them all.
+func runMigrate(ctx context.Context, migrator *migrate.Migrator, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	switch args[0] {
+	case "up":
+		if len(args) > 1 {
+			return errors.New(migrateUsage)
+		}
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("Nothing to apply; the database is up to date.")
+		}
+		for _, m := range applied {
+			fmt.Printf("Applied %s\n", m)
+		}
+
+	case "down":
+		steps := 1
+		if len(args) > 2 {
+			return errors.New(migrateUsage)
+		}
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("the number of migrations to roll back must be a positive number, not %q", args[1])
+			}
+			steps = n
+		}
+		rolledBack, err := migrator.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		if len(rolledBack) == 0 {
+			fmt.Println("Nothing to roll back; no migration is applied.")
+		}
+		for _, m := range rolledBack {
+			fmt.Printf("Rolled back %s\n", m)
+		}
+
+	case "status":
+		if len(args) > 1 {
+			return errors.New(migrateUsage)
+		}
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "MIGRATION\tAPPLIED")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%s\t%s\n", s.Migration, applied)
+		}
+		return w.Flush()
+
+	default:
+		return errors.New(migrateUsage)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Package apierror writes the errors of the JSON API. Every error is sent
+// in the same envelope:
+//
+//	{"error": {"code": "username_taken", "message": "Username already exists", "details": {...}}}
+//
+// code is stable and meant for programs; message is meant for people and may
+// change; details is optional.
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/nicolas-camacho/thrg/internal/dberr"
+)
+
+// Generic codes, used when nothing more specific applies.
+const (
+	CodeBadRequest   = "bad_request"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeNotFound     = "not_found"
+	CodeConflict     = "conflict"
+	CodeInternal     = "internal_error"
+)
+
+// Error is an error to send to the client.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Details map[string]any
+}
+
+func New(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WithDetail returns a copy of e with one more detail.
+func (e *Error) WithDetail(key string, value any) *Error {
+	c := *e
+	c.Details = make(map[string]any, len(e.Details)+1)
+	for k, v := range e.Details {
+		c.Details[k] = v
+	}
+	c.Details[key] = value
+	return &c
+}
+
+func BadRequest(message string) *Error {
+	return New(http.StatusBadRequest, CodeBadRequest, message)
+}
+
+func Unauthorized(message string) *Error {
+	return New(http.StatusUnauthorized, CodeUnauthorized, message)
+}
+
+func Forbidden(message string) *Error {
+	return New(http.StatusForbidden, CodeForbidden, message)
+}
+
+func NotFound(message string) *Error {
+	return New(http.StatusNotFound, CodeNotFound, message)
+}
+
+// ErrInternal hides the cause of an unexpected failure from the client; log
+// the cause before writing it.
+var ErrInternal = New(http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+
+var (
+	mu       sync.RWMutex
+	mappings []mapping
+)
+
+type mapping struct {
+	target error
+	apiErr *Error
+}
+
+// Register makes Write answer with apiErr for any error that is target, as
+// errors.Is reports. Packages register their sentinel errors once, at
+// init, so handlers can pass them to Write as they come.
+func Register(target error, apiErr *Error) {
+	mu.Lock()
+	defer mu.Unlock()
+	mappings = append(mappings, mapping{target: target, apiErr: apiErr})
+}
+
+// errConflict answers unique violations that no package turned into an error
+// of its own.
+var errConflict = New(http.StatusConflict, CodeConflict, "This conflicts with an existing record")
+
+// From returns the API error for err: err itself if it is an *Error, the
+// registered error it matches, errConflict for a unique violation, or nil.
+func From(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, m := range mappings {
+		if errors.Is(err, m.target) {
+			return m.apiErr
+		}
+	}
+	if errors.Is(err, dberr.ErrConflict) {
+		return errConflict
+	}
+	return nil
+}
+
+type envelope struct {
+	Error body `json:"error"`
+}
+
+type body struct {
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// Write sends err to the client. Errors that are neither an *Error nor
+// registered are logged and sent as ErrInternal.
+func Write(w http.ResponseWriter, err error) {
+	apiErr := From(err)
+	if apiErr == nil {
+		log.Printf("Unexpected error: %v", err)
+		apiErr = ErrInternal
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	if err := json.NewEncoder(w).Encode(envelope{body{apiErr.Code, apiErr.Message, apiErr.Details}}); err != nil {
+		log.Printf("Error encoding API error: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package apitoken
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type contextKey struct{}
+
+// PathPrefix is where access tokens are accepted instead of a session. Only
+// the admin API authenticates by token; every other route goes by cookie.
+const PathPrefix = "/admin/api/"
+
+// WithToken records that the request was authenticated with t.
+func WithToken(ctx context.Context, t *AccessToken) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the token the request was authenticated with, if it
+// was not authenticated with a session.
+func FromContext(ctx context.Context) (*AccessToken, bool) {
+	t, ok := ctx.Value(contextKey{}).(*AccessToken)
+	return t, ok && t != nil
+}
+
+// BearerToken returns the token from an "Authorization: Bearer" header.
+func BearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
@@ -0,0 +1,193 @@
+package apitoken
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/apierror"
+	"github.com/nicolas-camacho/thrg/internal/contextutil"
+)
+
+const (
+	DefaultLifetimeDays = 90
+	MaxLifetimeDays     = 365
+)
+
+// ScopeGranter returns the scopes a user may put on their tokens, which are
+// the permissions of their current role.
+type ScopeGranter interface {
+	GrantableScopes(ctx context.Context, userID uuid.UUID) ([]string, error)
+}
+
+type TokenDTO struct {
+	ID         uuid.UUID  `json:"ID"`
+	Name       string     `json:"Name"`
+	Prefix     string     `json:"Prefix"`
+	Scopes     []string   `json:"Scopes"`
+	CreatedAt  time.Time  `json:"CreatedAt"`
+	ExpiresAt  time.Time  `json:"ExpiresAt"`
+	LastUsedAt *time.Time `json:"LastUsedAt"`
+	Revoked    bool       `json:"Revoked"`
+	Expired    bool       `json:"Expired"`
+}
+
+func toDTO(t *AccessToken, now time.Time) TokenDTO {
+	return TokenDTO{
+		ID:         t.ID,
+		Name:       t.Name,
+		Prefix:     t.Prefix,
+		Scopes:     t.ScopeList(),
+		CreatedAt:  t.CreatedAt,
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedAt: t.LastUsedAt,
+		Revoked:    t.RevokedAt != nil,
+		Expired:    !now.Before(t.ExpiresAt),
+	}
+}
+
+type createTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays"`
+}
+
+func currentUser(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	userID, ok := contextutil.GetUserIDFromContext(r.Context())
+	if !ok || userID == uuid.Nil {
+		apierror.Write(w, apierror.Unauthorized("Unauthorized"))
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+func CreateTokenHandler(repo *Repository, granter ScopeGranter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := currentUser(w, r)
+		if !ok {
+			return
+		}
+
+		var req createTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid request body"))
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			apierror.Write(w, apierror.BadRequest("A name is required"))
+			return
+		}
+		if len(req.Scopes) == 0 {
+			apierror.Write(w, apierror.BadRequest("At least one scope is required"))
+			return
+		}
+		if req.ExpiresInDays == 0 {
+			req.ExpiresInDays = DefaultLifetimeDays
+		}
+		if req.ExpiresInDays < 0 || req.ExpiresInDays > MaxLifetimeDays {
+			apierror.Write(w, apierror.BadRequest("expiresInDays must be between 1 and 365"))
+			return
+		}
+
+		grantable, err := granter.GrantableScopes(r.Context(), userID)
+		if err != nil {
+			log.Printf("Error looking up scopes for user %s: %v", userID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+		allowed := make(map[string]bool, len(grantable))
+		for _, s := range grantable {
+			allowed[s] = true
+		}
+		scopes := make([]string, 0, len(req.Scopes))
+		seen := make(map[string]bool, len(req.Scopes))
+		for _, s := range req.Scopes {
+			if !allowed[s] {
+				apierror.Write(w, apierror.BadRequest("Scope not allowed for your role: "+s).WithDetail("scope", s))
+				return
+			}
+			if !seen[s] {
+				seen[s] = true
+				scopes = append(scopes, s)
+			}
+		}
+
+		expiresAt := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		raw, token, err := repo.Create(r.Context(), userID, req.Name, scopes, expiresAt)
+		if err != nil {
+			log.Printf("Error creating access token: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"message": "Access token created. Copy it now, it will not be shown again.",
+			"token":   raw,
+			"details": toDTO(token, time.Now()),
+		})
+	}
+}
+
+func ListTokensHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := currentUser(w, r)
+		if !ok {
+			return
+		}
+
+		tokens, err := repo.ListByUser(r.Context(), userID)
+		if err != nil {
+			log.Printf("Error listing access tokens: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		now := time.Now()
+		dtos := make([]TokenDTO, len(tokens))
+		for i := range tokens {
+			dtos[i] = toDTO(&tokens[i], now)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(dtos); err != nil {
+			log.Printf("Error encoding access tokens to JSON: %v", err)
+		}
+	}
+}
+
+func RevokeTokenHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := currentUser(w, r)
+		if !ok {
+			return
+		}
+
+		tokenID, err := uuid.Parse(chi.URLParam(r, "tokenID"))
+		if err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid token ID"))
+			return
+		}
+
+		revoked, err := repo.Revoke(r.Context(), userID, tokenID)
+		if err != nil {
+			log.Printf("Error revoking access token: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+		if !revoked {
+			apierror.Write(w, apierror.NotFound("Token not found"))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
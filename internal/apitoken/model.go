@@ -0,0 +1,42 @@
+package apitoken
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AccessToken is a personal access token. Only the SHA-256 of the token is
+// stored; Prefix keeps its first characters so users can tell tokens apart.
+// Scopes holds permission names separated by spaces.
+type AccessToken struct {
+	ID         uuid.UUID `gorm:"type:uuid;primaryKey"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	UserID     uuid.UUID `gorm:"type:uuid;index;not null"`
+	Name       string    `gorm:"not null"`
+	Prefix     string    `gorm:"not null"`
+	TokenHash  string    `gorm:"uniqueIndex;not null"`
+	Scopes     string    `gorm:"not null"`
+	ExpiresAt  time.Time `gorm:"not null"`
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (t *AccessToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+func (t *AccessToken) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *AccessToken) IsActive(now time.Time) bool {
+	return t.RevokedAt == nil && now.Before(t.ExpiresAt)
+}
@@ -0,0 +1,123 @@
+package apitoken
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/dberr"
+	"gorm.io/gorm"
+)
+
+const (
+	// tokenPrefix marks thrg tokens so secret scanners and people can
+	// recognise them.
+	tokenPrefix = "thrg_"
+	// displayPrefixLength is how much of the token is kept for listings.
+	displayPrefixLength = len(tokenPrefix) + 6
+	// touchInterval limits how often last_used_at is written for a token
+	// used in a tight loop.
+	touchInterval = time.Minute
+)
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{db: db}
+}
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Create stores a new token for the user and returns it with its secret,
+// which is not kept anywhere and cannot be shown again.
+func (r *Repository) Create(ctx context.Context, userID uuid.UUID, name string, scopes []string, expiresAt time.Time) (string, *AccessToken, error) {
+	raw, err := generateToken()
+	if err != nil {
+		return "", nil, fmt.Errorf("error generating token: %w", err)
+	}
+
+	token := AccessToken{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    raw[:displayPrefixLength],
+		TokenHash: hashToken(raw),
+		Scopes:    strings.Join(scopes, " "),
+		ExpiresAt: expiresAt,
+	}
+	if err := r.db.WithContext(ctx).Create(&token).Error; err != nil {
+		return "", nil, fmt.Errorf("error creating access token: %w", dberr.Classify(err))
+	}
+	return raw, &token, nil
+}
+
+func (r *Repository) ListByUser(ctx context.Context, userID uuid.UUID) ([]AccessToken, error) {
+	var tokens []AccessToken
+	result := r.db.WithContext(ctx).Where("user_id = ?", userID).Order("created_at desc").Find(&tokens)
+	if result.Error != nil {
+		return nil, fmt.Errorf("error listing access tokens: %w", result.Error)
+	}
+	return tokens, nil
+}
+
+// Revoke revokes one of the user's tokens and reports whether it found an
+// active one.
+func (r *Repository) Revoke(ctx context.Context, userID, tokenID uuid.UUID) (bool, error) {
+	result := r.db.WithContext(ctx).Model(&AccessToken{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", tokenID, userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return false, fmt.Errorf("error revoking access token: %w", result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// Authenticate returns the active token matching raw, or nil if there is
+// none, and records that it was used.
+func (r *Repository) Authenticate(ctx context.Context, raw string) (*AccessToken, error) {
+	if !strings.HasPrefix(raw, tokenPrefix) {
+		return nil, nil
+	}
+
+	var token AccessToken
+	result := r.db.WithContext(ctx).Where("token_hash = ?", hashToken(raw)).First(&token)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error finding access token: %w", result.Error)
+	}
+
+	now := time.Now()
+	if !token.IsActive(now) {
+		return nil, nil
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > touchInterval {
+		result := r.db.WithContext(ctx).Model(&AccessToken{}).Where("id = ?", token.ID).Update("last_used_at", now)
+		if result.Error != nil {
+			return nil, fmt.Errorf("error updating access token: %w", result.Error)
+		}
+		token.LastUsedAt = &now
+	}
+	return &token, nil
+}
@@ -0,0 +1,316 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/apierror"
+	"github.com/nicolas-camacho/thrg/internal/csvsafe"
+	"github.com/nicolas-camacho/thrg/internal/listing"
+)
+
+// UserLookup resolves the actors of the audit log.
+type UserLookup interface {
+	// GetUsernames returns the usernames of the given users, deleted ones
+	// included, in a single query.
+	GetUsernames(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID]string, error)
+	// GetUserIDByUsername returns uuid.Nil if there is no such user.
+	GetUserIDByUsername(ctx context.Context, username string) (uuid.UUID, error)
+}
+
+// exportPageSize is how many events an export reads from the database at a
+// time.
+const exportPageSize = 500
+
+type EventDTO struct {
+	ID            uuid.UUID  `json:"ID"`
+	CreatedAt     time.Time  `json:"CreatedAt"`
+	ActorID       *uuid.UUID `json:"ActorID"`
+	ActorUsername string     `json:"ActorUsername"`
+	Action        Action     `json:"Action"`
+	TargetType    string     `json:"TargetType"`
+	TargetID      string     `json:"TargetID"`
+	Metadata      Metadata   `json:"Metadata"`
+	IP            string     `json:"IP"`
+}
+
+// ListEventsHandler returns one page of the audit log, newest first. The
+// query can filter by action, actor (a username), targetType, targetId and
+// date (from, to); the cursor of the next page is in the X-Next-Cursor
+// header.
+func ListEventsHandler(auditLog *Log, users UserLookup) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, err := listing.PageFromRequest(r)
+		if err != nil {
+			apierror.Write(w, apierror.BadRequest(err.Error()))
+			return
+		}
+		filter, ok := eventFilter(w, r, users)
+		if !ok {
+			return
+		}
+
+		var dtos []EventDTO
+		var next *listing.Cursor
+		if filter != nil {
+			var events []Event
+			events, next, err = auditLog.List(r.Context(), *filter, page)
+			if err == nil {
+				dtos, err = eventDTOs(r.Context(), users, events)
+			}
+			if err != nil {
+				log.Printf("Error listing audit events: %v", err)
+				apierror.Write(w, apierror.ErrInternal)
+				return
+			}
+		}
+		if dtos == nil {
+			dtos = []EventDTO{}
+		}
+
+		listing.WriteNext(w, next)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(dtos); err != nil {
+			log.Printf("Error encoding audit events to JSON: %v", err)
+		}
+	}
+}
+
+// ExportEventsHandler downloads every event matching the same filters as
+// ListEventsHandler, as CSV (the default) or JSON with ?format=json.
+func ExportEventsHandler(auditLog *Log, users UserLookup) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "csv"
+		}
+		if format != "csv" && format != "json" {
+			apierror.Write(w, apierror.BadRequest("format must be csv or json"))
+			return
+		}
+		filter, ok := eventFilter(w, r, users)
+		if !ok {
+			return
+		}
+
+		// The first page is read before anything is written, so a broken
+		// query still gets a proper error response.
+		page := listing.Page{Limit: exportPageSize}
+		var events []EventDTO
+		var next *listing.Cursor
+		if filter != nil {
+			var err error
+			if events, next, err = exportPage(r.Context(), auditLog, users, *filter, page); err != nil {
+				log.Printf("Error exporting audit events: %v", err)
+				apierror.Write(w, apierror.ErrInternal)
+				return
+			}
+		}
+
+		filename := "audit-" + time.Now().Format("2006-01-02") + "." + format
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		var out eventWriter
+		if format == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			out = &jsonEventWriter{w: w}
+		} else {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			out = newCSVEventWriter(w)
+		}
+
+		for {
+			for _, e := range events {
+				if err := out.Write(e); err != nil {
+					log.Printf("Error writing audit export: %v", err)
+					return
+				}
+			}
+			if next == nil {
+				break
+			}
+			page.After = next
+			var err error
+			if events, next, err = exportPage(r.Context(), auditLog, users, *filter, page); err != nil {
+				// The response has started; all that is left is to cut it
+				// short.
+				log.Printf("Error exporting audit events: %v", err)
+				return
+			}
+		}
+		if err := out.Close(); err != nil {
+			log.Printf("Error writing audit export: %v", err)
+		}
+	}
+}
+
+func exportPage(ctx context.Context, auditLog *Log, users UserLookup, filter Filter, page listing.Page) ([]EventDTO, *listing.Cursor, error) {
+	events, next, err := auditLog.List(ctx, filter, page)
+	if err != nil {
+		return nil, nil, err
+	}
+	dtos, err := eventDTOs(ctx, users, events)
+	return dtos, next, err
+}
+
+// eventFilter reads the filters from the query. A nil filter with ok set
+// means nothing can match, such as an actor that does not exist; on bad
+// input the error is written and ok is false.
+func eventFilter(w http.ResponseWriter, r *http.Request, users UserLookup) (filter *Filter, ok bool) {
+	query := r.URL.Query()
+	created, err := listing.DateRangeFromRequest(r)
+	if err != nil {
+		apierror.Write(w, apierror.BadRequest(err.Error()))
+		return nil, false
+	}
+	filter = &Filter{
+		Action:     Action(query.Get("action")),
+		TargetType: strings.TrimSpace(query.Get("targetType")),
+		TargetID:   strings.TrimSpace(query.Get("targetId")),
+		Created:    created,
+	}
+	if filter.Action != "" && !ValidAction(string(filter.Action)) {
+		apierror.Write(w, apierror.BadRequest("Unknown action"))
+		return nil, false
+	}
+
+	if actor := strings.TrimSpace(query.Get("actor")); actor != "" {
+		actorID, err := users.GetUserIDByUsername(r.Context(), actor)
+		if err != nil {
+			log.Printf("Error looking up audit actor %q: %v", actor, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return nil, false
+		}
+		if actorID == uuid.Nil {
+			return nil, true
+		}
+		filter.ActorID = &actorID
+	}
+	return filter, true
+}
+
+func eventDTOs(ctx context.Context, users UserLookup, events []Event) ([]EventDTO, error) {
+	var actorIDs []uuid.UUID
+	for _, e := range events {
+		if e.ActorID != nil {
+			actorIDs = append(actorIDs, *e.ActorID)
+		}
+	}
+	usernames := map[uuid.UUID]string{}
+	if len(actorIDs) > 0 {
+		var err error
+		if usernames, err = users.GetUsernames(ctx, actorIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	dtos := make([]EventDTO, 0, len(events))
+	for _, e := range events {
+		dto := EventDTO{
+			ID:         e.ID,
+			CreatedAt:  e.CreatedAt,
+			ActorID:    e.ActorID,
+			Action:     e.Action,
+			TargetType: e.TargetType,
+			TargetID:   e.TargetID,
+			Metadata:   e.Details(),
+			IP:         e.IP,
+		}
+		if e.ActorID != nil {
+			dto.ActorUsername = usernames[*e.ActorID]
+		}
+		dtos = append(dtos, dto)
+	}
+	return dtos, nil
+}
+
+type eventWriter interface {
+	Write(e EventDTO) error
+	Close() error
+}
+
+type csvEventWriter struct {
+	w      *csvsafe.Writer
+	header bool
+}
+
+func newCSVEventWriter(w http.ResponseWriter) *csvEventWriter {
+	return &csvEventWriter{w: csvsafe.NewWriter(w)}
+}
+
+var csvHeader = []string{"time", "actor", "actor_id", "action", "target_type", "target_id", "ip", "metadata"}
+
+// writeHeader writes the header once, before the first event or, in an
+// empty export, on its own.
+func (c *csvEventWriter) writeHeader() error {
+	if c.header {
+		return nil
+	}
+	c.header = true
+	return c.w.Write(csvHeader)
+}
+
+func (c *csvEventWriter) Write(e EventDTO) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	actorID := ""
+	if e.ActorID != nil {
+		actorID = e.ActorID.String()
+	}
+	metadata := ""
+	if len(e.Metadata) > 0 {
+		encoded, err := json.Marshal(e.Metadata)
+		if err != nil {
+			return err
+		}
+		metadata = string(encoded)
+	}
+	return c.w.Write([]string{
+		e.CreatedAt.UTC().Format(time.RFC3339), e.ActorUsername, actorID, string(e.Action),
+		e.TargetType, e.TargetID, e.IP, metadata,
+	})
+}
+
+func (c *csvEventWriter) Close() error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonEventWriter streams the events as one JSON array.
+type jsonEventWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (j *jsonEventWriter) Write(e EventDTO) error {
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	prefix := ","
+	if !j.started {
+		j.started = true
+		prefix = "["
+	}
+	_, err = j.w.Write(append([]byte(prefix), encoded...))
+	return err
+}
+
+func (j *jsonEventWriter) Close() error {
+	closing := "]\n"
+	if !j.started {
+		closing = "[]\n"
+	}
+	_, err := j.w.Write([]byte(closing))
+	return err
+}
@@ -0,0 +1,109 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/apitoken"
+	"github.com/nicolas-camacho/thrg/internal/contextutil"
+	"github.com/nicolas-camacho/thrg/internal/listing"
+	"github.com/nicolas-camacho/thrg/internal/session"
+	"gorm.io/gorm"
+)
+
+// Log appends events to the audit log and reads them back. It has no way
+// to change or delete them.
+type Log struct {
+	db *gorm.DB
+}
+
+func NewLog(db *gorm.DB) *Log {
+	return &Log{db: db}
+}
+
+// Record appends an event done by the user logged in on r.
+func (l *Log) Record(r *http.Request, action Action, target Target, meta Metadata) {
+	var actorID *uuid.UUID
+	if userID, ok := contextutil.GetUserIDFromContext(r.Context()); ok {
+		actorID = &userID
+	}
+	l.RecordAs(r, actorID, action, target, meta)
+}
+
+// RecordAs appends an event done by actorID, for requests where nobody is
+// logged in yet, such as logins and registrations. A nil actorID means the
+// actor is unknown.
+//
+// Failing to record an event is logged but does not fail the action; the
+// action has already happened by the time it is recorded.
+func (l *Log) RecordAs(r *http.Request, actorID *uuid.UUID, action Action, target Target, meta Metadata) {
+	if t, ok := apitoken.FromContext(r.Context()); ok {
+		if meta == nil {
+			meta = Metadata{}
+		}
+		meta["accessToken"] = t.Prefix
+	}
+
+	event := Event{
+		ActorID:    actorID,
+		Action:     action,
+		TargetType: target.Type,
+		TargetID:   target.ID,
+		IP:         session.ClientIP(r),
+	}
+	if len(meta) > 0 {
+		encoded, err := json.Marshal(meta)
+		if err != nil {
+			log.Printf("Failed to encode audit metadata for %s: %v", action, err)
+		} else {
+			event.Metadata = string(encoded)
+		}
+	}
+
+	if err := l.db.WithContext(r.Context()).Create(&event).Error; err != nil {
+		log.Printf("Failed to record audit event %s: %v", action, err)
+	}
+}
+
+// Filter narrows the audit log. Zero fields do not filter.
+type Filter struct {
+	Action     Action
+	ActorID    *uuid.UUID
+	TargetType string
+	TargetID   string
+	Created    listing.DateRange
+}
+
+// List returns one page of events, newest first, and the cursor of the next
+// page.
+func (l *Log) List(ctx context.Context, filter Filter, page listing.Page) ([]Event, *listing.Cursor, error) {
+	const table = "audit_events"
+	query := l.db.WithContext(ctx).Model(&Event{})
+
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.ActorID != nil {
+		query = query.Where("actor_id = ?", *filter.ActorID)
+	}
+	if filter.TargetType != "" {
+		query = query.Where("target_type = ?", filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		query = query.Where("target_id = ?", filter.TargetID)
+	}
+	query = filter.Created.Apply(query, table)
+
+	var events []Event
+	if err := page.Apply(query, table).Find(&events).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to list audit events: %w", err)
+	}
+	events, next := listing.Trim(events, page, func(e Event) listing.Cursor {
+		return listing.Cursor{CreatedAt: e.CreatedAt, ID: e.ID}
+	})
+	return events, next, nil
+}
@@ -0,0 +1,103 @@
+// Package audit keeps an append-only record of security- and game-relevant
+// actions: who did what, to what, from where and when.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Action names what happened, as "<area>.<verb>".
+type Action string
+
+const (
+	ActionTokenGenerate      Action = "token.generate"
+	ActionTokenBatchGenerate Action = "token.batch_generate"
+	ActionTokenBatchRevoke   Action = "token.batch_revoke"
+	ActionPlayerRegister     Action = "player.register"
+	ActionLogin              Action = "auth.login"
+	ActionLoginFailed        Action = "auth.login_failed"
+	ActionPasswordChange     Action = "account.password_change"
+	ActionAccountDelete      Action = "account.delete"
+	ActionOIDCLink           Action = "account.oidc_link"
+	ActionOIDCUnlink         Action = "account.oidc_unlink"
+	ActionStoryImport        Action = "story.import"
+	ActionCharacterOverride  Action = "character.override"
+)
+
+// Actions lists every action, for validating filters.
+var Actions = []Action{
+	ActionTokenGenerate, ActionTokenBatchGenerate, ActionTokenBatchRevoke, ActionPlayerRegister, ActionLogin,
+	ActionLoginFailed, ActionPasswordChange, ActionAccountDelete, ActionOIDCLink, ActionOIDCUnlink,
+	ActionStoryImport, ActionCharacterOverride,
+}
+
+func ValidAction(a string) bool {
+	for _, action := range Actions {
+		if string(action) == a {
+			return true
+		}
+	}
+	return false
+}
+
+// Target types.
+const (
+	TargetUser       = "user"
+	TargetToken      = "token"
+	TargetTokenBatch = "token_batch"
+	TargetStory      = "story"
+	TargetCharacter  = "character"
+)
+
+// Target is what an action was done to. The zero Target means the action
+// has none.
+type Target struct {
+	Type string
+	ID   string
+}
+
+// Metadata holds the details of an event. It is stored as a JSON object.
+type Metadata map[string]any
+
+// ErrAppendOnly is returned when something tries to change or delete an
+// event.
+var ErrAppendOnly = errors.New("audit events cannot be changed or deleted")
+
+// Event is one entry of the audit log. ActorID is nil when nobody was
+// logged in, as in a failed login; the username tried is then in Metadata.
+type Event struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primaryKey"`
+	CreatedAt  time.Time  `gorm:"index"`
+	ActorID    *uuid.UUID `gorm:"type:uuid;index"`
+	Action     Action     `gorm:"not null;index"`
+	TargetType string
+	TargetID   string `gorm:"index"`
+	Metadata   string `gorm:"type:text"`
+	IP         string
+}
+
+func (Event) TableName() string {
+	return "audit_events"
+}
+
+func (*Event) BeforeUpdate(*gorm.DB) error {
+	return ErrAppendOnly
+}
+
+func (*Event) BeforeDelete(*gorm.DB) error {
+	return ErrAppendOnly
+}
+
+// Details decodes Metadata. Events with unreadable metadata have none.
+func (e *Event) Details() Metadata {
+	var meta Metadata
+	if e.Metadata != "" {
+		_ = json.Unmarshal([]byte(e.Metadata), &meta)
+	}
+	return meta
+}
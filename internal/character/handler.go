@@ -0,0 +1,90 @@
+package character
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/apierror"
+	"github.com/nicolas-camacho/thrg/internal/audit"
+)
+
+type StatsDTO struct {
+	Misfortune float64 `json:"Misfortune"`
+	Locura     float64 `json:"Locura"`
+	Panico     float64 `json:"Panico"`
+	Ansiedad   float64 `json:"Ansiedad"`
+	Brillantes float64 `json:"Brillantes"`
+}
+
+func newStatsDTO(c *Character) StatsDTO {
+	return StatsDTO{
+		Misfortune: c.Misfortune,
+		Locura:     c.Locura,
+		Panico:     c.Panico,
+		Ansiedad:   c.Ansiedad,
+		Brillantes: c.Brillantes,
+	}
+}
+
+// OverrideCharacterHandler sets stats on a player's character by hand, for
+// game masters fixing a run. The stats left out of the body keep their
+// value, and the audit log records each one that changed with its old and
+// new value.
+func OverrideCharacterHandler(repo *Repository, auditLog *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := uuid.Parse(chi.URLParam(r, "userID"))
+		if err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid user ID"))
+			return
+		}
+
+		var req StatsOverride
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
+			return
+		}
+		if req.IsEmpty() {
+			apierror.Write(w, apierror.BadRequest("Set at least one stat"))
+			return
+		}
+
+		before, after, err := repo.OverrideStats(r.Context(), userID, req)
+		if err != nil {
+			if errors.Is(err, ErrNoCharacter) {
+				apierror.Write(w, apierror.NotFound("Character not found"))
+				return
+			}
+			log.Printf("Failed to override character of user %s: %v", userID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		meta := audit.Metadata{"userId": userID.String()}
+		old, updated := newStatsDTO(before), newStatsDTO(after)
+		for _, stat := range []struct {
+			name     string
+			from, to float64
+		}{
+			{"misfortune", old.Misfortune, updated.Misfortune},
+			{"locura", old.Locura, updated.Locura},
+			{"panico", old.Panico, updated.Panico},
+			{"ansiedad", old.Ansiedad, updated.Ansiedad},
+			{"brillantes", old.Brillantes, updated.Brillantes},
+		} {
+			if stat.from != stat.to {
+				meta[stat.name] = map[string]float64{"from": stat.from, "to": stat.to}
+			}
+		}
+		auditLog.Record(r, audit.ActionCharacterOverride, audit.Target{Type: audit.TargetCharacter, ID: after.ID.String()}, meta)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(updated); err != nil {
+			log.Printf("Error encoding character stats to JSON: %v", err)
+		}
+	}
+}
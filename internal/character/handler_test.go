@@ -0,0 +1,138 @@
+package character
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/audit"
+	"github.com/nicolas-camacho/thrg/internal/database"
+	"github.com/nicolas-camacho/thrg/internal/migrate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := database.Open(database.Config{
+		Driver: database.SQLite,
+		DSN:    filepath.Join(t.TempDir(), "thrg.db"),
+	})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	db.Logger = logger.Discard
+
+	migrator, err := migrate.New(db, database.SQLite)
+	if err != nil {
+		t.Fatalf("load migrations: %v", err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+func overrideCharacter(t *testing.T, handler http.HandlerFunc, userID, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	router := chi.NewRouter()
+	router.Patch("/admin/api/players/{userID}/character", handler)
+	req := httptest.NewRequest(http.MethodPatch, "/admin/api/players/"+userID+"/character", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestOverrideCharacterRecordsChangedStats(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewRepository(db)
+	auditLog := audit.NewLog(db)
+	handler := OverrideCharacterHandler(repo, auditLog)
+
+	userID := uuid.New()
+	character, err := repo.CreateCharacter(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("create character: %v", err)
+	}
+	character.Locura, character.Panico = 4, 2
+	if err := repo.UpdateCharacter(context.Background(), character); err != nil {
+		t.Fatalf("update character: %v", err)
+	}
+
+	rec := overrideCharacter(t, handler, userID.String(), `{"locura": 0, "panico": 2, "brillantes": 10}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("override answered %d: %s", rec.Code, rec.Body)
+	}
+
+	stored, err := repo.GetCharacterByUserID(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("reload character: %v", err)
+	}
+	if stored.Locura != 0 || stored.Panico != 2 || stored.Brillantes != 10 || stored.Misfortune != 0 {
+		t.Errorf("stats are %+v after the override", newStatsDTO(stored))
+	}
+
+	var event audit.Event
+	if err := db.Where("action = ?", audit.ActionCharacterOverride).First(&event).Error; err != nil {
+		t.Fatalf("find audit event: %v", err)
+	}
+	if event.TargetType != audit.TargetCharacter || event.TargetID != character.ID.String() {
+		t.Errorf("event target is %s %s, want %s %s", event.TargetType, event.TargetID, audit.TargetCharacter, character.ID)
+	}
+	meta := event.Details()
+	if meta["userId"] != userID.String() {
+		t.Errorf("event userId is %v, want %s", meta["userId"], userID)
+	}
+	if _, ok := meta["panico"]; ok {
+		t.Errorf("unchanged panico was recorded: %v", meta["panico"])
+	}
+	locura, _ := meta["locura"].(map[string]any)
+	if locura["from"] != 4.0 || locura["to"] != 0.0 {
+		t.Errorf("locura is recorded as %v, want from 4 to 0", meta["locura"])
+	}
+}
+
+func TestOverrideCharacterRejects(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewRepository(db)
+	handler := OverrideCharacterHandler(repo, audit.NewLog(db))
+
+	userID := uuid.New()
+	if _, err := repo.CreateCharacter(context.Background(), userID); err != nil {
+		t.Fatalf("create character: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		userID string
+		body   string
+		want   int
+	}{
+		{"invalid user ID", "nobody", `{"locura": 1}`, http.StatusBadRequest},
+		{"no stats", userID.String(), `{}`, http.StatusBadRequest},
+		{"invalid body", userID.String(), `{"locura": "high"}`, http.StatusBadRequest},
+		{"no character", uuid.NewString(), `{"locura": 1}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := overrideCharacter(t, handler, tt.userID, tt.body); rec.Code != tt.want {
+				t.Errorf("override answered %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+
+	var events int64
+	if err := db.Model(&audit.Event{}).Count(&events).Error; err != nil {
+		t.Fatalf("count audit events: %v", err)
+	}
+	if events != 0 {
+		t.Errorf("%d audit events recorded for refused overrides", events)
+	}
+}
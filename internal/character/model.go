@@ -8,19 +8,67 @@ import (
 )
 
 type Character struct {
-	ID        uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 
 	UserID uuid.UUID `gorm:"type:uuid;not null"`
 
+	// Party groups the players an admin invited to play together.
+	Party string `gorm:"index"`
+
 	CurrentStoryID *uuid.UUID `gorm:"type:uuid"`
 	CurrentActID   *uuid.UUID `gorm:"type:uuid"`
 
+	// RunID changes every time the character starts a story, so the journal
+	// and inventory of earlier runs are kept apart.
+	RunID      *uuid.UUID `gorm:"type:uuid"`
+	FinishedAt *time.Time
+	Ending     string
+
 	Misfortune float64 `gorm:"not null;default:0"`
 	Locura     float64 `gorm:"not null;default:0"`
 	Panico     float64 `gorm:"not null;default:0"`
 	Ansiedad   float64 `gorm:"not null;default:0"`
 	Brillantes float64 `gorm:"not null;default:0"`
 }
+
+const (
+	EndingCompleted  = "completed"
+	EndingMisfortune = "misfortune"
+)
+
+// JournalEntry records one choice made during a run. Act and option texts
+// are copied so later edits to the story do not rewrite a player's history.
+type JournalEntry struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
+	CreatedAt time.Time
+
+	CharacterID uuid.UUID `gorm:"type:uuid;not null;index"`
+	RunID       uuid.UUID `gorm:"type:uuid;not null;index"`
+	StoryID     uuid.UUID `gorm:"type:uuid;not null"`
+	ActID       uuid.UUID `gorm:"type:uuid;not null"`
+	OptionID    uuid.UUID `gorm:"type:uuid;not null"`
+
+	ActText      string `gorm:"not null"`
+	OptionText   string `gorm:"not null"`
+	Consequences string `gorm:"not null;default:'[]'"` // JSON-encoded []AppliedConsequence
+}
+
+type AppliedConsequence struct {
+	Type  string  `json:"Type"`
+	Item  string  `json:"Item,omitempty"`
+	Value float64 `json:"Value"`
+}
+
+type InventoryItem struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	CharacterID uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_inventory_character_run_name"`
+	RunID       uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_inventory_character_run_name"`
+	Name        string    `gorm:"not null;uniqueIndex:idx_inventory_character_run_name"`
+	Quantity    float64   `gorm:"not null;default:0"`
+}
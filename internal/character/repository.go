@@ -2,12 +2,24 @@ package character
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/dberr"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// ErrStoryDeleted is returned when starting a story that was deleted in the
+// meantime.
+var ErrStoryDeleted = errors.New("story was deleted")
+
+// ErrNoCharacter is returned when overriding the stats of a user who has no
+// character.
+var ErrNoCharacter = errors.New("user has no character")
+
 type Repository struct {
 	db *gorm.DB
 }
@@ -24,7 +36,7 @@ func (r *Repository) CreateCharacter(ctx context.Context, userID uuid.UUID) (*Ch
 	}
 
 	if err := r.db.WithContext(ctx).Create(&newCharacter).Error; err != nil {
-		return nil, fmt.Errorf("error creating character: %w", err)
+		return nil, fmt.Errorf("error creating character: %w", dberr.Classify(err))
 	}
 
 	return &newCharacter, nil
@@ -58,3 +70,271 @@ func (r *Repository) UpdateCharacter(ctx context.Context, character *Character)
 	}
 	return nil
 }
+
+// StatsOverride holds the stats an admin sets on a character. Nil stats are
+// left as they are.
+type StatsOverride struct {
+	Misfortune *float64 `json:"misfortune"`
+	Locura     *float64 `json:"locura"`
+	Panico     *float64 `json:"panico"`
+	Ansiedad   *float64 `json:"ansiedad"`
+	Brillantes *float64 `json:"brillantes"`
+}
+
+// IsEmpty reports whether the override changes nothing.
+func (o StatsOverride) IsEmpty() bool {
+	return o.Misfortune == nil && o.Locura == nil && o.Panico == nil && o.Ansiedad == nil && o.Brillantes == nil
+}
+
+// OverrideStats sets the stats in o on the user's character and returns the
+// character before and after. Only those stats are written, and the
+// character is locked while they change, so before is what the override
+// replaced. It fails with ErrNoCharacter if the user has none.
+func (r *Repository) OverrideStats(ctx context.Context, userID uuid.UUID, o StatsOverride) (before, after *Character, err error) {
+	err = r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var character Character
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&character, "user_id = ?", userID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNoCharacter
+			}
+			return err
+		}
+		original := character
+
+		updates := map[string]any{"updated_at": time.Now()}
+		for _, stat := range []struct {
+			column string
+			value  *float64
+			target *float64
+		}{
+			{"misfortune", o.Misfortune, &character.Misfortune},
+			{"locura", o.Locura, &character.Locura},
+			{"panico", o.Panico, &character.Panico},
+			{"ansiedad", o.Ansiedad, &character.Ansiedad},
+			{"brillantes", o.Brillantes, &character.Brillantes},
+		} {
+			if stat.value != nil {
+				*stat.target = *stat.value
+				updates[stat.column] = *stat.value
+			}
+		}
+		if err := tx.Model(&Character{}).Where("id = ?", character.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+		before, after = &original, &character
+		return nil
+	})
+	if errors.Is(err, ErrNoCharacter) {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error overriding character stats: %w", err)
+	}
+	return before, after, nil
+}
+
+// CountCharactersByStory returns how many characters are playing each story
+// right now, keyed by story ID. Characters that finished a story and have
+// not started another are not counted.
+func (r *Repository) CountCharactersByStory(ctx context.Context) (map[uuid.UUID]int64, error) {
+	var rows []struct {
+		CurrentStoryID uuid.UUID
+		Count          int64
+	}
+	err := r.db.WithContext(ctx).Model(&Character{}).
+		Select("current_story_id, COUNT(*) AS count").
+		Where("current_story_id IS NOT NULL AND finished_at IS NULL").
+		Group("current_story_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("error counting characters by story: %w", err)
+	}
+
+	counts := make(map[uuid.UUID]int64, len(rows))
+	for _, row := range rows {
+		counts[row.CurrentStoryID] = row.Count
+	}
+	return counts, nil
+}
+
+// StartStory puts the user's character at the given act of a story with
+// fresh stats, creating the character if the user does not have one yet.
+func (r *Repository) StartStory(ctx context.Context, userID, storyID, actID uuid.UUID) (*Character, error) {
+	var character *Character
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		character, err = StartStoryTx(tx, userID, storyID, actID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return character, nil
+}
+
+// StartStoryTx is StartStory for callers that are inside a transaction. It
+// keeps the story locked until the transaction ends, so it cannot be
+// deleted while the character moves in; see story.Repository.DeleteStory.
+// It fails with ErrStoryDeleted if the story is already gone.
+func StartStoryTx(tx *gorm.DB, userID, storyID, actID uuid.UUID) (*Character, error) {
+	var stories []uuid.UUID
+	err := tx.Table("stories").Clauses(clause.Locking{Strength: "SHARE"}).
+		Where("id = ? AND deleted_at IS NULL", storyID).
+		Pluck("id", &stories).Error
+	if err != nil {
+		return nil, fmt.Errorf("error starting story: %w", err)
+	}
+	if len(stories) == 0 {
+		return nil, ErrStoryDeleted
+	}
+
+	var character Character
+	if err := tx.Where(Character{UserID: userID}).FirstOrCreate(&character).Error; err != nil {
+		return nil, fmt.Errorf("error starting story: %w", err)
+	}
+
+	runID := uuid.New()
+	character.CurrentStoryID = &storyID
+	character.CurrentActID = &actID
+	character.RunID = &runID
+	character.FinishedAt = nil
+	character.Ending = ""
+	character.Misfortune = 0
+	character.Locura = 0
+	character.Panico = 0
+	character.Ansiedad = 0
+	character.Brillantes = 0
+	if err := tx.Save(&character).Error; err != nil {
+		return nil, fmt.Errorf("error starting story: %w", err)
+	}
+	return &character, nil
+}
+
+// JoinPartyTx puts the user's character in a party, creating the character
+// if the user does not have one yet. It runs inside the caller's
+// transaction.
+func JoinPartyTx(tx *gorm.DB, userID uuid.UUID, party string) error {
+	var character Character
+	if err := tx.Where(Character{UserID: userID}).FirstOrCreate(&character).Error; err != nil {
+		return fmt.Errorf("error joining party: %w", err)
+	}
+	if err := tx.Model(&character).Update("party", party).Error; err != nil {
+		return fmt.Errorf("error joining party: %w", err)
+	}
+	return nil
+}
+
+// AdvanceCharacter stores the outcome of a choice: the character's new
+// stats and position, the journal entry and the inventory changes. It only
+// applies if the character is still at fromActID, so a choice submitted twice
+// is applied once; it returns false otherwise.
+func (r *Repository) AdvanceCharacter(ctx context.Context, character *Character, fromActID uuid.UUID, entry *JournalEntry, itemDeltas map[string]float64) (bool, error) {
+	applied := false
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Character{}).
+			Where("id = ? AND current_act_id = ? AND finished_at IS NULL", character.ID, fromActID).
+			Updates(map[string]any{
+				"current_act_id": character.CurrentActID,
+				"finished_at":    character.FinishedAt,
+				"ending":         character.Ending,
+				"misfortune":     character.Misfortune,
+				"locura":         character.Locura,
+				"panico":         character.Panico,
+				"ansiedad":       character.Ansiedad,
+				"brillantes":     character.Brillantes,
+				"updated_at":     time.Now(),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+
+		if err := tx.Create(entry).Error; err != nil {
+			return err
+		}
+
+		for name, delta := range itemDeltas {
+			item := InventoryItem{CharacterID: character.ID, RunID: entry.RunID, Name: name}
+			if err := tx.Where(item).FirstOrCreate(&item).Error; err != nil {
+				return err
+			}
+			item.Quantity = max(item.Quantity+delta, 0)
+			if err := tx.Save(&item).Error; err != nil {
+				return err
+			}
+		}
+
+		applied = true
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("error advancing character: %w", err)
+	}
+	return applied, nil
+}
+
+func (r *Repository) GetJournal(ctx context.Context, characterID, runID uuid.UUID) ([]JournalEntry, error) {
+	var entries []JournalEntry
+	err := r.db.WithContext(ctx).
+		Where("character_id = ? AND run_id = ?", characterID, runID).
+		Order("created_at").
+		Find(&entries).Error
+	if err != nil {
+		return nil, fmt.Errorf("error getting journal: %w", err)
+	}
+	return entries, nil
+}
+
+func (r *Repository) GetInventory(ctx context.Context, characterID, runID uuid.UUID) ([]InventoryItem, error) {
+	var items []InventoryItem
+	err := r.db.WithContext(ctx).
+		Where("character_id = ? AND run_id = ? AND quantity > 0", characterID, runID).
+		Order("name").
+		Find(&items).Error
+	if err != nil {
+		return nil, fmt.Errorf("error getting inventory: %w", err)
+	}
+	return items, nil
+}
+
+// AnonymizeTx clears what ties a deleted player's characters to them beyond
+// their user ID, which no longer leads to any personal data. The characters
+// and their journals stay so their runs still count in story statistics.
+func AnonymizeTx(tx *gorm.DB, userID uuid.UUID) error {
+	if err := tx.Model(&Character{}).Where("user_id = ?", userID).Update("party", "").Error; err != nil {
+		return fmt.Errorf("error anonymizing characters: %w", err)
+	}
+	return nil
+}
+
+// DataExport is everything stored about a player's character, across all
+// their runs, for the player's own data download.
+type DataExport struct {
+	Character *Character
+	Journal   []JournalEntry
+	Inventory []InventoryItem
+}
+
+// ExportUserData gathers the character of the user with its full journal
+// and inventory. Character is nil if the user never played.
+func (r *Repository) ExportUserData(ctx context.Context, userID uuid.UUID) (*DataExport, error) {
+	export := &DataExport{Journal: []JournalEntry{}, Inventory: []InventoryItem{}}
+	character, err := r.GetCharacterByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if character == nil {
+		return export, nil
+	}
+	export.Character = character
+
+	if err := r.db.WithContext(ctx).Where("character_id = ?", character.ID).Order("created_at").Find(&export.Journal).Error; err != nil {
+		return nil, fmt.Errorf("error exporting journal: %w", err)
+	}
+	if err := r.db.WithContext(ctx).Where("character_id = ?", character.ID).Order("run_id, name").Find(&export.Inventory).Error; err != nil {
+		return nil, fmt.Errorf("error exporting inventory: %w", err)
+	}
+	return export, nil
+}
@@ -0,0 +1,39 @@
+package character
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCountCharactersByStorySkipsFinishedRuns(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewRepository(db)
+
+	storyID, otherStoryID := uuid.New(), uuid.New()
+	finishedAt := time.Now()
+	for _, c := range []Character{
+		{UserID: uuid.New(), CurrentStoryID: &storyID},
+		{UserID: uuid.New(), CurrentStoryID: &storyID},
+		{UserID: uuid.New(), CurrentStoryID: &storyID, FinishedAt: &finishedAt, Ending: EndingCompleted},
+		{UserID: uuid.New(), CurrentStoryID: &otherStoryID, FinishedAt: &finishedAt, Ending: EndingMisfortune},
+		{UserID: uuid.New()},
+	} {
+		if err := db.Create(&c).Error; err != nil {
+			t.Fatalf("create character: %v", err)
+		}
+	}
+
+	counts, err := repo.CountCharactersByStory(context.Background())
+	if err != nil {
+		t.Fatalf("CountCharactersByStory: %v", err)
+	}
+	if counts[storyID] != 2 {
+		t.Errorf("story has %d players, want the 2 still playing", counts[storyID])
+	}
+	if n, ok := counts[otherStoryID]; ok {
+		t.Errorf("story with only a finished run has %d players", n)
+	}
+}
@@ -0,0 +1,43 @@
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBearerSkipsCheckOnlyOnAdminAPI(t *testing.T) {
+	handler := Middleware(false)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name   string
+		path   string
+		bearer bool
+		want   int
+	}{
+		{"admin API with token", "/admin/api/tokens", true, http.StatusNoContent},
+		{"admin API without token", "/admin/api/tokens", false, http.StatusForbidden},
+		{"player API with token", "/player/api/game/choices", true, http.StatusForbidden},
+		{"player account with token", "/player/api/account", true, http.StatusForbidden},
+		{"lookalike path with token", "/admin/apis", true, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			// The session cookies a browser would attach cross-site, without
+			// the CSRF token only a same-site page can read.
+			req.AddCookie(&http.Cookie{Name: CookieName, Value: "victim-token"})
+			req.AddCookie(&http.Cookie{Name: "player-session", Value: "victim-session"})
+			if tt.bearer {
+				req.Header.Set("Authorization", "Bearer thrg_anything")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s answered %d, want %d", req.Method, tt.path, rec.Code, tt.want)
+			}
+		})
+	}
+}
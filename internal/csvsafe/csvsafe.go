@@ -0,0 +1,40 @@
+// Package csvsafe writes CSV files that are safe to open in a spreadsheet:
+// cells that a spreadsheet would run as a formula are written as text.
+package csvsafe
+
+import (
+	"encoding/csv"
+	"io"
+	"strings"
+)
+
+// formulaPrefixes are the first characters that make Excel, LibreOffice and
+// Google Sheets treat a cell as a formula.
+const formulaPrefixes = "=+-@\t\r"
+
+// Escape prefixes cell with a single quote if it starts like a formula, so
+// the spreadsheet shows it as text instead of running it.
+func Escape(cell string) string {
+	if cell != "" && strings.ContainsRune(formulaPrefixes, rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// Writer is a csv.Writer that escapes every cell it writes.
+type Writer struct {
+	*csv.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{Writer: csv.NewWriter(w)}
+}
+
+// Write writes one record with its cells escaped.
+func (w *Writer) Write(record []string) error {
+	escaped := make([]string, len(record))
+	for i, cell := range record {
+		escaped[i] = Escape(cell)
+	}
+	return w.Writer.Write(escaped)
+}
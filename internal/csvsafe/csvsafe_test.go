@@ -0,0 +1,43 @@
+package csvsafe
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		cell, want string
+	}{
+		{"", ""},
+		{"gamer-01", "gamer-01"},
+		{"1.5", "1.5"},
+		{`{"label":"=1"}`, `{"label":"=1"}`},
+		{"=HYPERLINK(\"http://evil\")", "'=HYPERLINK(\"http://evil\")"},
+		{"+1+1", "'+1+1"},
+		{"-1+1", "'-1+1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"\r=1", "'\r=1"},
+	}
+	for _, tt := range tests {
+		if got := Escape(tt.cell); got != tt.want {
+			t.Errorf("Escape(%q) = %q, want %q", tt.cell, got, tt.want)
+		}
+	}
+}
+
+func TestWriterEscapesEveryCell(t *testing.T) {
+	var b strings.Builder
+	w := NewWriter(&b)
+	if err := w.Write([]string{"=cmd", "ok", "@x"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got, want := b.String(), "'=cmd,ok,'@x\n"; got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
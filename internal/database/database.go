@@ -0,0 +1,135 @@
+// Package database opens the database the app runs on. DB_DRIVER picks
+// it: PostgreSQL, the default, or SQLite, which keeps everything in a single
+// file for local development and tests.
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/glebarez/sqlite"
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+)
+
+// DefaultSQLitePath is where the SQLite database lives unless DB_PATH says
+// otherwise.
+const DefaultSQLitePath = "thrg.db"
+
+type Config struct {
+	Driver string
+	// DSN is the PostgreSQL connection string or the SQLite file; ":memory:"
+	// keeps a SQLite database in memory until the process exits.
+	DSN string
+}
+
+// ConfigFromEnv reads DB_DRIVER and the settings of the driver it names:
+// DB_HOST, DB_USER, DB_PASSWORD, DB_NAME and DB_PORT for PostgreSQL, and
+// DB_PATH for SQLite.
+func ConfigFromEnv() (Config, error) {
+	switch driver := os.Getenv("DB_DRIVER"); driver {
+	case "", Postgres:
+		return Config{
+			Driver: Postgres,
+			DSN: fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
+				os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"),
+				os.Getenv("DB_NAME"), os.Getenv("DB_PORT")),
+		}, nil
+	case SQLite:
+		path := os.Getenv("DB_PATH")
+		if path == "" {
+			path = DefaultSQLitePath
+		}
+		return Config{Driver: SQLite, DSN: path}, nil
+	default:
+		return Config{}, fmt.Errorf("DB_DRIVER must be %s or %s", Postgres, SQLite)
+	}
+}
+
+// Open connects to the database in cfg. Primary keys of type uuid.UUID are
+// generated in Go on insert, so the schema needs no database extension.
+func Open(cfg Config) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch cfg.Driver {
+	case Postgres:
+		dialector = postgres.Open(cfg.DSN)
+	case SQLite:
+		// SQLite leaves foreign keys unchecked unless asked, and fails at
+		// once on a locked database instead of waiting for it. Transactions
+		// take the write lock when they begin, so two of them never
+		// deadlock upgrading a read to a write; migrate relies on it too.
+		sep := "?"
+		if strings.Contains(cfg.DSN, "?") {
+			sep = "&"
+		}
+		dialector = sqlite.Open(cfg.DSN + sep + "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_txlock=immediate")
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", cfg.Driver)
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Driver == SQLite {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		// SQLite takes one writer at a time, and every connection to
+		// ":memory:" would open a database of its own.
+		sqlDB.SetMaxOpenConns(1)
+	}
+
+	if err := db.Callback().Create().Before("gorm:create").Register("database:uuid", assignUUIDs); err != nil {
+		return nil, fmt.Errorf("failed to register UUID callback: %w", err)
+	}
+	return db, nil
+}
+
+var uuidType = reflect.TypeOf(uuid.UUID{})
+
+// assignUUIDs gives a new UUID to every record about to be created whose
+// primary key is a zero uuid.UUID.
+func assignUUIDs(db *gorm.DB) {
+	if db.Statement.Schema == nil {
+		return
+	}
+	field := db.Statement.Schema.PrioritizedPrimaryField
+	if field == nil || field.FieldType != uuidType {
+		return
+	}
+
+	ctx := db.Statement.Context
+	switch rv := db.Statement.ReflectValue; rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if err := assignUUID(ctx, field, reflect.Indirect(rv.Index(i))); err != nil {
+				db.AddError(err)
+				return
+			}
+		}
+	case reflect.Struct:
+		if err := assignUUID(ctx, field, rv); err != nil {
+			db.AddError(err)
+		}
+	}
+}
+
+func assignUUID(ctx context.Context, field *schema.Field, rv reflect.Value) error {
+	if _, zero := field.ValueOf(ctx, rv); !zero {
+		return nil
+	}
+	return field.Set(ctx, rv, uuid.New())
+}
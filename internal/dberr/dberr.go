@@ -0,0 +1,98 @@
+// Package dberr tells database errors apart whatever the database behind
+// gorm is, so repositories can turn them into errors of their own.
+package dberr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// uniqueViolation is PostgreSQL's SQLSTATE for a duplicate key.
+const uniqueViolation = "23505"
+
+// sqliteUnique starts SQLite's message for a duplicate key, with every
+// driver: "UNIQUE constraint failed: users.username".
+const sqliteUnique = "UNIQUE constraint failed: "
+
+// ErrConflict matches every ConflictError.
+var ErrConflict = errors.New("unique constraint violated")
+
+// ConflictError is a write refused because it would duplicate a unique key.
+type ConflictError struct {
+	// Constraint names what was violated: the index on PostgreSQL, such as
+	// "idx_users_username", and the columns on SQLite, such as
+	// "users.username".
+	Constraint string
+	Err        error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("unique constraint %s violated", e.Constraint)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// Classify returns a *ConflictError if err is a unique violation, and err
+// otherwise.
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		return err
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		if pgErr.Code == uniqueViolation {
+			return &ConflictError{Constraint: pgErr.ConstraintName, Err: err}
+		}
+		return err
+	}
+
+	// SQLite drivers differ in their error types but not in the message.
+	if i := strings.Index(err.Error(), sqliteUnique); i >= 0 {
+		constraint := err.Error()[i+len(sqliteUnique):]
+		if end := strings.Index(constraint, " ("); end >= 0 {
+			constraint = constraint[:end]
+		}
+		return &ConflictError{Constraint: constraint, Err: err}
+	}
+	return err
+}
+
+// IsUniqueViolation reports whether err is a unique violation.
+func IsUniqueViolation(err error) bool {
+	return errors.Is(Classify(err), ErrConflict)
+}
+
+// Violates reports whether err is a unique violation of the named index or
+// of any of the given columns. Indexes are named as on PostgreSQL and
+// columns as "table.column", as SQLite reports them.
+func Violates(err error, index string, columns ...string) bool {
+	var conflict *ConflictError
+	if !errors.As(Classify(err), &conflict) {
+		return false
+	}
+	if conflict.Constraint == index {
+		return true
+	}
+	for _, column := range columns {
+		for _, violated := range strings.Split(conflict.Constraint, ", ") {
+			if violated == column {
+				return true
+			}
+		}
+	}
+	return false
+}
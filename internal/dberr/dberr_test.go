@@ -0,0 +1,135 @@
+package dberr
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/nicolas-camacho/thrg/internal/database"
+	"gorm.io/gorm/logger"
+)
+
+func TestClassify(t *testing.T) {
+	usernameTaken := &pgconn.PgError{Code: "23505", ConstraintName: "idx_users_username"}
+	notNull := &pgconn.PgError{Code: "23502", ColumnName: "username"}
+
+	tests := []struct {
+		name       string
+		err        error
+		constraint string // "" when err is not a conflict
+	}{
+		{"postgres unique violation", usernameTaken, "idx_users_username"},
+		{"wrapped postgres unique violation", fmt.Errorf("error creating user: %w", usernameTaken), "idx_users_username"},
+		{"postgres not null violation", notNull, ""},
+		{"sqlite one column", errors.New("constraint failed: UNIQUE constraint failed: users.username (2067)"), "users.username"},
+		{"sqlite several columns", errors.New("constraint failed: UNIQUE constraint failed: users.oidc_issuer, users.oidc_subject (2067)"), "users.oidc_issuer, users.oidc_subject"},
+		{"sqlite without result code", errors.New("UNIQUE constraint failed: stories.holder_name"), "stories.holder_name"},
+		{"sqlite not null violation", errors.New("constraint failed: NOT NULL constraint failed: users.username (1299)"), ""},
+		{"other error", errors.New("connection refused"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			classified := Classify(tt.err)
+			var conflict *ConflictError
+			isConflict := errors.As(classified, &conflict)
+
+			if tt.constraint == "" {
+				if isConflict || IsUniqueViolation(tt.err) {
+					t.Fatalf("Classify(%v) = %v, want no conflict", tt.err, classified)
+				}
+				if classified != tt.err {
+					t.Errorf("Classify changed %v into %v", tt.err, classified)
+				}
+				return
+			}
+			if !isConflict {
+				t.Fatalf("Classify(%v) = %v, want a conflict", tt.err, classified)
+			}
+			if conflict.Constraint != tt.constraint {
+				t.Errorf("constraint is %q, want %q", conflict.Constraint, tt.constraint)
+			}
+			if !errors.Is(classified, ErrConflict) || !IsUniqueViolation(tt.err) {
+				t.Errorf("%v does not match ErrConflict", classified)
+			}
+			if !errors.Is(classified, tt.err) {
+				t.Errorf("%v does not wrap the original error", classified)
+			}
+			if again := Classify(classified); again != classified {
+				t.Errorf("classifying twice gave %v", again)
+			}
+		})
+	}
+
+	if Classify(nil) != nil {
+		t.Error("Classify(nil) is not nil")
+	}
+}
+
+func TestViolates(t *testing.T) {
+	oidcTaken := errors.New("constraint failed: UNIQUE constraint failed: users.oidc_issuer, users.oidc_subject (2067)")
+
+	tests := []struct {
+		name    string
+		err     error
+		index   string
+		columns []string
+		want    bool
+	}{
+		{"postgres index", &pgconn.PgError{Code: "23505", ConstraintName: "idx_users_username"}, "idx_users_username", []string{"users.username"}, true},
+		{"wrapped postgres index", fmt.Errorf("save: %w", &pgconn.PgError{Code: "23505", ConstraintName: "idx_users_username"}), "idx_users_username", []string{"users.username"}, true},
+		{"postgres other index", &pgconn.PgError{Code: "23505", ConstraintName: "idx_users_oidc_identity"}, "idx_users_username", []string{"users.username"}, false},
+		{"postgres other error", &pgconn.PgError{Code: "23503", ConstraintName: "idx_users_username"}, "idx_users_username", nil, false},
+		{"sqlite one column", errors.New("UNIQUE constraint failed: users.username (2067)"), "idx_users_username", []string{"users.username"}, true},
+		{"sqlite other column", errors.New("UNIQUE constraint failed: users.email (2067)"), "idx_users_username", []string{"users.username"}, false},
+		{"sqlite column prefix", errors.New("UNIQUE constraint failed: users.username_lower (2067)"), "idx_users_username", []string{"users.username"}, false},
+		{"sqlite several columns", oidcTaken, "idx_users_oidc_identity", []string{"users.oidc_issuer", "users.oidc_subject"}, true},
+		{"sqlite several columns, one asked", oidcTaken, "idx_users_oidc_identity", []string{"users.oidc_subject"}, true},
+		{"sqlite several columns, other asked", oidcTaken, "idx_users_username", []string{"users.username"}, false},
+		{"not a database error", errors.New("boom"), "idx_users_username", []string{"users.username"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Violates(tt.err, tt.index, tt.columns...); got != tt.want {
+				t.Errorf("Violates(%v, %q, %q) = %v, want %v", tt.err, tt.index, tt.columns, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestClassifySQLiteDriver checks the messages the SQLite driver really
+// returns, not only the ones written above.
+func TestClassifySQLiteDriver(t *testing.T) {
+	db, err := database.Open(database.Config{
+		Driver: database.SQLite,
+		DSN:    filepath.Join(t.TempDir(), "thrg.db"),
+	})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	db.Logger = logger.Discard
+
+	for _, stmt := range []string{
+		"CREATE TABLE users (username TEXT, oidc_issuer TEXT, oidc_subject TEXT)",
+		"CREATE UNIQUE INDEX idx_users_username ON users (username)",
+		"CREATE UNIQUE INDEX idx_users_oidc_identity ON users (oidc_issuer, oidc_subject)",
+		"INSERT INTO users VALUES ('ana', 'https://idp', 'sub-1')",
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	err = db.Exec("INSERT INTO users VALUES ('ana', 'https://idp', 'sub-2')").Error
+	if !Violates(err, "idx_users_username", "users.username") {
+		t.Errorf("duplicate username %v is not a violation of users.username", err)
+	}
+	err = db.Exec("INSERT INTO users VALUES ('bea', 'https://idp', 'sub-1')").Error
+	if !Violates(err, "idx_users_oidc_identity", "users.oidc_issuer", "users.oidc_subject") {
+		t.Errorf("duplicate identity %v is not a violation of the OIDC identity", err)
+	}
+	if Violates(err, "idx_users_username", "users.username") {
+		t.Errorf("duplicate identity %v is taken for a duplicate username", err)
+	}
+}
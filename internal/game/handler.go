@@ -0,0 +1,228 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/apierror"
+	"github.com/nicolas-camacho/thrg/internal/character"
+	"github.com/nicolas-camacho/thrg/internal/contextutil"
+	"github.com/nicolas-camacho/thrg/internal/csrf"
+	"github.com/nicolas-camacho/thrg/web"
+)
+
+const gamePagePath = "/player/game"
+
+var gameTmpl *template.Template
+
+func init() {
+	var err error
+	gameTmpl, err = template.New("game.html").Funcs(template.FuncMap{
+		"consequence": formatConsequence,
+		"ending":      endingMessage,
+		"number":      formatNumber,
+	}).ParseFS(web.Templates, "game.html")
+	if err != nil {
+		log.Fatalf("Failed to parse game template: %v", err)
+	}
+}
+
+var statLabels = map[string]string{
+	"locura":     "Locura",
+	"panico":     "Pánico",
+	"ansiedad":   "Ansiedad",
+	"brillantes": "Brillantes",
+	"desgracia":  "Desgracia",
+}
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func formatConsequence(c character.AppliedConsequence) string {
+	sign := "+"
+	if c.Value < 0 {
+		sign = ""
+	}
+	if c.Item != "" {
+		return fmt.Sprintf("%s %s%s", c.Item, sign, formatNumber(c.Value))
+	}
+	label, ok := statLabels[c.Type]
+	if !ok {
+		label = c.Type
+	}
+	return fmt.Sprintf("%s %s%s", label, sign, formatNumber(c.Value))
+}
+
+func endingMessage(kind string) string {
+	if kind == character.EndingMisfortune {
+		return "La desgracia te ha alcanzado. Tu historia termina aquí."
+	}
+	return "Has llegado al final de la historia."
+}
+
+// isFormPost tells plain HTML form submissions (the no-JS page) apart from
+// API calls, so the same endpoint can redirect the former and answer JSON to
+// the latter.
+func isFormPost(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data"
+}
+
+func playerID(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	userID, ok := contextutil.GetUserIDFromContext(r.Context())
+	if !ok || userID == uuid.Nil {
+		apierror.Write(w, apierror.Unauthorized("Unauthorized"))
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+func init() {
+	apierror.Register(ErrStoryNotFound, apierror.New(http.StatusNotFound, "story_not_found", "Story not found"))
+	apierror.Register(ErrStoryHasNoActs, apierror.New(http.StatusConflict, "story_has_no_acts", "Story has no acts"))
+	apierror.Register(ErrNoActiveStory, apierror.New(http.StatusConflict, "not_playing", "You are not playing a story"))
+	apierror.Register(ErrStoryFinished, apierror.New(http.StatusConflict, "story_finished", "This story has already finished"))
+	apierror.Register(ErrInvalidOption, apierror.New(http.StatusConflict, "option_unavailable", "That option is not available"))
+}
+
+// pageData is what the game template receives: the current state plus the
+// CSRF token its forms and scripts have to send back.
+type pageData struct {
+	*State
+	CSRFToken string
+}
+
+// PageHandler renders the game page on the server, so it works without
+// JavaScript; the script in the page then takes over using the JSON API.
+func PageHandler(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := playerID(w, r)
+		if !ok {
+			return
+		}
+
+		state, err := service.State(r.Context(), userID)
+		if err != nil {
+			apierror.Write(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := gameTmpl.Execute(w, pageData{State: state, CSRFToken: csrf.Token(r)}); err != nil {
+			log.Printf("Failed to render game page: %v", err)
+		}
+	}
+}
+
+func StateHandler(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := playerID(w, r)
+		if !ok {
+			return
+		}
+
+		state, err := service.State(r.Context(), userID)
+		if err != nil {
+			apierror.Write(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(state); err != nil {
+			log.Printf("Error encoding game state to JSON: %v", err)
+		}
+	}
+}
+
+// StartStoryHandler lets a player start an open story on their own. The
+// player's character is created if needed and placed at the first act.
+func StartStoryHandler(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := playerID(w, r)
+		if !ok {
+			return
+		}
+
+		storyID, err := uuid.Parse(chi.URLParam(r, "storyID"))
+		if err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid story ID"))
+			return
+		}
+
+		if _, err := service.StartStory(r.Context(), userID, storyID); err != nil {
+			apierror.Write(w, err)
+			return
+		}
+
+		if isFormPost(r) {
+			http.Redirect(w, r, gamePagePath, http.StatusSeeOther)
+			return
+		}
+
+		state, err := service.State(r.Context(), userID)
+		if err != nil {
+			apierror.Write(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]any{
+			"message": "Story started successfully",
+			"state":   state,
+		})
+	}
+}
+
+type chooseRequest struct {
+	OptionID uuid.UUID `json:"optionId"`
+}
+
+func ChooseHandler(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := playerID(w, r)
+		if !ok {
+			return
+		}
+
+		form := isFormPost(r)
+		var req chooseRequest
+		if form {
+			optionID, err := uuid.Parse(r.FormValue("optionId"))
+			if err != nil {
+				apierror.Write(w, apierror.BadRequest("Invalid option ID"))
+				return
+			}
+			req.OptionID = optionID
+		} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
+			return
+		}
+
+		result, err := service.Choose(r.Context(), userID, req.OptionID)
+		if err != nil {
+			apierror.Write(w, err)
+			return
+		}
+
+		if form {
+			http.Redirect(w, r, gamePagePath, http.StatusSeeOther)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Printf("Error encoding choice result to JSON: %v", err)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/character"
+	"github.com/nicolas-camacho/thrg/internal/story"
+)
+
+var (
+	ErrStoryNotFound  = errors.New("story not found")
+	ErrStoryHasNoActs = errors.New("story has no acts")
+	ErrNoActiveStory  = errors.New("character is not in a story")
+	ErrStoryFinished  = errors.New("story already finished")
+	ErrInvalidOption  = errors.New("option is not available in the current act")
+)
+
+// Service runs the game for players: it reads the character's position in
+// a story and applies the choices they make.
+type Service struct {
+	stories    *story.Repository
+	characters *character.Repository
+}
+
+func NewService(stories *story.Repository, characters *character.Repository) *Service {
+	return &Service{
+		stories:    stories,
+		characters: characters,
+	}
+}
+
+// StartStory places the player's character at the first act of an open
+// story, starting a new run.
+func (s *Service) StartStory(ctx context.Context, userID, storyID uuid.UUID) (*character.Character, error) {
+	st, err := s.stories.GetStoryInfo(ctx, storyID)
+	if err != nil {
+		return nil, err
+	}
+	// Stories that are not open are reported as missing so players cannot
+	// probe for hidden ones.
+	if st == nil || st.Visibility != story.VisibilityOpen {
+		return nil, ErrStoryNotFound
+	}
+
+	firstAct, err := s.stories.GetFirstAct(ctx, storyID)
+	if err != nil {
+		return nil, err
+	}
+	if firstAct == nil {
+		return nil, ErrStoryHasNoActs
+	}
+
+	c, err := s.characters.StartStory(ctx, userID, storyID, firstAct.ID)
+	if errors.Is(err, character.ErrStoryDeleted) {
+		return nil, ErrStoryNotFound
+	}
+	return c, err
+}
+
+// State is everything the game page shows.
+type State struct {
+	Story     *StoryView             `json:"Story"`
+	Act       *ActView               `json:"Act"`
+	Options   []OptionView           `json:"Options"`
+	Stats     StatsView              `json:"Stats"`
+	Inventory []ItemView             `json:"Inventory"`
+	Journal   []JournalView          `json:"Journal"`
+	Ending    *EndingView            `json:"Ending"`
+	Library   []story.PlayerStoryDTO `json:"Library"`
+	Party     string                 `json:"Party"`
+}
+
+type StoryView struct {
+	ID                  uuid.UUID `json:"ID"`
+	Title               string    `json:"Title"`
+	MisfortuneThreshold float64   `json:"MisfortuneThreshold"`
+}
+
+type ActView struct {
+	ID    uuid.UUID `json:"ID"`
+	Order int       `json:"Order"`
+	Text  string    `json:"Text"`
+}
+
+type OptionView struct {
+	ID   uuid.UUID `json:"ID"`
+	Text string    `json:"Text"`
+}
+
+type StatsView struct {
+	Misfortune float64 `json:"Misfortune"`
+	Locura     float64 `json:"Locura"`
+	Panico     float64 `json:"Panico"`
+	Ansiedad   float64 `json:"Ansiedad"`
+	Brillantes float64 `json:"Brillantes"`
+}
+
+type ItemView struct {
+	Name     string  `json:"Name"`
+	Quantity float64 `json:"Quantity"`
+}
+
+type JournalView struct {
+	ActText      string                         `json:"ActText"`
+	OptionText   string                         `json:"OptionText"`
+	Consequences []character.AppliedConsequence `json:"Consequences"`
+	CreatedAt    time.Time                      `json:"CreatedAt"`
+}
+
+type EndingView struct {
+	Kind       string    `json:"Kind"`
+	FinishedAt time.Time `json:"FinishedAt"`
+}
+
+// State returns the player's current game. Players without a story in
+// progress get the library of open stories instead of an act.
+func (s *Service) State(ctx context.Context, userID uuid.UUID) (*State, error) {
+	state := &State{Options: []OptionView{}, Inventory: []ItemView{}, Journal: []JournalView{}}
+
+	c, err := s.characters.GetCharacterByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if c != nil {
+		state.Party = c.Party
+	}
+	if c != nil && c.CurrentStoryID != nil && c.CurrentActID != nil {
+		if err := s.fillRun(ctx, state, c); err != nil {
+			return nil, err
+		}
+	}
+
+	if state.Act == nil || state.Ending != nil {
+		summaries, err := s.stories.GetOpenStorySummaries(ctx)
+		if err != nil {
+			return nil, err
+		}
+		state.Library = make([]story.PlayerStoryDTO, len(summaries))
+		for i, sum := range summaries {
+			state.Library[i] = story.PlayerStoryDTO{ID: sum.ID, Title: sum.Title, Description: sum.Description, ActCount: sum.ActCount}
+		}
+	}
+	return state, nil
+}
+
+func (s *Service) fillRun(ctx context.Context, state *State, c *character.Character) error {
+	st, err := s.stories.GetStoryInfo(ctx, *c.CurrentStoryID)
+	if err != nil {
+		return err
+	}
+	act, err := s.stories.GetStoryActByID(ctx, *c.CurrentActID)
+	if err != nil {
+		return err
+	}
+	if st == nil || act == nil {
+		// The story was deleted from under the character.
+		return nil
+	}
+
+	state.Story = &StoryView{ID: st.ID, Title: st.Title, MisfortuneThreshold: st.MisfortuneThreshold}
+	state.Act = &ActView{ID: act.ID, Order: act.Order, Text: act.Text}
+	state.Stats = StatsView{
+		Misfortune: c.Misfortune,
+		Locura:     c.Locura,
+		Panico:     c.Panico,
+		Ansiedad:   c.Ansiedad,
+		Brillantes: c.Brillantes,
+	}
+
+	if c.FinishedAt != nil {
+		state.Ending = &EndingView{Kind: c.Ending, FinishedAt: *c.FinishedAt}
+	} else {
+		for _, o := range act.Options {
+			state.Options = append(state.Options, OptionView{ID: o.ID, Text: o.Text})
+		}
+	}
+
+	if c.RunID == nil {
+		return nil
+	}
+
+	items, err := s.characters.GetInventory(ctx, c.ID, *c.RunID)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		state.Inventory = append(state.Inventory, ItemView{Name: item.Name, Quantity: item.Quantity})
+	}
+
+	entries, err := s.characters.GetJournal(ctx, c.ID, *c.RunID)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		view := JournalView{ActText: e.ActText, OptionText: e.OptionText, CreatedAt: e.CreatedAt}
+		if err := json.Unmarshal([]byte(e.Consequences), &view.Consequences); err != nil {
+			return fmt.Errorf("error decoding journal entry %s: %w", e.ID, err)
+		}
+		state.Journal = append(state.Journal, view)
+	}
+	return nil
+}
+
+// ChoiceResult is what happened after a choice, plus the new state.
+type ChoiceResult struct {
+	Applied []character.AppliedConsequence `json:"Applied"`
+	State   *State                         `json:"State"`
+}
+
+// Choose applies an option of the character's current act: its
+// consequences, the move to the next act and, if the story is over, the
+// ending.
+func (s *Service) Choose(ctx context.Context, userID, optionID uuid.UUID) (*ChoiceResult, error) {
+	c, err := s.characters.GetCharacterByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil || c.CurrentStoryID == nil || c.CurrentActID == nil || c.RunID == nil {
+		return nil, ErrNoActiveStory
+	}
+	if c.FinishedAt != nil {
+		return nil, ErrStoryFinished
+	}
+
+	st, err := s.stories.GetStoryInfo(ctx, *c.CurrentStoryID)
+	if err != nil {
+		return nil, err
+	}
+	act, err := s.stories.GetStoryActByID(ctx, *c.CurrentActID)
+	if err != nil {
+		return nil, err
+	}
+	if st == nil || act == nil {
+		return nil, ErrNoActiveStory
+	}
+
+	var option *story.Option
+	for i := range act.Options {
+		if act.Options[i].ID == optionID {
+			option = &act.Options[i]
+			break
+		}
+	}
+	if option == nil {
+		return nil, ErrInvalidOption
+	}
+
+	applied := make([]character.AppliedConsequence, 0, len(option.Consequences))
+	itemDeltas := make(map[string]float64)
+	for _, cons := range option.Consequences {
+		applyConsequence(c, cons, itemDeltas)
+		applied = append(applied, character.AppliedConsequence{Type: string(cons.Type), Item: cons.Item, Value: cons.Value})
+	}
+
+	if err := s.moveToNextAct(ctx, c, st, option); err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(applied)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding consequences: %w", err)
+	}
+	entry := &character.JournalEntry{
+		CharacterID:  c.ID,
+		RunID:        *c.RunID,
+		StoryID:      st.ID,
+		ActID:        act.ID,
+		OptionID:     option.ID,
+		ActText:      act.Text,
+		OptionText:   option.Text,
+		Consequences: string(encoded),
+	}
+
+	ok, err := s.characters.AdvanceCharacter(ctx, c, act.ID, entry, itemDeltas)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// Someone else (another tab, a double click) moved the character
+		// first; the option no longer belongs to the current act.
+		return nil, ErrInvalidOption
+	}
+
+	state, err := s.State(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &ChoiceResult{Applied: applied, State: state}, nil
+}
+
+func applyConsequence(c *character.Character, cons story.Consequence, itemDeltas map[string]float64) {
+	switch cons.Type {
+	case story.TypeLocura:
+		c.Locura += cons.Value
+	case story.TypePanico:
+		c.Panico += cons.Value
+	case story.TypeAnsiedad:
+		c.Ansiedad += cons.Value
+	case story.TypeBrillantes:
+		c.Brillantes += cons.Value
+	case story.TypeMisfortune:
+		c.Misfortune += cons.Value
+	case story.TypeItem:
+		itemDeltas[cons.Item] += cons.Value
+	}
+}
+
+// moveToNextAct follows the option. The story ends when misfortune reaches
+// the story's threshold, when the option leads nowhere, or when the next act
+// offers no options.
+func (s *Service) moveToNextAct(ctx context.Context, c *character.Character, st *story.Story, option *story.Option) error {
+	now := time.Now()
+
+	if st.MisfortuneThreshold > 0 && c.Misfortune >= st.MisfortuneThreshold {
+		c.FinishedAt, c.Ending = &now, character.EndingMisfortune
+		return nil
+	}
+	if option.NextAct == nil {
+		c.FinishedAt, c.Ending = &now, character.EndingCompleted
+		return nil
+	}
+
+	next, err := s.stories.GetStoryActByID(ctx, *option.NextAct)
+	if err != nil {
+		return err
+	}
+	if next == nil {
+		c.FinishedAt, c.Ending = &now, character.EndingCompleted
+		return nil
+	}
+
+	c.CurrentActID = &next.ID
+	if len(next.Options) == 0 {
+		c.FinishedAt, c.Ending = &now, character.EndingCompleted
+	}
+	return nil
+}
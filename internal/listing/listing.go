@@ -0,0 +1,174 @@
+// Package listing holds the query parameters shared by the admin listings:
+// cursor pagination over created_at and common filters.
+package listing
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultLimit = 50
+	MaxLimit     = 200
+
+	// NextCursorHeader carries the cursor of the next page. It is absent on
+	// the last page.
+	NextCursorHeader = "X-Next-Cursor"
+)
+
+// Cursor points at the last row of a page. Listings are ordered newest
+// first, with the ID breaking ties between rows created at the same time.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// String encodes the cursor as an opaque, URL-safe value.
+func (c Cursor) String() string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func ParseCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	createdAt, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil, errors.New("invalid cursor")
+	}
+	c := Cursor{}
+	if c.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	if c.ID, err = uuid.Parse(id); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return &c, nil
+}
+
+// Page selects one page of a listing.
+type Page struct {
+	Limit int
+	After *Cursor
+}
+
+// PageFromRequest reads the limit and cursor query parameters.
+func PageFromRequest(r *http.Request) (Page, error) {
+	page := Page{Limit: DefaultLimit}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			return page, errors.New("limit must be a positive number")
+		}
+		page.Limit = min(limit, MaxLimit)
+	}
+	if s := r.URL.Query().Get("cursor"); s != "" {
+		c, err := ParseCursor(s)
+		if err != nil {
+			return page, err
+		}
+		page.After = c
+	}
+	return page, nil
+}
+
+// Apply orders the query of table newest first and limits it to the page.
+// It fetches one row past the limit so Trim can tell whether another page
+// follows.
+func (p Page) Apply(db *gorm.DB, table string) *gorm.DB {
+	if p.After != nil {
+		db = db.Where(
+			fmt.Sprintf("%[1]s.created_at < ? OR (%[1]s.created_at = ? AND %[1]s.id < ?)", table),
+			p.After.CreatedAt, p.After.CreatedAt, p.After.ID,
+		)
+	}
+	return db.Order(table + ".created_at DESC").Order(table + ".id DESC").Limit(p.Limit + 1)
+}
+
+// Trim drops the extra row fetched by Apply and returns the cursor of the
+// next page, or nil on the last page.
+func Trim[T any](rows []T, p Page, cursor func(T) Cursor) ([]T, *Cursor) {
+	if len(rows) <= p.Limit {
+		return rows, nil
+	}
+	rows = rows[:p.Limit]
+	next := cursor(rows[len(rows)-1])
+	return rows, &next
+}
+
+// WriteNext sets the next page header; call it before writing the body.
+func WriteNext(w http.ResponseWriter, next *Cursor) {
+	if next != nil {
+		w.Header().Set(NextCursorHeader, next.String())
+	}
+}
+
+// DateRange limits a listing to rows created in [From, To). Either end may
+// be open.
+type DateRange struct {
+	From *time.Time
+	To   *time.Time
+}
+
+// DateRangeFromRequest reads the from and to query parameters, either dates
+// (YYYY-MM-DD) or RFC 3339 timestamps. A date in to includes that whole day.
+func DateRangeFromRequest(r *http.Request) (DateRange, error) {
+	var dr DateRange
+	var err error
+	if dr.From, err = parseBound(r.URL.Query().Get("from"), false); err != nil {
+		return dr, fmt.Errorf("invalid from: %w", err)
+	}
+	if dr.To, err = parseBound(r.URL.Query().Get("to"), true); err != nil {
+		return dr, fmt.Errorf("invalid to: %w", err)
+	}
+	if dr.From != nil && dr.To != nil && !dr.From.Before(*dr.To) {
+		return dr, errors.New("from must be before to")
+	}
+	return dr, nil
+}
+
+func parseBound(s string, end bool) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, errors.New("expected YYYY-MM-DD or an RFC 3339 timestamp")
+	}
+	return &t, nil
+}
+
+// Apply adds the range to a query over table.
+func (dr DateRange) Apply(db *gorm.DB, table string) *gorm.DB {
+	if dr.From != nil {
+		db = db.Where(table+".created_at >= ?", *dr.From)
+	}
+	if dr.To != nil {
+		db = db.Where(table+".created_at < ?", *dr.To)
+	}
+	return db
+}
+
+// ContainsPattern turns a search term into a case-insensitive LIKE pattern
+// for LOWER(column) LIKE ? ESCAPE '\'. LIKE wildcards in the term match
+// literally.
+func ContainsPattern(term string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(term))
+	return "%" + escaped + "%"
+}
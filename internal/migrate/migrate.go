@@ -0,0 +1,263 @@
+// Package migrate keeps the database schema up to date with versioned SQL
+// migrations. Each driver has its own in migrations/<driver>/, as pairs of
+// files named NNNN_name.up.sql and NNNN_name.down.sql, embedded in the
+// binary. The versions applied are recorded in the schema_migrations table.
+package migrate
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nicolas-camacho/thrg/internal/database"
+	"gorm.io/gorm"
+)
+
+//go:embed migrations
+var files embed.FS
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// lockID names the PostgreSQL advisory lock held while migrating. Any
+// number works as long as nothing else in the database uses it.
+const lockID = 7_412_203_301
+
+// ErrUnknownVersion is returned when the database has a migration applied
+// that this build does not know, which means it was migrated by a newer one.
+var ErrUnknownVersion = errors.New("database has a migration this build does not know")
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Status is a migration and when it was applied; AppliedAt is nil while it
+// is pending.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// appliedMigration is a row of schema_migrations.
+type appliedMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (appliedMigration) TableName() string {
+	return "schema_migrations"
+}
+
+type Migrator struct {
+	db         *gorm.DB
+	driver     string
+	migrations []Migration
+}
+
+// New returns a Migrator with the migrations of driver, one of the
+// database package's driver names.
+func New(db *gorm.DB, driver string) (*Migrator, error) {
+	migrations, err := load(driver)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, driver: driver, migrations: migrations}, nil
+}
+
+func load(driver string) ([]Migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for driver %q", driver)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration file %s is not named NNNN_name.up.sql or NNNN_name.down.sql", entry.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("migration file %s: %w", entry.Name(), err)
+		}
+		body, err := fs.ReadFile(files, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			return nil, fmt.Errorf("migration %s needs both an up and a down file", m)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Up applies every pending migration, oldest first, and returns them.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(tx *gorm.DB) error {
+		applied, err := m.applied(tx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if err := tx.Exec(migration.Up).Error; err != nil {
+				return fmt.Errorf("migration %s failed: %w", migration, err)
+			}
+			record := appliedMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}
+			if err := tx.Create(&record).Error; err != nil {
+				return fmt.Errorf("failed to record migration %s: %w", migration, err)
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// Down rolls back the last steps applied migrations, newest first, and
+// returns them. It stops early once none is left.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(tx *gorm.DB) error {
+		applied, err := m.applied(tx)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if err := tx.Exec(migration.Down).Error; err != nil {
+				return fmt.Errorf("rolling back migration %s failed: %w", migration, err)
+			}
+			if err := tx.Delete(&appliedMigration{}, migration.Version).Error; err != nil {
+				return fmt.Errorf("failed to unrecord migration %s: %w", migration, err)
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// Status lists every migration, oldest first, with when it was applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(m.db.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, len(m.migrations))
+	for i, migration := range m.migrations {
+		statuses[i].Migration = migration
+		if at, ok := applied[migration.Version]; ok {
+			statuses[i].AppliedAt = &at
+		}
+	}
+	return statuses, nil
+}
+
+// Pending returns the migrations not applied yet, oldest first.
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			pending = append(pending, status.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// locked runs fn in a transaction that only one instance can be in at a
+// time. On PostgreSQL the transaction holds an advisory lock; SQLite
+// transactions already take the write lock when they begin (see
+// database.Open). Schema changes are transactional on both, so a failed
+// run leaves the schema as it found it.
+func (m *Migrator) locked(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	return m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if m.driver == database.Postgres {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", lockID).Error; err != nil {
+				return fmt.Errorf("failed to take the migration lock: %w", err)
+			}
+		}
+		if !tx.Migrator().HasTable(&appliedMigration{}) {
+			if err := tx.Migrator().CreateTable(&appliedMigration{}); err != nil {
+				return fmt.Errorf("failed to create schema_migrations: %w", err)
+			}
+		}
+		return fn(tx)
+	})
+}
+
+// applied returns when each applied version was applied. It fails with
+// ErrUnknownVersion if one of them is not among m's migrations.
+func (m *Migrator) applied(db *gorm.DB) (map[int]time.Time, error) {
+	applied := make(map[int]time.Time)
+	if !db.Migrator().HasTable(&appliedMigration{}) {
+		return applied, nil
+	}
+
+	var records []appliedMigration
+	if err := db.Order("version").Find(&records).Error; err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	known := make(map[int]bool, len(m.migrations))
+	for _, migration := range m.migrations {
+		known[migration.Version] = true
+	}
+	for _, record := range records {
+		if !known[record.Version] {
+			return nil, fmt.Errorf("%w: %04d_%s", ErrUnknownVersion, record.Version, record.Name)
+		}
+		applied[record.Version] = record.AppliedAt
+	}
+	return applied, nil
+}
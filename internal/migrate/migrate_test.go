@@ -0,0 +1,377 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/apitoken"
+	"github.com/nicolas-camacho/thrg/internal/audit"
+	"github.com/nicolas-camacho/thrg/internal/character"
+	"github.com/nicolas-camacho/thrg/internal/database"
+	"github.com/nicolas-camacho/thrg/internal/ratelimit"
+	"github.com/nicolas-camacho/thrg/internal/session"
+	"github.com/nicolas-camacho/thrg/internal/story"
+	"github.com/nicolas-camacho/thrg/internal/token"
+	"github.com/nicolas-camacho/thrg/internal/user"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// The models as they were before versioned migrations, which AutoMigrate
+// created the schema from. The IDs had a uuid_generate_v4() default, which
+// only PostgreSQL has. LegacyBase is exported because gorm skips the
+// fields of unexported embedded structs.
+type LegacyBase struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+type legacyUser struct {
+	LegacyBase
+	Username     string `gorm:"uniqueIndex;not null"`
+	PasswordHash string `gorm:"not null"`
+	Role         string `gorm:"default:player"`
+}
+
+func (legacyUser) TableName() string { return "users" }
+
+type legacyRegistrationToken struct {
+	LegacyBase
+	Value       string `gorm:"uniqueIndex;not null"`
+	IsUsed      bool   `gorm:"default:false"`
+	UsedByID    *uuid.UUID
+	ExpiresAt   time.Time
+	CreatedByID uuid.UUID
+}
+
+func (legacyRegistrationToken) TableName() string { return "registration_tokens" }
+
+type legacyStory struct {
+	LegacyBase
+	HolderName          string `gorm:"uniqueIndex;not null"`
+	Title               string `gorm:"not null"`
+	Description         string
+	MisfortuneThreshold float64     `gorm:"not null"`
+	Acts                []legacyAct `gorm:"foreignKey:StoryID"`
+}
+
+func (legacyStory) TableName() string { return "stories" }
+
+type legacyAct struct {
+	LegacyBase
+	StoryID uuid.UUID      `gorm:"type:uuid;not null"`
+	Order   int            `gorm:"not null"`
+	Text    string         `gorm:"not null"`
+	Options []legacyOption `gorm:"foreignKey:ActID"`
+}
+
+func (legacyAct) TableName() string { return "acts" }
+
+type legacyOption struct {
+	LegacyBase
+	ActID        uuid.UUID           `gorm:"type:uuid;not null"`
+	Text         string              `gorm:"not null"`
+	NextAct      *uuid.UUID          `gorm:"type:uuid"`
+	Consequences []legacyConsequence `gorm:"foreignKey:OptionID"`
+}
+
+func (legacyOption) TableName() string { return "options" }
+
+type legacyConsequence struct {
+	gorm.Model
+	OptionID uuid.UUID `gorm:"type:uuid;not null"`
+	Type     string    `gorm:"not null"`
+	Value    float64   `gorm:"not null"`
+}
+
+func (legacyConsequence) TableName() string { return "consequences" }
+
+type legacyCharacter struct {
+	LegacyBase
+	UserID         uuid.UUID  `gorm:"type:uuid;not null"`
+	CurrentStoryID *uuid.UUID `gorm:"type:uuid"`
+	CurrentActID   *uuid.UUID `gorm:"type:uuid"`
+	Misfortune     float64    `gorm:"not null;default:0"`
+	Locura         float64    `gorm:"not null;default:0"`
+	Panico         float64    `gorm:"not null;default:0"`
+	Ansiedad       float64    `gorm:"not null;default:0"`
+	Brillantes     float64    `gorm:"not null;default:0"`
+}
+
+func (legacyCharacter) TableName() string { return "characters" }
+
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := database.Open(database.Config{
+		Driver: database.SQLite,
+		DSN:    filepath.Join(t.TempDir(), "thrg.db"),
+	})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	db.Logger = logger.Discard
+	return db
+}
+
+// openLegacyDB returns a database created by AutoMigrate from the legacy
+// models, with a player who has a character in the middle of a story.
+func openLegacyDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db := openTestDB(t)
+	err := db.AutoMigrate(&legacyUser{}, &legacyRegistrationToken{}, &legacyStory{}, &legacyAct{}, &legacyOption{}, &legacyConsequence{}, &legacyCharacter{})
+	if err != nil {
+		t.Fatalf("auto migrate legacy models: %v", err)
+	}
+
+	admin := legacyUser{LegacyBase: LegacyBase{ID: uuid.New()}, Username: "admin", PasswordHash: "hash", Role: "admin"}
+	player := legacyUser{LegacyBase: LegacyBase{ID: uuid.New()}, Username: "player", PasswordHash: "hash"}
+	invite := legacyRegistrationToken{
+		LegacyBase:  LegacyBase{ID: uuid.New()},
+		Value:       "invite",
+		IsUsed:      true,
+		UsedByID:    &player.ID,
+		ExpiresAt:   time.Now().Add(time.Hour),
+		CreatedByID: admin.ID,
+	}
+	act := legacyAct{LegacyBase: LegacyBase{ID: uuid.New()}, Order: 1, Text: "Una puerta."}
+	act.Options = []legacyOption{{
+		LegacyBase:   LegacyBase{ID: uuid.New()},
+		Text:         "Abrirla.",
+		Consequences: []legacyConsequence{{Type: "locura", Value: 1}},
+	}}
+	story := legacyStory{
+		LegacyBase:          LegacyBase{ID: uuid.New()},
+		HolderName:          "puerta",
+		Title:               "La puerta",
+		MisfortuneThreshold: 10,
+		Acts:                []legacyAct{act},
+	}
+	character := legacyCharacter{
+		LegacyBase:     LegacyBase{ID: uuid.New()},
+		UserID:         player.ID,
+		CurrentStoryID: &story.ID,
+		CurrentActID:   &act.ID,
+		Locura:         1,
+	}
+	for _, row := range []any{&admin, &player, &invite, &story, &character} {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatalf("create %T: %v", row, err)
+		}
+	}
+	return db
+}
+
+func migrateUp(t *testing.T, db *gorm.DB) *Migrator {
+	t.Helper()
+	migrator, err := New(db, database.SQLite)
+	if err != nil {
+		t.Fatalf("load migrations: %v", err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("migrate up: %v", err)
+	}
+	return migrator
+}
+
+// schemaOf describes every table of db but schema_migrations: its columns,
+// indexes and foreign keys, each sorted so the order they were added in
+// does not matter.
+func schemaOf(t *testing.T, db *gorm.DB) map[string][]string {
+	t.Helper()
+	var tables []string
+	err := db.Raw("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name <> 'schema_migrations'").Scan(&tables).Error
+	if err != nil {
+		t.Fatalf("list tables: %v", err)
+	}
+
+	schema := make(map[string][]string, len(tables))
+	for _, table := range tables {
+		var columns []struct {
+			Name      string
+			Type      string
+			NotNull   bool
+			DfltValue *string
+			PK        int
+		}
+		if err := db.Raw(fmt.Sprintf("SELECT name, type, `notnull` AS not_null, dflt_value, pk FROM pragma_table_info('%s')", table)).Scan(&columns).Error; err != nil {
+			t.Fatalf("describe %s: %v", table, err)
+		}
+		var desc []string
+		for _, c := range columns {
+			// AutoMigrate quotes string defaults with double quotes, which
+			// SQLite reads as the same string as single quotes.
+			dflt := "<none>"
+			if c.DfltValue != nil {
+				dflt = strings.ReplaceAll(*c.DfltValue, `"`, "'")
+			}
+			desc = append(desc, fmt.Sprintf("column %s %s not null=%t default=%s pk=%d", c.Name, c.Type, c.NotNull, dflt, c.PK))
+		}
+
+		var indexes []struct {
+			Name    string
+			Unique  bool
+			Columns string
+		}
+		err := db.Raw(fmt.Sprintf(
+			"SELECT il.name, il.[unique], (SELECT group_concat(name) FROM pragma_index_info(il.name)) AS columns FROM pragma_index_list('%s') AS il WHERE il.origin = 'c'",
+			table,
+		)).Scan(&indexes).Error
+		if err != nil {
+			t.Fatalf("list indexes of %s: %v", table, err)
+		}
+		for _, index := range indexes {
+			desc = append(desc, fmt.Sprintf("index %s (%s) unique=%t", index.Name, index.Columns, index.Unique))
+		}
+
+		var foreignKeys []struct {
+			Table string
+			From  string
+			To    string
+		}
+		if err := db.Raw(fmt.Sprintf("SELECT [table], [from], [to] FROM pragma_foreign_key_list('%s')", table)).Scan(&foreignKeys).Error; err != nil {
+			t.Fatalf("list foreign keys of %s: %v", table, err)
+		}
+		for _, fk := range foreignKeys {
+			desc = append(desc, fmt.Sprintf("foreign key %s -> %s(%s)", fk.From, fk.Table, fk.To))
+		}
+
+		sort.Strings(desc)
+		schema[table] = desc
+	}
+	return schema
+}
+
+func diffSchemas(t *testing.T, got, want map[string][]string) {
+	t.Helper()
+	for table, columns := range want {
+		if _, ok := got[table]; !ok {
+			t.Errorf("table %s is missing", table)
+			continue
+		}
+		if !reflect.DeepEqual(got[table], columns) {
+			t.Errorf("table %s is\n\t%v\nwant\n\t%v", table, got[table], columns)
+		}
+	}
+	for table := range got {
+		if _, ok := want[table]; !ok {
+			t.Errorf("table %s should not exist", table)
+		}
+	}
+}
+
+func TestMigrationsMatchModels(t *testing.T) {
+	fresh := openTestDB(t)
+	migrateUp(t, fresh)
+
+	models := openTestDB(t)
+	err := models.AutoMigrate(
+		&user.User{},
+		&user.PasswordReset{},
+		&user.RecoveryCode{},
+		&token.RegistrationToken{},
+		&story.Story{},
+		&story.Act{},
+		&story.Option{},
+		&story.Consequence{},
+		&character.Character{},
+		&character.JournalEntry{},
+		&character.InventoryItem{},
+		&session.Session{},
+		&ratelimit.Entry{},
+		&apitoken.AccessToken{},
+		&audit.Event{},
+	)
+	if err != nil {
+		t.Fatalf("auto migrate models: %v", err)
+	}
+
+	diffSchemas(t, schemaOf(t, fresh), schemaOf(t, models))
+}
+
+func TestBaselineMatchesAutoMigrate(t *testing.T) {
+	fresh := openTestDB(t)
+	migrator := migrateUp(t, fresh)
+	if _, err := migrator.Down(context.Background(), len(migrator.migrations)-1); err != nil {
+		t.Fatalf("migrate down to the baseline: %v", err)
+	}
+
+	diffSchemas(t, schemaOf(t, fresh), schemaOf(t, openLegacyDB(t)))
+}
+
+func TestUpMigratesLegacyDatabase(t *testing.T) {
+	legacy := openLegacyDB(t)
+	migrateUp(t, legacy)
+
+	fresh := openTestDB(t)
+	migrateUp(t, fresh)
+	diffSchemas(t, schemaOf(t, legacy), schemaOf(t, fresh))
+
+	var story struct {
+		Title      string
+		Visibility string
+	}
+	if err := legacy.Table("stories").Select("title, visibility").Take(&story).Error; err != nil {
+		t.Fatalf("read story: %v", err)
+	}
+	if story.Title != "La puerta" || story.Visibility != "assigned" {
+		t.Errorf("story is %q with visibility %q, want La puerta, assigned", story.Title, story.Visibility)
+	}
+
+	var invite struct {
+		IsUsed  bool
+		MaxUses int
+	}
+	if err := legacy.Table("registration_tokens").Select("is_used, max_uses").Take(&invite).Error; err != nil {
+		t.Fatalf("read token: %v", err)
+	}
+	if !invite.IsUsed || invite.MaxUses != 1 {
+		t.Errorf("token is used=%t with max uses %d, want a used single-use token", invite.IsUsed, invite.MaxUses)
+	}
+
+	var locura float64
+	if err := legacy.Table("characters").Select("locura").Take(&locura).Error; err != nil {
+		t.Fatalf("read character: %v", err)
+	}
+	if locura != 1 {
+		t.Errorf("character has locura %v, want 1", locura)
+	}
+}
+
+func TestDownRestoresLegacySchema(t *testing.T) {
+	legacy := openLegacyDB(t)
+	want := schemaOf(t, legacy)
+	migrator := migrateUp(t, legacy)
+
+	if _, err := migrator.Down(context.Background(), len(migrator.migrations)-1); err != nil {
+		t.Fatalf("migrate down to the baseline: %v", err)
+	}
+	diffSchemas(t, schemaOf(t, legacy), want)
+
+	var users int64
+	if err := legacy.Table("users").Count(&users).Error; err != nil {
+		t.Fatalf("count users: %v", err)
+	}
+	if users != 2 {
+		t.Errorf("%d users are left, want 2", users)
+	}
+}
+
+func TestDownRemovesEverything(t *testing.T) {
+	db := openTestDB(t)
+	migrator := migrateUp(t, db)
+	if _, err := migrator.Down(context.Background(), len(migrator.migrations)); err != nil {
+		t.Fatalf("migrate down: %v", err)
+	}
+	if schema := schemaOf(t, db); len(schema) != 0 {
+		t.Errorf("tables left after rolling back every migration: %v", schema)
+	}
+}
@@ -0,0 +1,9 @@
+-- Drops every table of the baseline, dependents first.
+
+DROP TABLE IF EXISTS "characters";
+DROP TABLE IF EXISTS "consequences";
+DROP TABLE IF EXISTS "options";
+DROP TABLE IF EXISTS "acts";
+DROP TABLE IF EXISTS "stories";
+DROP TABLE IF EXISTS "registration_tokens";
+DROP TABLE IF EXISTS "users";
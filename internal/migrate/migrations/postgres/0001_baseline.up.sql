@@ -0,0 +1,103 @@
+-- Baseline: the schema AutoMigrate created before versioned migrations.
+-- Every statement is IF NOT EXISTS, so databases created by AutoMigrate
+-- adopt it without changes; the migrations after it bring them up to
+-- date. Those databases keep the uuid_generate_v4() default AutoMigrate
+-- gave the IDs, which the application no longer relies on.
+
+CREATE TABLE IF NOT EXISTS "users" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "username" text NOT NULL,
+    "password_hash" text NOT NULL,
+    "role" text DEFAULT 'player',
+    PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_users_deleted_at" ON "users" ("deleted_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_users_username" ON "users" ("username");
+
+CREATE TABLE IF NOT EXISTS "registration_tokens" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "value" text NOT NULL,
+    "is_used" boolean DEFAULT false,
+    "used_by_id" text,
+    "expires_at" timestamptz,
+    "created_by_id" text,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_registration_tokens_deleted_at" ON "registration_tokens" ("deleted_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_registration_tokens_value" ON "registration_tokens" ("value");
+
+CREATE TABLE IF NOT EXISTS "stories" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "holder_name" text NOT NULL,
+    "title" text NOT NULL,
+    "description" text,
+    "misfortune_threshold" decimal NOT NULL,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_stories_deleted_at" ON "stories" ("deleted_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_stories_holder_name" ON "stories" ("holder_name");
+
+CREATE TABLE IF NOT EXISTS "acts" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "story_id" uuid NOT NULL,
+    "order" bigint NOT NULL,
+    "text" text NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_stories_acts" FOREIGN KEY ("story_id") REFERENCES "stories"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_acts_deleted_at" ON "acts" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "options" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "act_id" uuid NOT NULL,
+    "text" text NOT NULL,
+    "next_act" uuid,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_acts_options" FOREIGN KEY ("act_id") REFERENCES "acts"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_options_deleted_at" ON "options" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "consequences" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "option_id" uuid NOT NULL,
+    "type" text NOT NULL,
+    "value" decimal NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_options_consequences" FOREIGN KEY ("option_id") REFERENCES "options"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_consequences_deleted_at" ON "consequences" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "characters" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "user_id" uuid NOT NULL,
+    "current_story_id" uuid,
+    "current_act_id" uuid,
+    "misfortune" decimal NOT NULL DEFAULT 0,
+    "locura" decimal NOT NULL DEFAULT 0,
+    "panico" decimal NOT NULL DEFAULT 0,
+    "ansiedad" decimal NOT NULL DEFAULT 0,
+    "brillantes" decimal NOT NULL DEFAULT 0,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_characters_deleted_at" ON "characters" ("deleted_at");
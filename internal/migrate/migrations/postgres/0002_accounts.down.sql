@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS "recovery_codes";
+DROP TABLE IF EXISTS "password_resets";
+
+DROP INDEX IF EXISTS "idx_users_oidc_identity";
+DROP INDEX IF EXISTS "idx_users_invited_by_id";
+ALTER TABLE "users" DROP COLUMN "totp_last_step";
+ALTER TABLE "users" DROP COLUMN "totp_enabled_at";
+ALTER TABLE "users" DROP COLUMN "totp_secret";
+ALTER TABLE "users" DROP COLUMN "invited_by_id";
+ALTER TABLE "users" DROP COLUMN "oidc_subject";
+ALTER TABLE "users" DROP COLUMN "oidc_issuer";
+ALTER TABLE "users" DROP COLUMN "display_name";
+ALTER TABLE "users" DROP COLUMN "disabled_at";
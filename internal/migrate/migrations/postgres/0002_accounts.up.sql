@@ -0,0 +1,36 @@
+-- Accounts: disabling users, display names, OIDC identities, who invited
+-- each player, two-factor authentication and password resets.
+
+ALTER TABLE "users" ADD COLUMN "disabled_at" timestamptz;
+ALTER TABLE "users" ADD COLUMN "display_name" text;
+ALTER TABLE "users" ADD COLUMN "oidc_issuer" text;
+ALTER TABLE "users" ADD COLUMN "oidc_subject" text;
+ALTER TABLE "users" ADD COLUMN "invited_by_id" uuid;
+ALTER TABLE "users" ADD COLUMN "totp_secret" text;
+ALTER TABLE "users" ADD COLUMN "totp_enabled_at" timestamptz;
+ALTER TABLE "users" ADD COLUMN "totp_last_step" bigint;
+CREATE INDEX "idx_users_invited_by_id" ON "users" ("invited_by_id");
+CREATE UNIQUE INDEX "idx_users_oidc_identity" ON "users" ("oidc_issuer","oidc_subject");
+
+CREATE TABLE "password_resets" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "user_id" uuid NOT NULL,
+    "created_by_id" uuid NOT NULL,
+    "token_hash" text NOT NULL,
+    "expires_at" timestamptz NOT NULL,
+    "used_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX "idx_password_resets_token_hash" ON "password_resets" ("token_hash");
+CREATE INDEX "idx_password_resets_user_id" ON "password_resets" ("user_id");
+
+CREATE TABLE "recovery_codes" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "user_id" uuid NOT NULL,
+    "code_hash" text NOT NULL,
+    "used_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_recovery_codes_user_id" ON "recovery_codes" ("user_id");
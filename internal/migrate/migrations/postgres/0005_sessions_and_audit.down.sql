@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS "audit_events";
+DROP TABLE IF EXISTS "access_tokens";
+DROP TABLE IF EXISTS "rate_limit_entries";
+DROP TABLE IF EXISTS "sessions";
@@ -0,0 +1,100 @@
+-- Baseline: the schema AutoMigrate created on PostgreSQL before versioned
+-- migrations. SQLite came later, but starts from the same baseline so
+-- both drivers go through the same migrations.
+
+CREATE TABLE IF NOT EXISTS "users" (
+    "id" uuid,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "username" text NOT NULL,
+    "password_hash" text NOT NULL,
+    "role" text DEFAULT 'player',
+    PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_users_deleted_at" ON "users" ("deleted_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_users_username" ON "users" ("username");
+
+CREATE TABLE IF NOT EXISTS "registration_tokens" (
+    "id" uuid,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "value" text NOT NULL,
+    "is_used" numeric DEFAULT false,
+    "used_by_id" text,
+    "expires_at" datetime,
+    "created_by_id" text,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_registration_tokens_deleted_at" ON "registration_tokens" ("deleted_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_registration_tokens_value" ON "registration_tokens" ("value");
+
+CREATE TABLE IF NOT EXISTS "stories" (
+    "id" uuid,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "holder_name" text NOT NULL,
+    "title" text NOT NULL,
+    "description" text,
+    "misfortune_threshold" real NOT NULL,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_stories_deleted_at" ON "stories" ("deleted_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_stories_holder_name" ON "stories" ("holder_name");
+
+CREATE TABLE IF NOT EXISTS "acts" (
+    "id" uuid,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "story_id" uuid NOT NULL,
+    "order" integer NOT NULL,
+    "text" text NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_stories_acts" FOREIGN KEY ("story_id") REFERENCES "stories"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_acts_deleted_at" ON "acts" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "options" (
+    "id" uuid,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "act_id" uuid NOT NULL,
+    "text" text NOT NULL,
+    "next_act" uuid,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_acts_options" FOREIGN KEY ("act_id") REFERENCES "acts"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_options_deleted_at" ON "options" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "consequences" (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "option_id" uuid NOT NULL,
+    "type" text NOT NULL,
+    "value" real NOT NULL,
+    CONSTRAINT "fk_options_consequences" FOREIGN KEY ("option_id") REFERENCES "options"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_consequences_deleted_at" ON "consequences" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "characters" (
+    "id" uuid,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "user_id" uuid NOT NULL,
+    "current_story_id" uuid,
+    "current_act_id" uuid,
+    "misfortune" real NOT NULL DEFAULT 0,
+    "locura" real NOT NULL DEFAULT 0,
+    "panico" real NOT NULL DEFAULT 0,
+    "ansiedad" real NOT NULL DEFAULT 0,
+    "brillantes" real NOT NULL DEFAULT 0,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_characters_deleted_at" ON "characters" ("deleted_at");
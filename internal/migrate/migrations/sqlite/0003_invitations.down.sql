@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS "idx_registration_tokens_batch_id";
+ALTER TABLE "registration_tokens" DROP COLUMN "batch_label";
+ALTER TABLE "registration_tokens" DROP COLUMN "batch_id";
+ALTER TABLE "registration_tokens" DROP COLUMN "suggested_username";
+ALTER TABLE "registration_tokens" DROP COLUMN "party";
+ALTER TABLE "registration_tokens" DROP COLUMN "story_id";
+ALTER TABLE "registration_tokens" DROP COLUMN "role";
+ALTER TABLE "registration_tokens" DROP COLUMN "revoked_at";
+ALTER TABLE "registration_tokens" DROP COLUMN "use_count";
+ALTER TABLE "registration_tokens" DROP COLUMN "max_uses";
@@ -0,0 +1,13 @@
+-- Invitations: tokens with several uses that can be revoked, that set
+-- up the player they register, and batches of them.
+
+ALTER TABLE "registration_tokens" ADD COLUMN "max_uses" integer NOT NULL DEFAULT 1;
+ALTER TABLE "registration_tokens" ADD COLUMN "use_count" integer NOT NULL DEFAULT 0;
+ALTER TABLE "registration_tokens" ADD COLUMN "revoked_at" datetime;
+ALTER TABLE "registration_tokens" ADD COLUMN "role" text;
+ALTER TABLE "registration_tokens" ADD COLUMN "story_id" uuid;
+ALTER TABLE "registration_tokens" ADD COLUMN "party" text;
+ALTER TABLE "registration_tokens" ADD COLUMN "suggested_username" text;
+ALTER TABLE "registration_tokens" ADD COLUMN "batch_id" uuid;
+ALTER TABLE "registration_tokens" ADD COLUMN "batch_label" text;
+CREATE INDEX "idx_registration_tokens_batch_id" ON "registration_tokens" ("batch_id");
@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS "inventory_items";
+DROP TABLE IF EXISTS "journal_entries";
+
+DROP INDEX IF EXISTS "idx_characters_party";
+ALTER TABLE "characters" DROP COLUMN "ending";
+ALTER TABLE "characters" DROP COLUMN "finished_at";
+ALTER TABLE "characters" DROP COLUMN "run_id";
+ALTER TABLE "characters" DROP COLUMN "party";
+ALTER TABLE "consequences" DROP COLUMN "item";
+ALTER TABLE "stories" DROP COLUMN "visibility";
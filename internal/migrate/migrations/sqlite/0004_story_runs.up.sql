@@ -0,0 +1,38 @@
+-- Story runs: who can start each story, items, parties, the end of a run,
+-- and the journal and inventory of each run.
+
+ALTER TABLE "stories" ADD COLUMN "visibility" text NOT NULL DEFAULT 'assigned';
+ALTER TABLE "consequences" ADD COLUMN "item" text;
+ALTER TABLE "characters" ADD COLUMN "party" text;
+ALTER TABLE "characters" ADD COLUMN "run_id" uuid;
+ALTER TABLE "characters" ADD COLUMN "finished_at" datetime;
+ALTER TABLE "characters" ADD COLUMN "ending" text;
+CREATE INDEX "idx_characters_party" ON "characters" ("party");
+
+CREATE TABLE "journal_entries" (
+    "id" uuid,
+    "created_at" datetime,
+    "character_id" uuid NOT NULL,
+    "run_id" uuid NOT NULL,
+    "story_id" uuid NOT NULL,
+    "act_id" uuid NOT NULL,
+    "option_id" uuid NOT NULL,
+    "act_text" text NOT NULL,
+    "option_text" text NOT NULL,
+    "consequences" text NOT NULL DEFAULT '[]',
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_journal_entries_character_id" ON "journal_entries" ("character_id");
+CREATE INDEX "idx_journal_entries_run_id" ON "journal_entries" ("run_id");
+
+CREATE TABLE "inventory_items" (
+    "id" uuid,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "character_id" uuid NOT NULL,
+    "run_id" uuid NOT NULL,
+    "name" text NOT NULL,
+    "quantity" real NOT NULL DEFAULT 0,
+    PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX "idx_inventory_character_run_name" ON "inventory_items" ("character_id","run_id","name");
@@ -0,0 +1,59 @@
+-- Server-side sessions, login rate limiting, API access tokens and the
+-- audit log.
+
+CREATE TABLE "sessions" (
+    "id" text,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "name" text NOT NULL,
+    "user_id" uuid,
+    "data" blob,
+    "user_agent" text,
+    "ip" text,
+    "last_seen_at" datetime NOT NULL,
+    "expires_at" datetime NOT NULL,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_sessions_expires_at" ON "sessions" ("expires_at");
+CREATE INDEX "idx_sessions_user_id" ON "sessions" ("user_id");
+
+CREATE TABLE "rate_limit_entries" (
+    "key" text,
+    "failures" integer NOT NULL,
+    "last_failure_at" datetime,
+    "locked_until" datetime,
+    PRIMARY KEY ("key")
+);
+
+CREATE TABLE "access_tokens" (
+    "id" uuid,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "user_id" uuid NOT NULL,
+    "name" text NOT NULL,
+    "prefix" text NOT NULL,
+    "token_hash" text NOT NULL,
+    "scopes" text NOT NULL,
+    "expires_at" datetime NOT NULL,
+    "last_used_at" datetime,
+    "revoked_at" datetime,
+    PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX "idx_access_tokens_token_hash" ON "access_tokens" ("token_hash");
+CREATE INDEX "idx_access_tokens_user_id" ON "access_tokens" ("user_id");
+
+CREATE TABLE "audit_events" (
+    "id" uuid,
+    "created_at" datetime,
+    "actor_id" uuid,
+    "action" text NOT NULL,
+    "target_type" text,
+    "target_id" text,
+    "metadata" text,
+    "ip" text,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_audit_events_action" ON "audit_events" ("action");
+CREATE INDEX "idx_audit_events_actor_id" ON "audit_events" ("actor_id");
+CREATE INDEX "idx_audit_events_created_at" ON "audit_events" ("created_at");
+CREATE INDEX "idx_audit_events_target_id" ON "audit_events" ("target_id");
@@ -0,0 +1,99 @@
+// Package oidc logs users in with an OpenID Connect provider: discovery,
+// the authorization code flow with PKCE and ID token verification.
+package oidc
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config describes the provider and how its users map to roles.
+type Config struct {
+	// Issuer is the provider's issuer URL; discovery reads
+	// Issuer/.well-known/openid-configuration.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends users back, the callback
+	// route of this server.
+	RedirectURL string
+	Scopes      []string
+	// Name is shown on the login button.
+	Name string
+
+	// RoleClaim is the ID token claim holding the user's groups or roles,
+	// either a string or a list of strings. RoleMap maps its values to
+	// roles of this application.
+	RoleClaim string
+	RoleMap   map[string]string
+
+	// HTTPClient talks to the provider; nil means a client with a timeout.
+	HTTPClient *http.Client
+}
+
+var defaultScopes = []string{"openid", "profile", "email"}
+
+// ConfigFromEnv reads the OIDC_* variables. It returns nil if OIDC_ISSUER is
+// not set, which turns OIDC login off.
+//
+// OIDC_ROLE_MAP lists claim values and the role they give, as
+// "value=role,value=role".
+func ConfigFromEnv() (*Config, error) {
+	cfg := &Config{
+		Issuer:       os.Getenv("OIDC_ISSUER"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       defaultScopes,
+		Name:         os.Getenv("OIDC_NAME"),
+		RoleClaim:    os.Getenv("OIDC_ROLE_CLAIM"),
+		RoleMap:      map[string]string{},
+	}
+	if cfg.Issuer == "" {
+		return nil, nil
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required with OIDC_ISSUER")
+	}
+	if s := os.Getenv("OIDC_SCOPES"); s != "" {
+		cfg.Scopes = strings.Fields(s)
+	}
+	if cfg.Name == "" {
+		cfg.Name = "OpenID Connect"
+	}
+	if cfg.RoleClaim == "" {
+		cfg.RoleClaim = "groups"
+	}
+
+	if s := os.Getenv("OIDC_ROLE_MAP"); s != "" {
+		for _, pair := range strings.Split(s, ",") {
+			value, role, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			value, role = strings.TrimSpace(value), strings.TrimSpace(role)
+			if !ok || value == "" || role == "" {
+				return nil, fmt.Errorf("invalid OIDC_ROLE_MAP entry %q, expected value=role", pair)
+			}
+			cfg.RoleMap[value] = role
+		}
+	}
+	return cfg, nil
+}
+
+func (c *Config) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func (c *Config) scopes() []string {
+	for _, s := range c.Scopes {
+		if s == "openid" {
+			return c.Scopes
+		}
+	}
+	return append([]string{"openid"}, c.Scopes...)
+}
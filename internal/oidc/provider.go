@@ -0,0 +1,288 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Identity is the verified user behind an ID token.
+type Identity struct {
+	Issuer  string
+	Subject string
+	// Username is the preferred_username claim, or the email if there is
+	// none.
+	Username string
+	Email    string
+	Name     string
+	// Roles are the roles RoleMap gives the user's RoleClaim values, in no
+	// particular order.
+	Roles []string
+}
+
+// metadata is the part of the discovery document the flow needs.
+type metadata struct {
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+	TokenEndpoint                 string   `json:"token_endpoint"`
+	JWKSURI                       string   `json:"jwks_uri"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+}
+
+// Provider runs the login flow against one OIDC provider. Discovery happens
+// on first use and is retried until it succeeds, so the server starts even
+// while the provider is down.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu       sync.Mutex
+	metadata *metadata
+	keys     *keySet
+}
+
+func NewProvider(cfg Config) *Provider {
+	return &Provider{config: cfg, client: cfg.httpClient(), keys: &keySet{}}
+}
+
+// Name is how the provider is shown to users.
+func (p *Provider) Name() string {
+	return p.config.Name
+}
+
+// Issuer is the provider's issuer URL, as configured.
+func (p *Provider) Issuer() string {
+	return p.config.Issuer
+}
+
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	var m metadata
+	if err := p.getJSON(ctx, wellKnown, &m); err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+	}
+	if m.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("OIDC provider says its issuer is %q, expected %q", m.Issuer, p.config.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery document is missing endpoints")
+	}
+	if len(m.CodeChallengeMethodsSupported) > 0 && !slices.Contains(m.CodeChallengeMethodsSupported, "S256") {
+		return nil, errors.New("OIDC provider does not support PKCE with S256")
+	}
+	p.metadata = &m
+	return p.metadata, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// RandomValue returns a fresh random value for a state, nonce or PKCE
+// verifier.
+func RandomValue() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// challenge is the S256 PKCE challenge of verifier.
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL is where to send the user to log in. The state, nonce and
+// verifier must be kept until the callback, for Exchange.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.scopes(), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return m.AuthorizationEndpoint + sep + query.Encode(), nil
+}
+
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange trades the code from the callback for an ID token and returns
+// the identity it proves.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Identity, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange OIDC code: %w", err)
+	}
+	defer resp.Body.Close()
+	var tr tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("failed to read OIDC token response (%s): %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		return nil, fmt.Errorf("OIDC provider refused the code: %s %s", tr.Error, tr.ErrorDescription)
+	}
+	if tr.IDToken == "" {
+		return nil, errors.New("OIDC token response has no id_token")
+	}
+
+	claims, err := p.verify(ctx, m, tr.IDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return p.identity(claims), nil
+}
+
+// clockSkew is how far the provider's clock may be off from ours.
+const clockSkew = time.Minute
+
+// verify checks the signature and claims of an ID token.
+func (p *Provider) verify(ctx context.Context, m *metadata, raw, nonce string) (map[string]any, error) {
+	claims, err := p.keys.verify(ctx, p, m.JWKSURI, raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != m.Issuer {
+		return nil, fmt.Errorf("invalid ID token: issued by %q", iss)
+	}
+	audiences := stringList(claims["aud"])
+	if !slices.Contains(audiences, p.config.ClientID) {
+		return nil, errors.New("invalid ID token: not issued for this client")
+	}
+	if azp, ok := claims["azp"].(string); (ok || len(audiences) > 1) && azp != p.config.ClientID {
+		return nil, errors.New("invalid ID token: authorized party is another client")
+	}
+	now := time.Now()
+	exp, ok := numericDate(claims["exp"])
+	if !ok || now.After(exp.Add(clockSkew)) {
+		return nil, errors.New("invalid ID token: expired")
+	}
+	if iat, ok := numericDate(claims["iat"]); !ok || iat.After(now.Add(clockSkew)) {
+		return nil, errors.New("invalid ID token: issued in the future")
+	}
+	if got, _ := claims["nonce"].(string); got == "" || got != nonce {
+		return nil, errors.New("invalid ID token: nonce does not match")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("invalid ID token: no subject")
+	}
+	return claims, nil
+}
+
+func (p *Provider) identity(claims map[string]any) *Identity {
+	id := &Identity{}
+	id.Issuer, _ = claims["iss"].(string)
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	id.Name, _ = claims["name"].(string)
+	id.Username, _ = claims["preferred_username"].(string)
+	if id.Username == "" {
+		id.Username = id.Email
+	}
+	for _, value := range stringList(claims[p.config.RoleClaim]) {
+		if role, ok := p.config.RoleMap[value]; ok && !slices.Contains(id.Roles, role) {
+			id.Roles = append(id.Roles, role)
+		}
+	}
+	return id
+}
+
+// MapsRoles reports whether roles come from the provider. When they do,
+// the provider decides the role of every user who logs in with it.
+func (p *Provider) MapsRoles() bool {
+	return len(p.config.RoleMap) > 0
+}
+
+// stringList reads a claim that is a string or a list of strings.
+func stringList(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func numericDate(v any) (time.Time, bool) {
+	n, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(n), 0), true
+}
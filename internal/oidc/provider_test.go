@@ -0,0 +1,197 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicolas-camacho/thrg/internal/oidc/oidctest"
+)
+
+const (
+	testClientID    = "thrg"
+	testRedirectURL = "http://thrg.test/admin/login/oidc/callback"
+)
+
+func newTestProvider(t *testing.T) (*oidctest.Provider, *Provider) {
+	t.Helper()
+	fake := oidctest.NewProvider(testClientID, "secret")
+	t.Cleanup(fake.Close)
+
+	provider := NewProvider(Config{
+		Issuer:       fake.Issuer(),
+		ClientID:     testClientID,
+		ClientSecret: "secret",
+		RedirectURL:  testRedirectURL,
+		Scopes:       defaultScopes,
+		Name:         "Test",
+		RoleClaim:    "groups",
+		RoleMap:      map[string]string{"thrg-admins": "owner"},
+	})
+	return fake, provider
+}
+
+// authorize sends the user to authURL and returns the query the provider
+// sends them back to the redirect URL with.
+func authorize(t *testing.T, authURL string) url.Values {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %s, want a redirect", resp.Status)
+	}
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("parse redirect: %v", err)
+	}
+	if !strings.HasPrefix(back.String(), testRedirectURL+"?") {
+		t.Fatalf("provider redirected to %s, want %s", back, testRedirectURL)
+	}
+	return back.Query()
+}
+
+func TestLoginFlow(t *testing.T) {
+	fake, provider := newTestProvider(t)
+	fake.SetUser("subject-1", map[string]any{
+		"preferred_username": "alice",
+		"email":              "alice@example.com",
+		"groups":             []string{"thrg-admins", "other"},
+	})
+	ctx := context.Background()
+
+	authURL, err := provider.AuthCodeURL(ctx, "the-state", "the-nonce", "the-verifier")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	query := authorize(t, authURL)
+	if got := query.Get("state"); got != "the-state" {
+		t.Errorf("state is %q, want the-state", got)
+	}
+
+	identity, err := provider.Exchange(ctx, query.Get("code"), "the-verifier", "the-nonce")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if identity.Issuer != fake.Issuer() || identity.Subject != "subject-1" {
+		t.Errorf("identity is %s at %s, want subject-1 at %s", identity.Subject, identity.Issuer, fake.Issuer())
+	}
+	if identity.Username != "alice" || identity.Email != "alice@example.com" {
+		t.Errorf("identity is %q <%s>, want alice <alice@example.com>", identity.Username, identity.Email)
+	}
+	if !slices.Equal(identity.Roles, []string{"owner"}) {
+		t.Errorf("roles are %v, want [owner]", identity.Roles)
+	}
+}
+
+func TestExchangeRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		verifier string
+		nonce    string
+	}{
+		{"wrong PKCE verifier", "another-verifier", "the-nonce"},
+		{"wrong nonce", "the-verifier", "another-nonce"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, provider := newTestProvider(t)
+			ctx := context.Background()
+			authURL, err := provider.AuthCodeURL(ctx, "the-state", "the-nonce", "the-verifier")
+			if err != nil {
+				t.Fatalf("AuthCodeURL: %v", err)
+			}
+			code := authorize(t, authURL).Get("code")
+
+			if identity, err := provider.Exchange(ctx, code, tt.verifier, tt.nonce); err == nil {
+				t.Errorf("Exchange accepted the login of %s", identity.Subject)
+			}
+		})
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	fake, provider := newTestProvider(t)
+	ctx := context.Background()
+	m, err := provider.discover(ctx)
+	if err != nil {
+		t.Fatalf("discover: %v", err)
+	}
+
+	validClaims := func() map[string]any {
+		now := time.Now()
+		return map[string]any{
+			"iss":   fake.Issuer(),
+			"aud":   testClientID,
+			"sub":   "subject-1",
+			"nonce": "the-nonce",
+			"iat":   now.Unix(),
+			"exp":   now.Add(5 * time.Minute).Unix(),
+		}
+	}
+	if _, err := provider.verify(ctx, m, fake.Sign(validClaims()), "the-nonce"); err != nil {
+		t.Fatalf("verify rejected a valid token: %v", err)
+	}
+
+	// A provider of its own signs with another key under the same key ID.
+	impostor := oidctest.NewProvider(testClientID, "secret")
+	defer impostor.Close()
+	tampered := strings.Split(fake.Sign(validClaims()), ".")
+	tampered[1] = strings.Split(fake.Sign(map[string]any{"sub": "subject-2"}), ".")[1]
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"wrong audience", fake.Sign(with(validClaims(), "aud", "another-client"))},
+		{"wrong issuer", fake.Sign(with(validClaims(), "iss", "https://elsewhere.test"))},
+		{"wrong nonce", fake.Sign(with(validClaims(), "nonce", "another-nonce"))},
+		{"no nonce", fake.Sign(with(validClaims(), "nonce", nil))},
+		{"expired", fake.Sign(with(validClaims(), "exp", time.Now().Add(-2*clockSkew).Unix()))},
+		{"issued in the future", fake.Sign(with(validClaims(), "iat", time.Now().Add(2*clockSkew).Unix()))},
+		{"no subject", fake.Sign(with(validClaims(), "sub", nil))},
+		{"signed with another key", impostor.Sign(validClaims())},
+		{"claims changed after signing", strings.Join(tampered, ".")},
+		{"malformed", "not-a-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := provider.verify(ctx, m, tt.token, "the-nonce"); err == nil {
+				t.Error("verify accepted the token")
+			}
+		})
+	}
+}
+
+// with returns claims with name set to value, or removed if value is nil.
+func with(claims map[string]any, name string, value any) map[string]any {
+	if value == nil {
+		delete(claims, name)
+	} else {
+		claims[name] = value
+	}
+	return claims
+}
+
+func TestDiscoveryRejectsIssuerMismatch(t *testing.T) {
+	fake := oidctest.NewProvider(testClientID, "")
+	defer fake.Close()
+
+	provider := NewProvider(Config{
+		Issuer:      fake.Issuer() + "/",
+		ClientID:    testClientID,
+		RedirectURL: testRedirectURL,
+	})
+	if _, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier"); err == nil {
+		t.Error("AuthCodeURL accepted a provider whose discovery names another issuer")
+	}
+}
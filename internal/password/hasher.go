@@ -0,0 +1,159 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Algorithms.
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+// Argon2Params are the cost parameters of argon2id.
+type Argon2Params struct {
+	MemoryKB uint32
+	Time     uint32
+	Threads  uint8
+}
+
+// DefaultArgon2 follows the OWASP recommendation for argon2id.
+var DefaultArgon2 = Argon2Params{MemoryKB: 19 * 1024, Time: 2, Threads: 1}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// Hasher hashes new passwords with the configured algorithm and verifies
+// passwords hashed with any supported one, so the algorithm can change
+// without locking anyone out.
+type Hasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// DefaultHasher is used until the server configures one.
+var DefaultHasher = Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.DefaultCost, Argon2: DefaultArgon2}
+
+// HasherFromEnv reads PASSWORD_HASH (bcrypt or argon2id), BCRYPT_COST and
+// ARGON2_MEMORY_KB, ARGON2_TIME and ARGON2_THREADS, falling back to
+// DefaultHasher.
+func HasherFromEnv() (Hasher, error) {
+	h := DefaultHasher
+	if s := os.Getenv("PASSWORD_HASH"); s != "" {
+		if s != Bcrypt && s != Argon2id {
+			return h, fmt.Errorf("PASSWORD_HASH must be %s or %s", Bcrypt, Argon2id)
+		}
+		h.Algorithm = s
+	}
+
+	var err error
+	if h.BcryptCost, err = envInt("BCRYPT_COST", h.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost); err != nil {
+		return h, err
+	}
+	memory, err := envInt("ARGON2_MEMORY_KB", int(h.Argon2.MemoryKB), 8*1024, 4*1024*1024)
+	if err != nil {
+		return h, err
+	}
+	iterations, err := envInt("ARGON2_TIME", int(h.Argon2.Time), 1, 100)
+	if err != nil {
+		return h, err
+	}
+	threads, err := envInt("ARGON2_THREADS", int(h.Argon2.Threads), 1, 255)
+	if err != nil {
+		return h, err
+	}
+	h.Argon2 = Argon2Params{MemoryKB: uint32(memory), Time: uint32(iterations), Threads: uint8(threads)}
+	return h, nil
+}
+
+func envInt(name string, fallback, lo, hi int) (int, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < lo || n > hi {
+		return 0, fmt.Errorf("%s must be a number between %d and %d", name, lo, hi)
+	}
+	return n, nil
+}
+
+// Hash hashes password with the configured algorithm.
+func (h Hasher) Hash(password string) (string, error) {
+	if h.Algorithm == Argon2id {
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		p := h.Argon2
+		key := argon2.IDKey([]byte(password), salt, p.Time, p.MemoryKB, p.Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, p.MemoryKB, p.Time, p.Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+	return string(hash), err
+}
+
+// Verify reports whether password matches hash. Hashes that cannot be
+// parsed, such as the placeholder of accounts without a password, match
+// nothing.
+func (h Hasher) Verify(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, salt, key, ok := parseArgon2(hash)
+		if !ok {
+			return false
+		}
+		got := argon2.IDKey([]byte(password), salt, p.Time, p.MemoryKB, p.Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(got, key) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// NeedsRehash reports whether hash was made with another algorithm or other
+// costs than the configured ones. Call it after a successful Verify.
+func (h Hasher) NeedsRehash(hash string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, _, _, ok := parseArgon2(hash)
+		return !ok || h.Algorithm != Argon2id || p != h.Argon2
+	}
+	if h.Algorithm != Bcrypt {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.BcryptCost
+}
+
+// parseArgon2 reads a hash in the PHC format written by Hash.
+func parseArgon2(hash string) (p Argon2Params, salt, key []byte, ok bool) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != Argon2id || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return p, nil, nil, false
+	}
+	var threads uint32
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.MemoryKB, &p.Time, &threads); err != nil || threads == 0 || threads > 255 {
+		return p, nil, nil, false
+	}
+	p.Threads = uint8(threads)
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, false
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, false
+	}
+	return p, salt, key, true
+}
@@ -0,0 +1,174 @@
+package password
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap costs keep the tests fast; the format is the same at any cost.
+var (
+	testBcrypt = Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost, Argon2: testArgon2}
+	testArgon2 = Argon2Params{MemoryKB: 64, Time: 1, Threads: 1}
+	testArgon  = Hasher{Algorithm: Argon2id, BcryptCost: bcrypt.MinCost, Argon2: testArgon2}
+)
+
+func TestHashRoundTrip(t *testing.T) {
+	for _, h := range []Hasher{testBcrypt, testArgon} {
+		t.Run(h.Algorithm, func(t *testing.T) {
+			hash, err := h.Hash("correct horse battery")
+			if err != nil {
+				t.Fatalf("Hash: %v", err)
+			}
+			if h.Algorithm == Argon2id && !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+				t.Errorf("argon2id hash %q is not in the PHC format", hash)
+			}
+			if !h.Verify(hash, "correct horse battery") {
+				t.Error("the password does not match its own hash")
+			}
+			if h.Verify(hash, "correct horse batterY") {
+				t.Error("another password matches the hash")
+			}
+			if h.NeedsRehash(hash) {
+				t.Error("a fresh hash needs rehashing")
+			}
+
+			again, err := h.Hash("correct horse battery")
+			if err != nil {
+				t.Fatalf("Hash: %v", err)
+			}
+			if again == hash {
+				t.Error("hashing twice gave the same hash; the salt is not random")
+			}
+		})
+	}
+}
+
+func TestVerifyAcceptsEitherAlgorithm(t *testing.T) {
+	bcryptHash, err := testBcrypt.Hash("secreto-largo")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	argonHash, err := testArgon.Hash("secreto-largo")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if !testArgon.Verify(bcryptHash, "secreto-largo") {
+		t.Error("an argon2id hasher does not verify bcrypt hashes")
+	}
+	if !testBcrypt.Verify(argonHash, "secreto-largo") {
+		t.Error("a bcrypt hasher does not verify argon2id hashes")
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	bcryptHash, err := testBcrypt.Hash("secreto-largo")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	argonHash, err := testArgon.Hash("secreto-largo")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+
+	higherCost := testBcrypt
+	higherCost.BcryptCost++
+	moreMemory := testArgon
+	moreMemory.Argon2.MemoryKB *= 2
+	moreTime := testArgon
+	moreTime.Argon2.Time++
+	moreThreads := testArgon
+	moreThreads.Argon2.Threads++
+
+	tests := []struct {
+		name string
+		h    Hasher
+		hash string
+		want bool
+	}{
+		{"bcrypt, same cost", testBcrypt, bcryptHash, false},
+		{"bcrypt, other cost", higherCost, bcryptHash, true},
+		{"bcrypt to argon2id", testArgon, bcryptHash, true},
+		{"argon2id, same params", testArgon, argonHash, false},
+		{"argon2id, more memory", moreMemory, argonHash, true},
+		{"argon2id, more time", moreTime, argonHash, true},
+		{"argon2id, more threads", moreThreads, argonHash, true},
+		{"argon2id to bcrypt", testBcrypt, argonHash, true},
+		{"unparseable", testBcrypt, "!", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.h.NeedsRehash(tt.hash); got != tt.want {
+				t.Errorf("NeedsRehash = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseArgon2RejectsMalformedHashes(t *testing.T) {
+	hash, err := testArgon.Hash("secreto-largo")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if _, _, _, ok := parseArgon2(hash); !ok {
+		t.Fatalf("parseArgon2 rejects %q", hash)
+	}
+	parts := strings.Split(hash, "$")
+	salt, key := parts[4], parts[5]
+	b64 := base64.RawStdEncoding.EncodeToString
+
+	for _, malformed := range []string{
+		"",
+		"$argon2id$",
+		"$argon2i$v=19$m=64,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=256$" + salt + "$" + key,
+		"$argon2id$v=19$m=x,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=1$not base64!$" + key,
+		"$argon2id$v=19$m=64,t=1,p=1$" + salt + "$",
+		"$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key + "$extra",
+		"$argon2id$v=19$m=64,t=1,p=1$" + b64([]byte("salt")) + "$" + key + "==",
+	} {
+		if _, _, _, ok := parseArgon2(malformed); ok {
+			t.Errorf("parseArgon2 accepts %q", malformed)
+		}
+		if testArgon.Verify(malformed, "secreto-largo") {
+			t.Errorf("Verify matches the malformed hash %q", malformed)
+		}
+	}
+}
+
+func TestHasherFromEnv(t *testing.T) {
+	t.Setenv("PASSWORD_HASH", "argon2id")
+	t.Setenv("BCRYPT_COST", "12")
+	t.Setenv("ARGON2_MEMORY_KB", "65536")
+	t.Setenv("ARGON2_TIME", "3")
+	t.Setenv("ARGON2_THREADS", "4")
+	h, err := HasherFromEnv()
+	if err != nil {
+		t.Fatalf("HasherFromEnv: %v", err)
+	}
+	want := Hasher{Algorithm: Argon2id, BcryptCost: 12, Argon2: Argon2Params{MemoryKB: 65536, Time: 3, Threads: 4}}
+	if h != want {
+		t.Errorf("HasherFromEnv = %+v, want %+v", h, want)
+	}
+
+	for name, value := range map[string]string{
+		"PASSWORD_HASH":    "md5",
+		"BCRYPT_COST":      "3",
+		"ARGON2_MEMORY_KB": "1024",
+		"ARGON2_TIME":      "0",
+		"ARGON2_THREADS":   "many",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := HasherFromEnv(); err == nil {
+				t.Errorf("%s=%s was accepted", name, value)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Package password decides which passwords are acceptable and how they are
+// hashed.
+package password
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultMinLength is the shortest password accepted unless
+	// PASSWORD_MIN_LENGTH says otherwise.
+	DefaultMinLength = 8
+
+	// MaxBytes is the longest password accepted. bcrypt ignores anything
+	// past 72 bytes, so the limit applies with argon2id too: passwords keep
+	// working if the algorithm is switched back.
+	MaxBytes = 72
+)
+
+//go:embed common.txt
+var commonList string
+
+// common holds the bundled common passwords, lowercased.
+var common = func() map[string]struct{} {
+	set := make(map[string]struct{})
+	scanner := bufio.NewScanner(strings.NewReader(commonList))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			set[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	return set
+}()
+
+// PolicyError explains why a password was refused. Its message is meant
+// for the person choosing the password.
+type PolicyError struct {
+	Message string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Message
+}
+
+// Policy is what a password must satisfy.
+type Policy struct {
+	MinLength int
+}
+
+// DefaultPolicy is used until the server configures one.
+var DefaultPolicy = Policy{MinLength: DefaultMinLength}
+
+// PolicyFromEnv reads PASSWORD_MIN_LENGTH, falling back to DefaultPolicy.
+func PolicyFromEnv() (Policy, error) {
+	policy := DefaultPolicy
+	if s := os.Getenv("PASSWORD_MIN_LENGTH"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxBytes {
+			return policy, fmt.Errorf("PASSWORD_MIN_LENGTH must be a number between 1 and %d", MaxBytes)
+		}
+		policy.MinLength = n
+	}
+	return policy, nil
+}
+
+// Validate returns a *PolicyError if password is not acceptable for the
+// account named username.
+func (p Policy) Validate(password, username string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return &PolicyError{fmt.Sprintf("The password must be at least %d characters long", p.MinLength)}
+	}
+	if len(password) > MaxBytes {
+		return &PolicyError{fmt.Sprintf("The password must be at most %d bytes long", MaxBytes)}
+	}
+
+	lower := strings.ToLower(password)
+	if _, ok := common[lower]; ok {
+		return &PolicyError{"This password is too common; choose one that is harder to guess"}
+	}
+	if name := strings.ToLower(strings.TrimSpace(username)); name != "" && strings.Contains(lower, name) {
+		return &PolicyError{"The password must not contain the username"}
+	}
+	return nil
+}
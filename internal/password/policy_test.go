@@ -0,0 +1,76 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	policy := Policy{MinLength: 8}
+
+	tests := []struct {
+		name     string
+		password string
+		username string
+		ok       bool
+	}{
+		{"long enough", "tres-tristes-tigres", "ana", true},
+		{"too short", "corta12", "ana", false},
+		{"minimum length in runes", "ñandú-áé", "ana", true},
+		{"short in runes, long in bytes", "ñandúñ", "ana", false},
+		{"exactly 72 bytes", strings.Repeat("a", 71) + "b", "ana", true},
+		{"over 72 bytes", strings.Repeat("a", 72) + "b", "ana", false},
+		{"72 runes over 72 bytes", strings.Repeat("ñ", 40), "ana", false},
+		{"common password", "password123", "ana", false},
+		{"common password, other case", "PassWord123", "ana", false},
+		{"contains the username", "soy-gamer-01!", "gamer-01", false},
+		{"contains the username, other case", "SOY-GAMER-01!", "gamer-01", false},
+		{"blank username", "tres-tristes-tigres", "  ", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Validate(tt.password, tt.username)
+			if tt.ok {
+				if err != nil {
+					t.Errorf("Validate refused %q: %v", tt.password, err)
+				}
+				return
+			}
+			var policyErr *PolicyError
+			if !errors.As(err, &policyErr) {
+				t.Errorf("Validate(%q) = %v, want a *PolicyError", tt.password, err)
+			}
+		})
+	}
+}
+
+func TestCommonListIsLoaded(t *testing.T) {
+	for _, password := range []string{"123456", "qwerty", "p@ssw0rd"} {
+		if _, ok := common[password]; !ok {
+			t.Errorf("%q is not in the common list", password)
+		}
+	}
+	if _, ok := common["# passwords refused by the policy for being too common. one per line,"]; ok {
+		t.Error("the comment of common.txt was read as a password")
+	}
+}
+
+func TestPolicyFromEnv(t *testing.T) {
+	t.Setenv("PASSWORD_MIN_LENGTH", "")
+	if p, err := PolicyFromEnv(); err != nil || p != DefaultPolicy {
+		t.Errorf("unset PASSWORD_MIN_LENGTH gave %+v, %v", p, err)
+	}
+
+	t.Setenv("PASSWORD_MIN_LENGTH", "12")
+	if p, err := PolicyFromEnv(); err != nil || p.MinLength != 12 {
+		t.Errorf("PASSWORD_MIN_LENGTH=12 gave %+v, %v", p, err)
+	}
+
+	for _, value := range []string{"0", "73", "ocho"} {
+		t.Setenv("PASSWORD_MIN_LENGTH", value)
+		if _, err := PolicyFromEnv(); err == nil {
+			t.Errorf("PASSWORD_MIN_LENGTH=%s was accepted", value)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nicolas-camacho/thrg/internal/apierror"
+)
+
+// Policy says how many failures a key may have before it is locked out, and
+// for how long. Each failure past Threshold doubles the lockout, up to
+// MaxLockout.
+type Policy struct {
+	Threshold   int
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	// Window is how long a key must stay quiet for its count to start over.
+	Window time.Duration
+}
+
+var (
+	// UsernamePolicy protects a single account from password guessing.
+	UsernamePolicy = Policy{Threshold: 5, BaseLockout: 30 * time.Second, MaxLockout: time.Hour, Window: 15 * time.Minute}
+	// IPPolicy is looser, since several people may share an address, but
+	// still stops one client from trying many accounts or tokens.
+	IPPolicy = Policy{Threshold: 20, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: 15 * time.Minute}
+	// TokenPolicy is for endpoints that take a secret token (registration,
+	// password reset): nobody legitimately gets many tokens wrong.
+	TokenPolicy = Policy{Threshold: 10, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour}
+)
+
+func (p Policy) lockout(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+	d := float64(p.BaseLockout) * math.Pow(2, float64(failures-p.Threshold))
+	if d > float64(p.MaxLockout) {
+		return p.MaxLockout
+	}
+	return time.Duration(d)
+}
+
+// Guard limits failed attempts at one action (admin login, player login,
+// registration...) per IP address and per username.
+type Guard struct {
+	store  Store
+	action string
+	ip     Policy
+	user   Policy
+}
+
+func NewGuard(store Store, action string, ip, user Policy) *Guard {
+	return &Guard{store: store, action: action, ip: ip, user: user}
+}
+
+func (g *Guard) keys(ip, username string) []string {
+	keys := []string{g.action + ":ip:" + ip}
+	if username != "" {
+		keys = append(keys, g.action+":user:"+strings.ToLower(username))
+	}
+	return keys
+}
+
+func (g *Guard) policy(key string) Policy {
+	if strings.HasPrefix(key, g.action+":user:") {
+		return g.user
+	}
+	return g.ip
+}
+
+// Check returns how long the caller must wait before trying again, or 0 if
+// neither the IP nor the username is locked out. Pass "" as username for
+// actions that are not tied to an account.
+func (g *Guard) Check(ctx context.Context, ip, username string) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range g.keys(ip, username) {
+		e, err := g.store.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if e != nil && e.LockedUntil != nil && e.LockedUntil.After(now) {
+			wait = max(wait, e.LockedUntil.Sub(now))
+		}
+	}
+	return wait, nil
+}
+
+// Fail records a failed attempt and locks out the IP or username once they
+// pass their threshold. It returns the resulting lockout, if any.
+func (g *Guard) Fail(ctx context.Context, ip, username string) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range g.keys(ip, username) {
+		policy := g.policy(key)
+		failures, err := g.store.AddFailure(ctx, key, now, policy.Window)
+		if err != nil {
+			return 0, err
+		}
+		if d := policy.lockout(failures); d > 0 {
+			if err := g.store.Lock(ctx, key, now.Add(d)); err != nil {
+				return 0, err
+			}
+			wait = max(wait, d)
+		}
+	}
+
+	log.Printf("Failed %s attempt from %s (username %q)", g.action, ip, username)
+	if wait > 0 {
+		log.Printf("Locked out %s from %s (username %q) for %s", g.action, ip, username, wait.Round(time.Second))
+	}
+	return wait, nil
+}
+
+// Succeed clears the username's failures after a successful attempt. The
+// IP's failures are kept, so guessing across many accounts still adds up.
+func (g *Guard) Succeed(ctx context.Context, username string) error {
+	if username == "" {
+		return nil
+	}
+	return g.store.Reset(ctx, g.action+":user:"+strings.ToLower(username))
+}
+
+// WriteTooManyAttempts answers a locked out request with 429 and a
+// Retry-After header. The error's retryAfter detail has the same number of
+// seconds.
+func WriteTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	apierror.Write(w, apierror.New(http.StatusTooManyRequests, "too_many_attempts", TooManyAttemptsMessage(wait)).
+		WithDetail("retryAfter", seconds))
+}
+
+func TooManyAttemptsMessage(wait time.Duration) string {
+	return fmt.Sprintf("Too many failed attempts, try again in %s", wait.Round(time.Second))
+}
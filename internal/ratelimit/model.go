@@ -0,0 +1,16 @@
+package ratelimit
+
+import "time"
+
+// Entry counts recent failures for one key, such as an IP address or a
+// username, and how long the key is locked out.
+type Entry struct {
+	Key           string `gorm:"primaryKey"`
+	Failures      int    `gorm:"not null"`
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+func (Entry) TableName() string {
+	return "rate_limit_entries"
+}
@@ -0,0 +1,159 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Store keeps failure counts. The in-memory store is enough for a single
+// instance; the Postgres store shares counts between instances.
+type Store interface {
+	// Get returns the entry for key, or nil if there is none.
+	Get(ctx context.Context, key string) (*Entry, error)
+	// AddFailure records a failure and returns the failure count. Counts
+	// start over once the key has been quiet for window, both since the last
+	// failure and since its last lockout ended.
+	AddFailure(ctx context.Context, key string, now time.Time, window time.Duration) (int, error)
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+}
+
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*Entry
+	swept   time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*Entry)}
+}
+
+func (m *MemoryStore) Get(ctx context.Context, key string) (*Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	copied := *e
+	return &copied, nil
+}
+
+func (m *MemoryStore) AddFailure(ctx context.Context, key string, now time.Time, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweep(now)
+
+	e, ok := m.entries[key]
+	if !ok || isStale(e, now, window) {
+		e = &Entry{Key: key}
+		m.entries[key] = e
+	}
+	e.Failures++
+	e.LastFailureAt = now
+	return e.Failures, nil
+}
+
+func (m *MemoryStore) Lock(ctx context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entries[key]; ok {
+		e.LockedUntil = &until
+	}
+	return nil
+}
+
+func (m *MemoryStore) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
+
+// sweep drops entries untouched for a day so the map does not grow forever.
+// It runs at most once an hour.
+func (m *MemoryStore) sweep(now time.Time) {
+	if now.Sub(m.swept) < time.Hour {
+		return
+	}
+	m.swept = now
+	for key, e := range m.entries {
+		if isStale(e, now, 24*time.Hour) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+func isStale(e *Entry, now time.Time, window time.Duration) bool {
+	if now.Sub(e.LastFailureAt) < window {
+		return false
+	}
+	return e.LockedUntil == nil || now.Sub(*e.LockedUntil) >= window
+}
+
+type PostgresStore struct {
+	db *gorm.DB
+}
+
+func NewPostgresStore(db *gorm.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (p *PostgresStore) Get(ctx context.Context, key string) (*Entry, error) {
+	var e Entry
+	result := p.db.WithContext(ctx).First(&e, "key = ?", key)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get rate limit entry: %w", result.Error)
+	}
+	return &e, nil
+}
+
+func (p *PostgresStore) AddFailure(ctx context.Context, key string, now time.Time, window time.Duration) (int, error) {
+	cutoff := now.Add(-window)
+	var failures int
+	// A single upsert keeps concurrent failures from different instances
+	// from overwriting each other's counts.
+	result := p.db.WithContext(ctx).Raw(`
+		INSERT INTO rate_limit_entries (key, failures, last_failure_at)
+		VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN rate_limit_entries.last_failure_at < ?
+					AND (rate_limit_entries.locked_until IS NULL OR rate_limit_entries.locked_until < ?)
+				THEN 1
+				ELSE rate_limit_entries.failures + 1
+			END,
+			last_failure_at = EXCLUDED.last_failure_at
+		RETURNING failures`, key, now, cutoff, cutoff).Scan(&failures)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to record failure: %w", result.Error)
+	}
+	return failures, nil
+}
+
+func (p *PostgresStore) Lock(ctx context.Context, key string, until time.Time) error {
+	result := p.db.WithContext(ctx).Model(&Entry{}).Where("key = ?", key).Update("locked_until", until)
+	if result.Error != nil {
+		return fmt.Errorf("failed to lock key: %w", result.Error)
+	}
+	return nil
+}
+
+func (p *PostgresStore) Reset(ctx context.Context, key string) error {
+	if err := p.db.WithContext(ctx).Delete(&Entry{}, "key = ?", key).Error; err != nil {
+		return fmt.Errorf("failed to reset key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package session
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// TrustedProxies are the reverse proxies in front of the server. ClientIP
+// believes the X-Forwarded-For header only on requests that come from one
+// of them, since anyone else can write whatever they like in it. Empty, the
+// default, means the server is reached directly.
+var TrustedProxies []netip.Prefix
+
+// TrustedProxiesFromEnv reads TRUSTED_PROXIES: a comma-separated list of
+// addresses or CIDR ranges, such as "10.0.0.0/8, 127.0.0.1".
+func TrustedProxiesFromEnv() ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not an address or CIDR range", entry)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not an address or CIDR range", entry)
+		}
+		addr = addr.Unmap()
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+// ClientIP returns the IP address the request came from. Behind trusted
+// proxies that is the last address in X-Forwarded-For that is not one of
+// them: each proxy appends the address it got the request from, so the
+// entries before that one were written by the client and prove nothing.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !isTrustedProxy(addr) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package session
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 127.0.0.1, ::1")
+	proxies, err := TrustedProxiesFromEnv()
+	if err != nil {
+		t.Fatalf("TrustedProxiesFromEnv: %v", err)
+	}
+	TrustedProxies = proxies
+	t.Cleanup(func() { TrustedProxies = nil })
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct client", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"direct client forging the header", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"behind a proxy", "10.0.0.2:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"client prepending a fake hop", "10.0.0.2:5000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"behind two proxies", "127.0.0.1:5000", []string{"198.51.100.1, 10.1.2.3"}, "198.51.100.1"},
+		{"header split over lines", "10.0.0.2:5000", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+		{"IPv6 proxy", "[::1]:5000", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"proxy without the header", "10.0.0.2:5000", nil, "10.0.0.2"},
+		{"garbage after a proxy", "10.0.0.2:5000", []string{"198.51.100.1, not-an-ip"}, "10.0.0.2"},
+		{"only proxies", "10.0.0.2:5000", []string{"10.9.9.9"}, "10.9.9.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP is %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxiesFromEnvRejectsGarbage(t *testing.T) {
+	for _, value := range []string{"proxy.internal", "10.0.0.0/33", "10.0.0.1,,nope"} {
+		t.Setenv("TRUSTED_PROXIES", value)
+		if _, err := TrustedProxiesFromEnv(); err == nil {
+			t.Errorf("TRUSTED_PROXIES %q was accepted", value)
+		}
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "")
+	if proxies, err := TrustedProxiesFromEnv(); err != nil || len(proxies) != 0 {
+		t.Errorf("unset TRUSTED_PROXIES gave %v, %v", proxies, err)
+	}
+}
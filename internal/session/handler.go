@@ -0,0 +1,114 @@
+package session
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"github.com/nicolas-camacho/thrg/internal/apierror"
+)
+
+type SessionDTO struct {
+	ID         string    `json:"ID"`
+	Kind       string    `json:"Kind"`
+	UserAgent  string    `json:"UserAgent"`
+	IP         string    `json:"IP"`
+	CreatedAt  time.Time `json:"CreatedAt"`
+	LastSeenAt time.Time `json:"LastSeenAt"`
+	ExpiresAt  time.Time `json:"ExpiresAt"`
+	Current    bool      `json:"Current"`
+}
+
+func parseUserID(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	userID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		apierror.Write(w, apierror.BadRequest("Invalid user ID"))
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+func ListUserSessionsHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := parseUserID(w, r)
+		if !ok {
+			return
+		}
+
+		sessions, err := store.ListUserSessions(r.Context(), userID)
+		if err != nil {
+			log.Printf("Error listing sessions: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		dtos := make([]SessionDTO, len(sessions))
+		for i, s := range sessions {
+			dtos[i] = SessionDTO{
+				ID:         s.ID,
+				Kind:       s.Name,
+				UserAgent:  s.UserAgent,
+				IP:         s.IP,
+				CreatedAt:  s.CreatedAt,
+				LastSeenAt: s.LastSeenAt,
+				ExpiresAt:  s.ExpiresAt,
+				Current:    store.IsCurrent(r, s.ID),
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(dtos); err != nil {
+			log.Printf("Error encoding sessions to JSON: %v", err)
+		}
+	}
+}
+
+func RevokeSessionHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := parseUserID(w, r)
+		if !ok {
+			return
+		}
+
+		revoked, err := store.RevokeSession(r.Context(), userID, chi.URLParam(r, "sessionID"))
+		if err != nil {
+			log.Printf("Error revoking session: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+		if !revoked {
+			apierror.Write(w, apierror.NotFound("Session not found"))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func RevokeUserSessionsHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := parseUserID(w, r)
+		if !ok {
+			return
+		}
+
+		n, err := store.RevokeUserSessions(r.Context(), userID)
+		if err != nil {
+			log.Printf("Error revoking sessions: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]any{
+			"message": "Sessions revoked successfully",
+			"revoked": n,
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package session
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryBackend keeps sessions in process. It is meant for tests and local
+// runs; sessions are lost on restart and are not shared between instances.
+type MemoryBackend struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{sessions: make(map[string]Session)}
+}
+
+func (m *MemoryBackend) Save(ctx context.Context, s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := m.sessions[s.ID]; ok {
+		s.CreatedAt = existing.CreatedAt
+	} else if s.CreatedAt.IsZero() {
+		s.CreatedAt = now
+	}
+	s.UpdatedAt = now
+	m.sessions[s.ID] = *s
+	return nil
+}
+
+func (m *MemoryBackend) Find(ctx context.Context, id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok || !s.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+func (m *MemoryBackend) Touch(ctx context.Context, id string, seen time.Time, ip, userAgent string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.sessions[id]; ok {
+		s.LastSeenAt, s.IP, s.UserAgent = seen, ip, userAgent
+		m.sessions[id] = s
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *MemoryBackend) ListByUser(ctx context.Context, userID uuid.UUID) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var sessions []Session
+	for _, s := range m.sessions {
+		if s.UserID != nil && *s.UserID == userID && s.ExpiresAt.After(now) {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+func (m *MemoryBackend) DeleteForUser(ctx context.Context, userID uuid.UUID, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok || s.UserID == nil || *s.UserID != userID {
+		return false, nil
+	}
+	delete(m.sessions, id)
+	return true, nil
+}
+
+func (m *MemoryBackend) DeleteByUser(ctx context.Context, userID uuid.UUID) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for id, s := range m.sessions {
+		if s.UserID != nil && *s.UserID == userID {
+			delete(m.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MemoryBackend) DeleteExpired(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var n int64
+	for id, s := range m.sessions {
+		if !s.ExpiresAt.After(now) {
+			delete(m.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
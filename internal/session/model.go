@@ -0,0 +1,23 @@
+package session
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session is a server-side session. The browser only holds a random token in
+// its cookie; ID is the SHA-256 of that token, so a leaked table cannot be
+// used to hijack sessions.
+type Session struct {
+	ID         string `gorm:"primaryKey"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	Name       string     `gorm:"not null"`
+	UserID     *uuid.UUID `gorm:"type:uuid;index"`
+	Data       []byte
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time `gorm:"not null"`
+	ExpiresAt  time.Time `gorm:"index;not null"`
+}
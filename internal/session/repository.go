@@ -0,0 +1,115 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Backend persists sessions for the Store.
+type Backend interface {
+	Save(ctx context.Context, s *Session) error
+	// Find returns the session with the given ID, or nil if it does not
+	// exist or has expired.
+	Find(ctx context.Context, id string) (*Session, error)
+	Touch(ctx context.Context, id string, seen time.Time, ip, userAgent string) error
+	Delete(ctx context.Context, id string) error
+	ListByUser(ctx context.Context, userID uuid.UUID) ([]Session, error)
+	// DeleteForUser deletes a session only if it belongs to the user, and
+	// reports whether it did.
+	DeleteForUser(ctx context.Context, userID uuid.UUID, id string) (bool, error)
+	DeleteByUser(ctx context.Context, userID uuid.UUID) (int64, error)
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+// Repository is the Postgres Backend.
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{db: db}
+}
+
+func (r *Repository) Save(ctx context.Context, s *Session) error {
+	result := r.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at", "user_id", "data", "user_agent", "ip", "last_seen_at", "expires_at"}),
+	}).Create(s)
+	if result.Error != nil {
+		return fmt.Errorf("failed to save session: %w", result.Error)
+	}
+	return nil
+}
+
+func (r *Repository) Find(ctx context.Context, id string) (*Session, error) {
+	var s Session
+	result := r.db.WithContext(ctx).Where("id = ? AND expires_at > ?", id, time.Now()).First(&s)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to find session: %w", result.Error)
+	}
+	return &s, nil
+}
+
+func (r *Repository) Touch(ctx context.Context, id string, seen time.Time, ip, userAgent string) error {
+	result := r.db.WithContext(ctx).Model(&Session{}).Where("id = ?", id).Updates(map[string]any{
+		"last_seen_at": seen,
+		"ip":           ip,
+		"user_agent":   userAgent,
+	})
+	if result.Error != nil {
+		return fmt.Errorf("failed to touch session: %w", result.Error)
+	}
+	return nil
+}
+
+func (r *Repository) Delete(ctx context.Context, id string) error {
+	if err := r.db.WithContext(ctx).Delete(&Session{}, "id = ?", id).Error; err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+func (r *Repository) ListByUser(ctx context.Context, userID uuid.UUID) ([]Session, error) {
+	var sessions []Session
+	result := r.db.WithContext(ctx).
+		Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", result.Error)
+	}
+	return sessions, nil
+}
+
+func (r *Repository) DeleteForUser(ctx context.Context, userID uuid.UUID, id string) (bool, error) {
+	result := r.db.WithContext(ctx).Delete(&Session{}, "id = ? AND user_id = ?", id, userID)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to delete session: %w", result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (r *Repository) DeleteByUser(ctx context.Context, userID uuid.UUID) (int64, error) {
+	result := r.db.WithContext(ctx).Delete(&Session{}, "user_id = ?", userID)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to delete user sessions: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+func (r *Repository) DeleteExpired(ctx context.Context) (int64, error) {
+	result := r.db.WithContext(ctx).Delete(&Session{}, "expires_at <= ?", time.Now())
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to delete expired sessions: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
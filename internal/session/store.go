@@ -0,0 +1,221 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/sessions"
+)
+
+// UserIDKey is the session value holding the logged-in user's ID. The store
+// copies it to the session record so sessions can be listed and revoked per
+// user.
+const UserIDKey = "user_id"
+
+const (
+	// touchInterval limits how often a request updates a session's last seen
+	// time, so reads do not turn into a write per request.
+	touchInterval = time.Minute
+	// defaultLifetime applies to browser-session cookies (MaxAge 0).
+	defaultLifetime = 24 * time.Hour
+)
+
+// Store is a gorilla sessions.Store that keeps session values on the server.
+// Unlike a cookie store, a session can be revoked before it expires.
+type Store struct {
+	backend Backend
+	Options *sessions.Options
+}
+
+func NewStore(backend Backend) *Store {
+	return &Store{
+		backend: backend,
+		Options: &sessions.Options{Path: "/", MaxAge: int(defaultLifetime.Seconds())},
+	}
+}
+
+func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	record, err := s.backend.Find(r.Context(), hashToken(cookie.Value))
+	if err != nil {
+		return session, err
+	}
+	if record == nil || record.Name != name {
+		return session, nil
+	}
+
+	if err := decodeValues(record.Data, &session.Values); err != nil {
+		return session, fmt.Errorf("error decoding session: %w", err)
+	}
+	session.ID = cookie.Value
+	session.IsNew = false
+
+	if now := time.Now(); now.Sub(record.LastSeenAt) > touchInterval {
+		if err := s.backend.Touch(r.Context(), record.ID, now, ClientIP(r), r.UserAgent()); err != nil {
+			log.Printf("Failed to update session last seen time: %v", err)
+		}
+	}
+	return session, nil
+}
+
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.Delete(r.Context(), hashToken(session.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		token, err := generateToken()
+		if err != nil {
+			return fmt.Errorf("error generating session token: %w", err)
+		}
+		session.ID = token
+	}
+
+	data, err := encodeValues(session.Values)
+	if err != nil {
+		return fmt.Errorf("error encoding session: %w", err)
+	}
+
+	lifetime := time.Duration(session.Options.MaxAge) * time.Second
+	if lifetime == 0 {
+		lifetime = defaultLifetime
+	}
+
+	now := time.Now()
+	record := &Session{
+		ID:         hashToken(session.ID),
+		Name:       session.Name(),
+		Data:       data,
+		UserAgent:  r.UserAgent(),
+		IP:         ClientIP(r),
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(lifetime),
+	}
+	if userID, ok := session.Values[UserIDKey].(uuid.UUID); ok && userID != uuid.Nil {
+		record.UserID = &userID
+	}
+
+	if err := s.backend.Save(r.Context(), record); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), session.ID, session.Options))
+	return nil
+}
+
+// Renew gives the session a new ID when it is next saved and ends the old
+// one now, keeping its values. Call it whenever the session gains
+// privileges, such as at login, so an ID planted in the browser beforehand
+// is worthless.
+func (s *Store) Renew(r *http.Request, session *sessions.Session) error {
+	if session.ID != "" {
+		if err := s.backend.Delete(r.Context(), hashToken(session.ID)); err != nil {
+			return err
+		}
+	}
+	session.ID = ""
+	return nil
+}
+
+// ListUserSessions returns the user's active sessions, most recently used
+// first.
+func (s *Store) ListUserSessions(ctx context.Context, userID uuid.UUID) ([]Session, error) {
+	return s.backend.ListByUser(ctx, userID)
+}
+
+// RevokeSession ends one of the user's sessions. It reports false if the
+// session does not exist or belongs to someone else.
+func (s *Store) RevokeSession(ctx context.Context, userID uuid.UUID, sessionID string) (bool, error) {
+	return s.backend.DeleteForUser(ctx, userID, sessionID)
+}
+
+// RevokeUserSessions ends every session of the user, logging them out
+// everywhere on their next request.
+func (s *Store) RevokeUserSessions(ctx context.Context, userID uuid.UUID) (int64, error) {
+	return s.backend.DeleteByUser(ctx, userID)
+}
+
+// IsCurrent reports whether the session with the given ID is the one making
+// the request.
+func (s *Store) IsCurrent(r *http.Request, sessionID string) bool {
+	for _, c := range r.Cookies() {
+		if hashToken(c.Value) == sessionID {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanupExpired deletes expired sessions every interval until ctx is done.
+func (s *Store) CleanupExpired(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.backend.DeleteExpired(ctx)
+			if err != nil {
+				log.Printf("Failed to clean up expired sessions: %v", err)
+			} else if n > 0 {
+				log.Printf("Deleted %d expired sessions", n)
+			}
+		}
+	}
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func encodeValues(values map[interface{}]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeValues(data []byte, values *map[interface{}]interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(values)
+}
@@ -0,0 +1,544 @@
+package story
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Format string
+
+const (
+	FormatJSON     Format = "json"
+	FormatYAML     Format = "yaml"
+	FormatMarkdown Format = "markdown"
+	FormatZip      Format = "zip"
+)
+
+// Limits on what the zip archives of one upload expand to. Entries are
+// small, but a zip compresses them so well that their number and total
+// size need a limit of their own.
+const (
+	maxArchiveEntrySize = 5 << 20
+	maxArchiveEntries   = 200
+	maxArchiveTotalSize = 20 << 20
+)
+
+// FormatFromFilename picks the parser for a file based on its extension.
+func FormatFromFilename(name string) (Format, bool) {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".json":
+		return FormatJSON, true
+	case ".yaml", ".yml":
+		return FormatYAML, true
+	case ".md", ".markdown":
+		return FormatMarkdown, true
+	case ".zip":
+		return FormatZip, true
+	}
+	return "", false
+}
+
+// FormatFromContentType picks the parser for a request body or multipart
+// part based on its media type.
+func FormatFromContentType(contentType string) (Format, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	switch mediaType {
+	case "application/json":
+		return FormatJSON, true
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return FormatYAML, true
+	case "text/markdown", "text/x-markdown":
+		return FormatMarkdown, true
+	case "application/zip", "application/x-zip-compressed":
+		return FormatZip, true
+	}
+	return "", false
+}
+
+// ParseError points at the file and line where a story document is invalid.
+type ParseError struct {
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e ParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.File, e.Message)
+}
+
+// ParseErrors collects every problem found in an upload so authors can fix
+// them in one go instead of one per request.
+type ParseErrors []ParseError
+
+func (e ParseErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, pe := range e {
+		msgs[i] = pe.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Document is one uploaded story file, or the raw request body.
+type Document struct {
+	Name   string
+	Format Format
+	Data   []byte
+}
+
+// parsedDocument is what a single file contributes to the upload: either
+// complete stories, or one act that belongs to the story in the same
+// directory.
+type parsedDocument struct {
+	name    string
+	stories []StoryData
+	act     *ActData
+}
+
+// ParseDocuments turns a set of uploaded documents into story data. Zip
+// archives are expanded first; inside them every directory holds one story
+// file (JSON, YAML or Markdown with front matter) and, optionally, one
+// Markdown or YAML file per act.
+func ParseDocuments(docs []Document) ([]StoryData, error) {
+	var errs ParseErrors
+
+	expanded, err := expandArchives(docs)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed []parsedDocument
+	for _, doc := range expanded {
+		p, docErrs := parseDocument(doc)
+		if len(docErrs) > 0 {
+			errs = append(errs, docErrs...)
+			continue
+		}
+		parsed = append(parsed, p)
+	}
+
+	stories, groupErrs := groupActs(parsed)
+	errs = append(errs, groupErrs...)
+	errs = append(errs, validateStories(stories)...)
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return stories, nil
+}
+
+func expandArchives(docs []Document) ([]Document, error) {
+	var out []Document
+	var entries int
+	var total int64
+	for _, doc := range docs {
+		if doc.Format != FormatZip {
+			out = append(out, doc)
+			continue
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(doc.Data), int64(len(doc.Data)))
+		if err != nil {
+			return nil, ParseErrors{{File: doc.Name, Message: "invalid zip archive: " + err.Error()}}
+		}
+
+		// The sizes in the archive are checked before anything is read, and
+		// the bytes actually read are counted too, since those sizes can lie.
+		entries += len(zr.File)
+		if entries > maxArchiveEntries {
+			return nil, ParseErrors{{File: doc.Name, Message: fmt.Sprintf("archives can hold at most %d files", maxArchiveEntries)}}
+		}
+		var declared uint64
+		for _, f := range zr.File {
+			declared += f.UncompressedSize64
+		}
+		if declared > maxArchiveTotalSize-uint64(total) {
+			return nil, errArchiveTooLarge(doc.Name)
+		}
+
+		var errs ParseErrors
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() || isHiddenPath(f.Name) {
+				continue
+			}
+			name := doc.Name + "/" + f.Name
+
+			format, ok := FormatFromFilename(f.Name)
+			if !ok || format == FormatZip {
+				errs = append(errs, ParseError{File: name, Message: "unsupported file type"})
+				continue
+			}
+			if f.UncompressedSize64 > maxArchiveEntrySize {
+				errs = append(errs, ParseError{File: name, Message: "file is too large"})
+				continue
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				errs = append(errs, ParseError{File: name, Message: "cannot open file: " + err.Error()})
+				continue
+			}
+			data, err := io.ReadAll(io.LimitReader(rc, min(maxArchiveEntrySize, maxArchiveTotalSize-total)+1))
+			rc.Close()
+			if err != nil {
+				errs = append(errs, ParseError{File: name, Message: "cannot read file: " + err.Error()})
+				continue
+			}
+			total += int64(len(data))
+			if total > maxArchiveTotalSize {
+				return nil, errArchiveTooLarge(doc.Name)
+			}
+			if len(data) > maxArchiveEntrySize {
+				errs = append(errs, ParseError{File: name, Message: "file is too large"})
+				continue
+			}
+			out = append(out, Document{Name: name, Format: format, Data: data})
+		}
+		if len(errs) > 0 {
+			return nil, errs
+		}
+	}
+	return out, nil
+}
+
+func errArchiveTooLarge(name string) ParseErrors {
+	return ParseErrors{{File: name, Message: fmt.Sprintf("archives can expand to at most %d MiB", maxArchiveTotalSize>>20)}}
+}
+
+func isHiddenPath(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+func parseDocument(doc Document) (parsedDocument, ParseErrors) {
+	p := parsedDocument{name: doc.Name}
+
+	switch doc.Format {
+	case FormatJSON:
+		stories, err := parseJSONStories(doc)
+		if err != nil {
+			return p, err
+		}
+		p.stories = stories
+	case FormatYAML:
+		stories, act, err := parseYAMLDocument(doc.Name, doc.Data, 0)
+		if err != nil {
+			return p, err
+		}
+		p.stories, p.act = stories, act
+	case FormatMarkdown:
+		stories, act, err := parseMarkdownDocument(doc.Name, doc.Data)
+		if err != nil {
+			return p, err
+		}
+		p.stories, p.act = stories, act
+	default:
+		return p, ParseErrors{{File: doc.Name, Message: "unsupported format"}}
+	}
+
+	setSource(p.stories, doc.Name)
+	if p.act != nil {
+		setActSource(p.act, doc.Name)
+	}
+	return p, nil
+}
+
+func parseJSONStories(doc Document) ([]StoryData, ParseErrors) {
+	trimmed := bytes.TrimSpace(doc.Data)
+
+	var stories []StoryData
+	var err error
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		var single StoryData
+		err = json.Unmarshal(trimmed, &single)
+		stories = []StoryData{single}
+	} else {
+		err = json.Unmarshal(trimmed, &stories)
+	}
+	if err == nil {
+		return stories, nil
+	}
+
+	pe := ParseError{File: doc.Name, Message: err.Error()}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		pe.Line = lineAtOffset(trimmed, syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		pe.Line = lineAtOffset(trimmed, typeErr.Offset)
+	}
+	return nil, ParseErrors{pe}
+}
+
+func lineAtOffset(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// parseYAMLDocument accepts a list of stories, a single story, or a single
+// act (a mapping with an "order" key and no "holderName"). lineOffset is
+// added to every reported line, for YAML embedded in Markdown front matter.
+func parseYAMLDocument(name string, data []byte, lineOffset int) ([]StoryData, *ActData, ParseErrors) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, yamlErrors(name, lineOffset, err)
+	}
+	if len(root.Content) == 0 {
+		return nil, nil, ParseErrors{{File: name, Message: "document is empty"}}
+	}
+	node := root.Content[0]
+
+	switch {
+	case node.Kind == yaml.SequenceNode:
+		var stories []StoryData
+		if err := node.Decode(&stories); err != nil {
+			return nil, nil, yamlErrors(name, lineOffset, err)
+		}
+		shiftStoryLines(stories, lineOffset)
+		return stories, nil, nil
+	case node.Kind == yaml.MappingNode && hasKey(node, "order") && !hasKey(node, "holderName"):
+		var act ActData
+		if err := node.Decode(&act); err != nil {
+			return nil, nil, yamlErrors(name, lineOffset, err)
+		}
+		shiftActLines(&act, lineOffset)
+		return nil, &act, nil
+	case node.Kind == yaml.MappingNode:
+		var story StoryData
+		if err := node.Decode(&story); err != nil {
+			return nil, nil, yamlErrors(name, lineOffset, err)
+		}
+		stories := []StoryData{story}
+		shiftStoryLines(stories, lineOffset)
+		return stories, nil, nil
+	}
+	return nil, nil, ParseErrors{{File: name, Line: node.Line + lineOffset, Message: "expected a story, a list of stories or an act"}}
+}
+
+func hasKey(node *yaml.Node, key string) bool {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+var yamlLinePattern = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlErrors splits a yaml.v3 error into one ParseError per line it reports.
+func yamlErrors(name string, lineOffset int, err error) ParseErrors {
+	var msgs []string
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		msgs = typeErr.Errors
+	} else {
+		msgs = []string{err.Error()}
+	}
+
+	errs := make(ParseErrors, 0, len(msgs))
+	for _, msg := range msgs {
+		pe := ParseError{File: name, Message: strings.TrimPrefix(msg, "yaml: ")}
+		if m := yamlLinePattern.FindStringSubmatch(msg); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			pe.Line = line + lineOffset
+			pe.Message = m[2]
+		}
+		errs = append(errs, pe)
+	}
+	return errs
+}
+
+func (s *StoryData) UnmarshalYAML(node *yaml.Node) error {
+	type plain StoryData
+	if err := node.Decode((*plain)(s)); err != nil {
+		return err
+	}
+	s.src.line = node.Line
+	return nil
+}
+
+func (a *ActData) UnmarshalYAML(node *yaml.Node) error {
+	type plain ActData
+	if err := node.Decode((*plain)(a)); err != nil {
+		return err
+	}
+	a.src.line = node.Line
+	return nil
+}
+
+func (o *OptionData) UnmarshalYAML(node *yaml.Node) error {
+	type plain OptionData
+	if err := node.Decode((*plain)(o)); err != nil {
+		return err
+	}
+	o.src.line = node.Line
+	return nil
+}
+
+func shiftStoryLines(stories []StoryData, offset int) {
+	for i := range stories {
+		stories[i].src.line += offset
+		for j := range stories[i].Acts {
+			shiftActLines(&stories[i].Acts[j], offset)
+		}
+	}
+}
+
+func shiftActLines(act *ActData, offset int) {
+	act.src.line += offset
+	for i := range act.Options {
+		act.Options[i].src.line += offset
+	}
+}
+
+func setSource(stories []StoryData, name string) {
+	for i := range stories {
+		stories[i].src.file = name
+		for j := range stories[i].Acts {
+			setActSource(&stories[i].Acts[j], name)
+		}
+	}
+}
+
+func setActSource(act *ActData, name string) {
+	act.src.file = name
+	for i := range act.Options {
+		act.Options[i].src.file = name
+	}
+}
+
+// groupActs attaches act files to the single story found in the same
+// directory.
+func groupActs(parsed []parsedDocument) ([]StoryData, ParseErrors) {
+	var errs ParseErrors
+	var stories []StoryData
+	storyByDir := make(map[string]int)
+	ambiguousDirs := make(map[string]bool)
+
+	for _, p := range parsed {
+		dir := path.Dir(p.name)
+		for _, s := range p.stories {
+			if _, exists := storyByDir[dir]; exists || len(p.stories) > 1 {
+				ambiguousDirs[dir] = true
+			}
+			storyByDir[dir] = len(stories)
+			stories = append(stories, s)
+		}
+	}
+
+	var acts []parsedDocument
+	for _, p := range parsed {
+		if p.act != nil {
+			acts = append(acts, p)
+		}
+	}
+	sort.SliceStable(acts, func(i, j int) bool { return acts[i].name < acts[j].name })
+
+	for _, p := range acts {
+		dir := path.Dir(p.name)
+		idx, ok := storyByDir[dir]
+		switch {
+		case !ok:
+			errs = append(errs, ParseError{File: p.name, Line: p.act.src.line, Message: "act file has no story file in its directory"})
+		case ambiguousDirs[dir]:
+			errs = append(errs, ParseError{File: p.name, Line: p.act.src.line, Message: "act file's directory contains more than one story"})
+		default:
+			stories[idx].Acts = append(stories[idx].Acts, *p.act)
+		}
+	}
+
+	for i := range stories {
+		sort.SliceStable(stories[i].Acts, func(a, b int) bool {
+			return stories[i].Acts[a].Order < stories[i].Acts[b].Order
+		})
+	}
+	return stories, errs
+}
+
+func validateStories(stories []StoryData) ParseErrors {
+	var errs ParseErrors
+	holders := make(map[string]bool)
+
+	for _, s := range stories {
+		fail := func(src source, format string, args ...any) {
+			errs = append(errs, ParseError{File: src.file, Line: src.line, Message: fmt.Sprintf(format, args...)})
+		}
+
+		if s.HolderName == "" {
+			fail(s.src, "story is missing holderName")
+		} else if holders[s.HolderName] {
+			fail(s.src, "story %q is defined more than once", s.HolderName)
+		}
+		holders[s.HolderName] = true
+
+		if s.Title == "" {
+			fail(s.src, "story %q is missing a title", s.HolderName)
+		}
+		if len(s.Acts) == 0 {
+			fail(s.src, "story %q has no acts", s.HolderName)
+		}
+		if s.Visibility != "" && !Visibility(s.Visibility).IsValid() {
+			fail(s.src, "story %q has unknown visibility %q", s.HolderName, s.Visibility)
+		}
+
+		orders := make(map[int]bool)
+		for _, a := range s.Acts {
+			if orders[a.Order] {
+				fail(a.src, "act %d is defined more than once", a.Order)
+			}
+			orders[a.Order] = true
+			if strings.TrimSpace(a.Text) == "" {
+				fail(a.src, "act %d has no text", a.Order)
+			}
+		}
+
+		for _, a := range s.Acts {
+			texts := make(map[string]bool)
+			for _, o := range a.Options {
+				if o.Text == "" {
+					fail(o.src, "option in act %d has no text", a.Order)
+				} else if texts[o.Text] {
+					fail(o.src, "option %q appears twice in act %d", o.Text, a.Order)
+				}
+				texts[o.Text] = true
+
+				if o.NextActOrder != nil && !orders[*o.NextActOrder] {
+					fail(o.src, "option %q points to act %d, which does not exist", o.Text, *o.NextActOrder)
+				}
+				for _, c := range o.Consequences {
+					if !ConsequenceType(c.Type).IsValid() {
+						fail(o.src, "option %q has unknown consequence type %q", o.Text, c.Type)
+					} else if ConsequenceType(c.Type) == TypeItem && c.Item == "" {
+						fail(o.src, "option %q has an item consequence without an item name", o.Text)
+					}
+				}
+			}
+		}
+	}
+	return errs
+}
@@ -1,41 +1,619 @@
 package story
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/apierror"
+	"github.com/nicolas-camacho/thrg/internal/audit"
 )
 
+const maxUploadSize = 20 << 20
+
 type LoaderService struct {
-	repo *Repository
+	repo     *Repository
+	auditLog *audit.Log
 }
 
-func NewLoaderService(repo *Repository) *LoaderService {
+func NewLoaderService(repo *Repository, auditLog *audit.Log) *LoaderService {
 	return &LoaderService{
-		repo: repo,
+		repo:     repo,
+		auditLog: auditLog,
 	}
 }
 
+// LoadStoriesHandler accepts stories as JSON, YAML, Markdown with front
+// matter, a zip of those files, or a multipart upload of any of them. The
+// parser is chosen by Content-Type for raw bodies and by file extension for
+// uploaded files.
 func (s *LoaderService) LoadStoriesHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		apierror.Write(w, apierror.New(http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed"))
+		return
+	}
+
+	docs, err := readDocuments(w, r)
+	if err != nil {
+		writeParseError(w, err)
 		return
 	}
 
-	var storiesData []StoryData
-	if err := json.NewDecoder(r.Body).Decode(&storiesData); err != nil {
-		log.Printf("Error decoding request body: %v", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	storiesData, err := ParseDocuments(docs)
+	if err != nil {
+		writeParseError(w, err)
 		return
 	}
 
-	if err := s.repo.LoadStoriesFromData(r.Context(), storiesData); err != nil {
+	storyIDs, err := s.repo.LoadStoriesFromData(r.Context(), storiesData)
+	if errors.Is(err, ErrHolderNameTaken) {
+		apierror.Write(w, err)
+		return
+	}
+	if err != nil {
 		log.Printf("Error loading stories: %v", err)
-		http.Error(w, "Failed to load stories", http.StatusInternalServerError)
+		apierror.Write(w, apierror.ErrInternal)
 		return
 	}
+	s.recordImports(r, storiesData, storyIDs, "documents")
 
+	loaded := make([]map[string]any, len(storyIDs))
+	for i, storyID := range storyIDs {
+		loaded[i] = map[string]any{
+			"id":         storyID,
+			"holderName": storiesData[i].HolderName,
+			"acts":       len(storiesData[i].Acts),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, "Stories loaded successfully")
+	json.NewEncoder(w).Encode(map[string]any{
+		"message": "Stories loaded successfully",
+		"stories": loaded,
+	})
+}
+
+// ImportInkHandler imports a compiled ink story. The response lists every ink
+// feature that could not be represented so authors can adjust the source.
+func (s *LoaderService) ImportInkHandler(w http.ResponseWriter, r *http.Request) {
+	var req InkImportRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUploadSize)).Decode(&req); err != nil {
+		log.Printf("Error decoding ink import request: %v", err)
+		apierror.Write(w, apierror.BadRequest("Invalid request body"))
+		return
+	}
+
+	storyData, issues, err := ConvertInk(req)
+	if err != nil {
+		log.Printf("Error converting ink story: %v", err)
+		apierror.Write(w, apierror.New(http.StatusBadRequest, "invalid_ink", err.Error()))
+		return
+	}
+	if issues == nil {
+		issues = []InkIssue{}
+	}
+
+	if errs := validateStories([]StoryData{storyData}); len(errs) > 0 {
+		apierror.Write(w, errInvalidStories.WithDetail("errors", errs).WithDetail("unsupported", issues))
+		return
+	}
+
+	storyIDs, err := s.repo.LoadStoriesFromData(r.Context(), []StoryData{storyData})
+	if errors.Is(err, ErrHolderNameTaken) {
+		apierror.Write(w, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading ink story: %v", err)
+		apierror.Write(w, apierror.ErrInternal)
+		return
+	}
+	s.recordImports(r, []StoryData{storyData}, storyIDs, "ink")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"message":     "Story imported successfully",
+		"holderName":  storyData.HolderName,
+		"acts":        len(storyData.Acts),
+		"unsupported": issues,
+	})
+}
+
+// recordImports adds one audit event per imported story.
+func (s *LoaderService) recordImports(r *http.Request, storiesData []StoryData, storyIDs []uuid.UUID, format string) {
+	for i, storyID := range storyIDs {
+		s.auditLog.Record(r, audit.ActionStoryImport, audit.Target{Type: audit.TargetStory, ID: storyID.String()}, audit.Metadata{
+			"format":     format,
+			"holderName": storiesData[i].HolderName,
+			"title":      storiesData[i].Title,
+			"acts":       len(storiesData[i].Acts),
+		})
+	}
+}
+
+var errInvalidStories = apierror.New(http.StatusBadRequest, "invalid_stories", "Invalid story documents")
+
+func init() {
+	apierror.Register(ErrHolderNameTaken, apierror.New(http.StatusConflict, "holder_name_taken", "A story with this holderName already exists"))
+}
+
+func writeParseError(w http.ResponseWriter, err error) {
+	var parseErrs ParseErrors
+	if !errors.As(err, &parseErrs) {
+		log.Printf("Error reading stories: %v", err)
+		apierror.Write(w, apierror.BadRequest("Invalid request body"))
+		return
+	}
+
+	apierror.Write(w, errInvalidStories.WithDetail("errors", parseErrs))
+}
+
+func readDocuments(w http.ResponseWriter, r *http.Request) ([]Document, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		return readMultipartDocuments(r)
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Anything that is not a recognised story format is treated as JSON,
+	// which is what this endpoint has always accepted.
+	format, ok := FormatFromContentType(r.Header.Get("Content-Type"))
+	if !ok {
+		format = FormatJSON
+	}
+	return []Document{{Name: "request body", Format: format, Data: data}}, nil
+}
+
+func readMultipartDocuments(r *http.Request) ([]Document, error) {
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		return nil, err
+	}
+
+	var docs []Document
+	for _, files := range r.MultipartForm.File {
+		for _, fh := range files {
+			format, ok := FormatFromFilename(fh.Filename)
+			if !ok {
+				format, ok = FormatFromContentType(fh.Header.Get("Content-Type"))
+			}
+			if !ok {
+				return nil, ParseErrors{{File: fh.Filename, Message: "unsupported file type"}}
+			}
+
+			f, err := fh.Open()
+			if err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, Document{Name: strings.TrimPrefix(fh.Filename, "/"), Format: format, Data: data})
+		}
+	}
+
+	if len(docs) == 0 {
+		return nil, errors.New("no files in multipart upload")
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Name < docs[j].Name })
+	return docs, nil
+}
+
+type CharacterCounter interface {
+	CountCharactersByStory(ctx context.Context) (map[uuid.UUID]int64, error)
+}
+
+type StorySummaryDTO struct {
+	ID          uuid.UUID  `json:"ID"`
+	HolderName  string     `json:"HolderName"`
+	Title       string     `json:"Title"`
+	Description string     `json:"Description"`
+	Visibility  Visibility `json:"Visibility"`
+	ActCount    int64      `json:"ActCount"`
+	PlayerCount int64      `json:"PlayerCount"`
+	CreatedAt   time.Time  `json:"CreatedAt"`
+}
+
+// PlayerStoryDTO is what players see of a story in their library.
+type PlayerStoryDTO struct {
+	ID          uuid.UUID `json:"ID"`
+	Title       string    `json:"Title"`
+	Description string    `json:"Description"`
+	ActCount    int64     `json:"ActCount"`
+}
+
+type StoryDetailDTO struct {
+	ID                  uuid.UUID  `json:"ID"`
+	HolderName          string     `json:"HolderName"`
+	Title               string     `json:"Title"`
+	Description         string     `json:"Description"`
+	MisfortuneThreshold float64    `json:"MisfortuneThreshold"`
+	Visibility          Visibility `json:"Visibility"`
+	Acts                []ActDTO   `json:"Acts"`
+}
+
+type ActDTO struct {
+	ID      uuid.UUID   `json:"ID"`
+	Order   int         `json:"Order"`
+	Text    string      `json:"Text"`
+	Options []OptionDTO `json:"Options"`
+}
+
+type OptionDTO struct {
+	ID           uuid.UUID        `json:"ID"`
+	Text         string           `json:"Text"`
+	NextActID    *uuid.UUID       `json:"NextActID"`
+	NextActOrder *int             `json:"NextActOrder"`
+	Consequences []ConsequenceDTO `json:"Consequences"`
+}
+
+type ConsequenceDTO struct {
+	Type  ConsequenceType `json:"Type"`
+	Item  string          `json:"Item,omitempty"`
+	Value float64         `json:"Value"`
+}
+
+func newOptionDTO(o Option, orderByAct map[uuid.UUID]int) OptionDTO {
+	dto := OptionDTO{
+		ID:           o.ID,
+		Text:         o.Text,
+		NextActID:    o.NextAct,
+		Consequences: make([]ConsequenceDTO, len(o.Consequences)),
+	}
+	if o.NextAct != nil {
+		if order, ok := orderByAct[*o.NextAct]; ok {
+			dto.NextActOrder = &order
+		}
+	}
+	for i, c := range o.Consequences {
+		dto.Consequences[i] = ConsequenceDTO{Type: c.Type, Item: c.Item, Value: c.Value}
+	}
+	return dto
+}
+
+func newStoryDetailDTO(s *Story) StoryDetailDTO {
+	orderByAct := make(map[uuid.UUID]int, len(s.Acts))
+	for _, a := range s.Acts {
+		orderByAct[a.ID] = a.Order
+	}
+
+	dto := StoryDetailDTO{
+		ID:                  s.ID,
+		HolderName:          s.HolderName,
+		Title:               s.Title,
+		Description:         s.Description,
+		MisfortuneThreshold: s.MisfortuneThreshold,
+		Visibility:          s.Visibility,
+		Acts:                make([]ActDTO, len(s.Acts)),
+	}
+	for i, a := range s.Acts {
+		act := ActDTO{ID: a.ID, Order: a.Order, Text: a.Text, Options: make([]OptionDTO, len(a.Options))}
+		for j, o := range a.Options {
+			act.Options[j] = newOptionDTO(o, orderByAct)
+		}
+		dto.Acts[i] = act
+	}
+	return dto
+}
+
+func storyIDParam(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	storyID, err := uuid.Parse(chi.URLParam(r, "storyID"))
+	if err != nil {
+		apierror.Write(w, apierror.BadRequest("Invalid story ID"))
+		return uuid.Nil, false
+	}
+	return storyID, true
+}
+
+func ListStoriesHandler(repo *Repository, counter CharacterCounter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		summaries, err := repo.GetStorySummaries(r.Context())
+		if err != nil {
+			log.Printf("Error retrieving stories: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		counts, err := counter.CountCharactersByStory(r.Context())
+		if err != nil {
+			log.Printf("Error counting players per story: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		dtos := make([]StorySummaryDTO, len(summaries))
+		for i, s := range summaries {
+			dtos[i] = StorySummaryDTO{
+				ID:          s.ID,
+				HolderName:  s.HolderName,
+				Title:       s.Title,
+				Description: s.Description,
+				Visibility:  s.Visibility,
+				ActCount:    s.ActCount,
+				PlayerCount: counts[s.ID],
+				CreatedAt:   s.CreatedAt,
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(dtos); err != nil {
+			log.Printf("Error encoding stories to JSON: %v", err)
+		}
+	}
+}
+
+func GetStoryHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		storyID, ok := storyIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		story, err := repo.GetStoryByID(r.Context(), storyID)
+		if err != nil {
+			log.Printf("Error retrieving story %s: %v", storyID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+		if story == nil {
+			apierror.Write(w, apierror.NotFound("Story not found"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(newStoryDetailDTO(story)); err != nil {
+			log.Printf("Error encoding story to JSON: %v", err)
+		}
+	}
+}
+
+type updateStoryRequest struct {
+	Visibility Visibility `json:"visibility"`
+}
+
+func UpdateStoryHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		storyID, ok := storyIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		var req updateStoryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
+			return
+		}
+		if !req.Visibility.IsValid() {
+			apierror.Write(w, apierror.BadRequest("Visibility must be hidden, assigned or open"))
+			return
+		}
+
+		found, err := repo.UpdateVisibility(r.Context(), storyID, req.Visibility)
+		if err != nil {
+			log.Printf("Error updating story %s: %v", storyID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+		if !found {
+			apierror.Write(w, apierror.NotFound("Story not found"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message":    "Story updated successfully",
+			"visibility": string(req.Visibility),
+		})
+	}
+}
+
+// ListOpenStoriesHandler is the player library: every story an admin has
+// marked as open.
+func ListOpenStoriesHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		summaries, err := repo.GetOpenStorySummaries(r.Context())
+		if err != nil {
+			log.Printf("Error retrieving open stories: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		dtos := make([]PlayerStoryDTO, len(summaries))
+		for i, s := range summaries {
+			dtos[i] = PlayerStoryDTO{
+				ID:          s.ID,
+				Title:       s.Title,
+				Description: s.Description,
+				ActCount:    s.ActCount,
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(dtos); err != nil {
+			log.Printf("Error encoding open stories to JSON: %v", err)
+		}
+	}
+}
+
+type updateActRequest struct {
+	Text string `json:"text"`
+}
+
+func UpdateActHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		storyID, ok := storyIDParam(w, r)
+		if !ok {
+			return
+		}
+		actID, err := uuid.Parse(chi.URLParam(r, "actID"))
+		if err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid act ID"))
+			return
+		}
+
+		var req updateActRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
+			return
+		}
+		if strings.TrimSpace(req.Text) == "" {
+			apierror.Write(w, apierror.BadRequest("Act text is required"))
+			return
+		}
+
+		act, err := repo.UpdateActText(r.Context(), storyID, actID, req.Text)
+		if err != nil {
+			log.Printf("Error updating act %s: %v", actID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+		if act == nil {
+			apierror.Write(w, apierror.NotFound("Act not found"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ActDTO{ID: act.ID, Order: act.Order, Text: act.Text, Options: []OptionDTO{}})
+	}
+}
+
+// updateOptionRequest leaves fields that are absent untouched. NextActID is
+// raw so that an explicit null can clear the link.
+type updateOptionRequest struct {
+	Text         *string            `json:"text"`
+	NextActID    json.RawMessage    `json:"nextActId"`
+	Consequences *[]ConsequenceData `json:"consequences"`
+}
+
+func UpdateOptionHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		storyID, ok := storyIDParam(w, r)
+		if !ok {
+			return
+		}
+		optionID, err := uuid.Parse(chi.URLParam(r, "optionID"))
+		if err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid option ID"))
+			return
+		}
+
+		var req updateOptionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
+			return
+		}
+
+		update := OptionUpdate{Text: req.Text, Consequences: req.Consequences}
+		if req.Text != nil && strings.TrimSpace(*req.Text) == "" {
+			apierror.Write(w, apierror.BadRequest("Option text cannot be empty"))
+			return
+		}
+		if len(req.NextActID) > 0 {
+			if string(req.NextActID) == "null" {
+				update.ClearNextAct = true
+			} else {
+				var nextActID uuid.UUID
+				if err := json.Unmarshal(req.NextActID, &nextActID); err != nil {
+					apierror.Write(w, apierror.BadRequest("Invalid next act ID"))
+					return
+				}
+				update.NextActID = &nextActID
+			}
+		}
+		if req.Consequences != nil {
+			for _, c := range *req.Consequences {
+				if !ConsequenceType(c.Type).IsValid() {
+					apierror.Write(w, apierror.BadRequest(fmt.Sprintf("Unknown consequence type %q", c.Type)))
+					return
+				}
+				if ConsequenceType(c.Type) == TypeItem && c.Item == "" {
+					apierror.Write(w, apierror.BadRequest("Item consequences need an item name"))
+					return
+				}
+			}
+		}
+
+		option, err := repo.UpdateOption(r.Context(), storyID, optionID, update)
+		if errors.Is(err, ErrNextActNotInStory) {
+			apierror.Write(w, apierror.BadRequest("Next act does not belong to this story"))
+			return
+		}
+		if err != nil {
+			log.Printf("Error updating option %s: %v", optionID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+		if option == nil {
+			apierror.Write(w, apierror.NotFound("Option not found"))
+			return
+		}
+
+		orderByAct, err := repo.ActOrders(r.Context(), storyID)
+		if err != nil {
+			log.Printf("Error retrieving act orders of story %s: %v", storyID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(newOptionDTO(*option, orderByAct))
+	}
+}
+
+func DeleteStoryHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		storyID, ok := storyIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		story, err := repo.GetStoryByID(r.Context(), storyID)
+		if err != nil {
+			log.Printf("Error retrieving story %s: %v", storyID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+		if story == nil {
+			apierror.Write(w, apierror.NotFound("Story not found"))
+			return
+		}
+
+		if err := repo.DeleteStory(r.Context(), storyID); err != nil {
+			var inUse *StoryInUseError
+			if errors.As(err, &inUse) {
+				apierror.Write(w, apierror.New(http.StatusConflict, "story_in_use", "Story still has characters in it").
+					WithDetail("playerCount", inUse.Players))
+				return
+			}
+			log.Printf("Error deleting story %s: %v", storyID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
 }
@@ -0,0 +1,130 @@
+package story
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nicolas-camacho/thrg/internal/audit"
+	"github.com/nicolas-camacho/thrg/internal/database"
+	"github.com/nicolas-camacho/thrg/internal/migrate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := database.Open(database.Config{
+		Driver: database.SQLite,
+		DSN:    filepath.Join(t.TempDir(), "thrg.db"),
+	})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	db.Logger = logger.Discard
+
+	migrator, err := migrate.New(db, database.SQLite)
+	if err != nil {
+		t.Fatalf("load migrations: %v", err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+const casaMarkdown = `---
+holderName: la-casa
+title: La casa
+misfortuneThreshold: 10
+---
+# Acto 1
+Entras en la casa.
+
+- [Subir las escaleras](#2) {locura: 1}
+
+# Acto 2
+Arriba está oscuro.
+
+- [Bajar](#1)
+`
+
+func TestLoadStoriesAnswersJSON(t *testing.T) {
+	db := newTestDB(t)
+	loader := NewLoaderService(NewRepository(db), audit.NewLog(db))
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/api/stories/load", strings.NewReader(casaMarkdown))
+	req.Header.Set("Content-Type", "text/markdown")
+	rec := httptest.NewRecorder()
+	loader.LoadStoriesHandler(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("load answered %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type is %q, want application/json", got)
+	}
+	var body struct {
+		Message string `json:"message"`
+		Stories []struct {
+			ID         string `json:"id"`
+			HolderName string `json:"holderName"`
+			Acts       int    `json:"acts"`
+		} `json:"stories"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(body.Stories) != 1 || body.Stories[0].HolderName != "la-casa" || body.Stories[0].Acts != 2 || body.Stories[0].ID == "" {
+		t.Errorf("response lists %+v, want la-casa with 2 acts", body.Stories)
+	}
+}
+
+func TestUpdateOptionReturnsNextActOrder(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewRepository(db)
+	docs := []Document{{Name: "la-casa.md", Format: FormatMarkdown, Data: []byte(casaMarkdown)}}
+	storiesData, err := ParseDocuments(docs)
+	if err != nil {
+		t.Fatalf("parse story: %v", err)
+	}
+	storyIDs, err := repo.LoadStoriesFromData(context.Background(), storiesData)
+	if err != nil {
+		t.Fatalf("load story: %v", err)
+	}
+	story, err := repo.GetStoryByID(context.Background(), storyIDs[0])
+	if err != nil {
+		t.Fatalf("get story: %v", err)
+	}
+	option := story.Acts[0].Options[0]
+
+	router := chi.NewRouter()
+	router.Patch("/admin/api/stories/{storyID}/options/{optionID}", UpdateOptionHandler(repo))
+	req := httptest.NewRequest(http.MethodPatch, "/admin/api/stories/"+story.ID.String()+"/options/"+option.ID.String(),
+		strings.NewReader(`{"text": "Subir despacio"}`))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update answered %d: %s", rec.Code, rec.Body)
+	}
+	var dto OptionDTO
+	if err := json.NewDecoder(rec.Body).Decode(&dto); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if dto.Text != "Subir despacio" {
+		t.Errorf("text is %q, want the new one", dto.Text)
+	}
+	if dto.NextActOrder == nil || *dto.NextActOrder != 2 {
+		t.Errorf("NextActOrder is %v, want 2", dto.NextActOrder)
+	}
+	if len(dto.Consequences) != 1 || dto.Consequences[0].Type != "locura" || dto.Consequences[0].Value != 1 {
+		t.Errorf("consequences are %+v, want the untouched locura 1", dto.Consequences)
+	}
+}
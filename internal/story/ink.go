@@ -0,0 +1,560 @@
+package story
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Ink import converts a compiled ink story (the JSON produced by inklecate
+// or Inky) into StoryData. Only a subset of ink maps onto our model:
+//
+//   - knots, stitches and gathers that are diverted to become acts, numbered
+//     in the order they are first reached from the start of the story;
+//   - plain text becomes the act text;
+//   - choices become options, and the divert at the end of a choice becomes
+//     the option's next act. If the choice prints text of its own, that text
+//     becomes an intermediate act;
+//   - a divert with no choices becomes a single "Continuar" option;
+//   - "~ stat += n" and "~ stat -= n" inside a choice become consequences,
+//     for variables whose name is a consequence type or that are mapped to
+//     one in InkImportRequest.Variables.
+//
+// Everything else (conditions, sequences, tunnels, functions, tags, absolute
+// assignments, unreachable knots...) is reported as an InkIssue rather than
+// silently dropped.
+
+const inkContinueText = "Continuar"
+
+type InkImportRequest struct {
+	HolderName          string            `json:"holderName"`
+	Title               string            `json:"title"`
+	Description         string            `json:"description"`
+	MisfortuneThreshold float64           `json:"misfortuneThreshold"`
+	Visibility          string            `json:"visibility"`
+	Variables           map[string]string `json:"variables"`
+	Ink                 json.RawMessage   `json:"ink"`
+}
+
+// InkIssue describes a piece of the ink story that could not be represented
+// exactly. Path is the ink container path where it was found.
+type InkIssue struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+type inkContainer struct {
+	name    string
+	parent  *inkContainer
+	content []any
+	named   map[string]*inkContainer
+}
+
+func (c *inkContainer) path() string {
+	if c.parent == nil {
+		return ""
+	}
+	parent := c.parent.path()
+	if parent == "" {
+		return c.name
+	}
+	return parent + "." + c.name
+}
+
+func (c *inkContainer) child(name string) *inkContainer {
+	if sub, ok := c.named[name]; ok {
+		return sub
+	}
+	if idx, err := strconv.Atoi(name); err == nil && idx >= 0 && idx < len(c.content) {
+		if sub, ok := c.content[idx].(*inkContainer); ok {
+			return sub
+		}
+	}
+	return nil
+}
+
+func parseInkContainer(raw any, name string, parent *inkContainer) (*inkContainer, error) {
+	items, ok := raw.([]any)
+	if !ok {
+		return nil, fmt.Errorf("container %q is not an array", name)
+	}
+
+	c := &inkContainer{name: name, parent: parent, named: make(map[string]*inkContainer)}
+	if len(items) == 0 {
+		return c, nil
+	}
+
+	if meta, ok := items[len(items)-1].(map[string]any); ok {
+		for key, value := range meta {
+			if strings.HasPrefix(key, "#") {
+				continue
+			}
+			sub, err := parseInkContainer(value, key, c)
+			if err != nil {
+				return nil, err
+			}
+			c.named[key] = sub
+		}
+	}
+
+	for i, item := range items[:len(items)-1] {
+		if sub, ok := item.([]any); ok {
+			container, err := parseInkContainer(sub, strconv.Itoa(i), c)
+			if err != nil {
+				return nil, err
+			}
+			c.content = append(c.content, container)
+			continue
+		}
+		c.content = append(c.content, item)
+	}
+	return c, nil
+}
+
+// resolve follows an ink path from the container holding the divert.
+// Relative paths start with "." and use "^" to step out to the parent.
+func (c *inkContainer) resolve(target string) *inkContainer {
+	cur := c
+	var parts []string
+
+	if strings.HasPrefix(target, ".") {
+		parts = strings.Split(target[1:], ".")
+		// The first "^" steps from the divert to the container holding it,
+		// every following one to that container's parent.
+		for i := 0; len(parts) > 0 && parts[0] == "^"; i++ {
+			if i > 0 {
+				if cur = cur.parent; cur == nil {
+					return nil
+				}
+			}
+			parts = parts[1:]
+		}
+	} else {
+		parts = strings.Split(target, ".")
+		for cur.parent != nil {
+			cur = cur.parent
+		}
+	}
+
+	for _, part := range parts {
+		if cur = cur.child(part); cur == nil {
+			return nil
+		}
+	}
+	return cur
+}
+
+type inkChoice struct {
+	text      string
+	target    *inkContainer
+	condition bool
+}
+
+type inkAssignment struct {
+	variable string
+	delta    float64
+}
+
+type inkFlow struct {
+	text        strings.Builder
+	choices     []inkChoice
+	assignments []inkAssignment
+	divert      *inkContainer
+	ended       bool
+}
+
+type inkConverter struct {
+	root      *inkContainer
+	variables map[string]ConsequenceType
+	issues    []InkIssue
+
+	acts         map[*inkContainer]int
+	choiceBodies map[*inkContainer]bool
+	queue        []*inkContainer
+	storyActs    []ActData
+}
+
+func (cv *inkConverter) issue(c *inkContainer, format string, args ...any) {
+	path := c.path()
+	if path == "" {
+		path = "root"
+	}
+	issue := InkIssue{Path: path, Message: fmt.Sprintf(format, args...)}
+	// Choice bodies are walked once for the option and again for their act.
+	for _, existing := range cv.issues {
+		if existing == issue {
+			return
+		}
+	}
+	cv.issues = append(cv.issues, issue)
+}
+
+// walk reads a container's content in order, stepping into anonymous nested
+// containers, until the flow diverts or ends.
+func (cv *inkConverter) walk(c *inkContainer, flow *inkFlow) bool {
+	var evalMode, strMode bool
+	var evalTokens []any
+	var choiceText strings.Builder
+
+	for _, item := range c.content {
+		switch v := item.(type) {
+		case *inkContainer:
+			if cv.walk(v, flow) {
+				return true
+			}
+		case string:
+			switch {
+			case strings.HasPrefix(v, "^"):
+				if strMode {
+					choiceText.WriteString(v[1:])
+				} else {
+					flow.text.WriteString(v[1:])
+				}
+			case v == "\n":
+				if !strMode {
+					flow.text.WriteString("\n")
+				}
+			case v == "ev":
+				evalMode, evalTokens = true, nil
+			case v == "/ev":
+				evalMode, evalTokens = false, nil
+			case v == "str":
+				strMode = true
+			case v == "/str":
+				strMode = false
+			case v == "end", v == "done":
+				flow.ended = true
+				return true
+			case v == "<>", v == "nop", v == "out", v == "pop", v == "du":
+			case v == "->->", v == "~ret":
+				cv.issue(c, "tunnels and functions are not supported")
+				flow.ended = true
+				return true
+			case evalMode:
+				evalTokens = append(evalTokens, v)
+			default:
+				cv.issue(c, "unsupported ink command %q", v)
+			}
+		case float64, bool:
+			if evalMode {
+				evalTokens = append(evalTokens, v)
+			}
+		case map[string]any:
+			if done := cv.walkObject(c, v, flow, evalMode, strMode, &evalTokens, &choiceText); done {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (cv *inkConverter) walkObject(c *inkContainer, obj map[string]any, flow *inkFlow, evalMode, strMode bool, evalTokens *[]any, choiceText *strings.Builder) bool {
+	switch {
+	case obj["->"] != nil:
+		target, _ := obj["->"].(string)
+		if obj["var"] == true {
+			// "$r" is the return address ink uses around choice content.
+			if !strings.HasPrefix(target, "$") {
+				cv.issue(c, "variable divert %q is not supported", target)
+			}
+			return false
+		}
+		dest := c.resolve(target)
+		if dest == nil {
+			cv.issue(c, "divert target %q not found", target)
+			return false
+		}
+		if dest.name == "s" {
+			// Choice start content ("* Hello [world]") lives in a sibling
+			// "s" container that is shown both in the choice and after it.
+			var sub inkFlow
+			cv.walk(dest, &sub)
+			if strMode {
+				choiceText.WriteString(sub.text.String())
+			} else {
+				flow.text.WriteString(sub.text.String())
+			}
+			return false
+		}
+		if obj["c"] == true {
+			cv.issue(c, "conditional divert to %q was ignored", target)
+			return false
+		}
+		flow.divert = dest
+		return true
+	case obj["*"] != nil:
+		target, _ := obj["*"].(string)
+		flags, _ := obj["flg"].(float64)
+		text := strings.TrimSpace(choiceText.String())
+		choiceText.Reset()
+
+		if int(flags)&0x8 != 0 {
+			cv.issue(c, "fallback choice was ignored")
+			return false
+		}
+		dest := c.resolve(target)
+		if dest == nil {
+			cv.issue(c, "choice target %q not found", target)
+			return false
+		}
+		flow.choices = append(flow.choices, inkChoice{
+			text:      text,
+			target:    dest,
+			condition: int(flags)&0x1 != 0,
+		})
+	case obj["VAR="] != nil:
+		name, _ := obj["VAR="].(string)
+		cv.assignment(c, name, obj["re"] == true, *evalTokens, flow)
+		*evalTokens = nil
+	case obj["temp="] != nil:
+		if name, _ := obj["temp="].(string); !strings.HasPrefix(name, "$") {
+			cv.issue(c, "temporary variable %q is not supported", name)
+		}
+		*evalTokens = nil
+	case obj["VAR?"] != nil, obj["CNT?"] != nil:
+		if evalMode {
+			*evalTokens = append(*evalTokens, obj)
+		}
+	case obj["^->"] != nil, obj["->$"] != nil:
+		// Return-address bookkeeping emitted around choice content.
+	case obj["#"] != nil:
+		cv.issue(c, "tag %q was ignored", obj["#"])
+	case obj["f()"] != nil, obj["->t->"] != nil, obj["x()"] != nil:
+		cv.issue(c, "tunnels and functions are not supported")
+	default:
+		cv.issue(c, "unsupported ink object %v", obj)
+	}
+	return false
+}
+
+// assignment recognises "~ x = x + n" and "~ x = x - n", which is what ink
+// compiles "+=" and "-=" to.
+func (cv *inkConverter) assignment(c *inkContainer, name string, reassign bool, tokens []any, flow *inkFlow) {
+	if !reassign {
+		return
+	}
+	if len(tokens) == 3 {
+		ref, _ := tokens[0].(map[string]any)
+		value, isNumber := tokens[1].(float64)
+		op, _ := tokens[2].(string)
+		if ref != nil && ref["VAR?"] == name && isNumber && (op == "+" || op == "-") {
+			if op == "-" {
+				value = -value
+			}
+			flow.assignments = append(flow.assignments, inkAssignment{variable: name, delta: value})
+			return
+		}
+	}
+	cv.issue(c, "assignment to %q is not a simple increment or decrement and was ignored", name)
+}
+
+func (cv *inkConverter) consequences(c *inkContainer, assignments []inkAssignment) []ConsequenceData {
+	var out []ConsequenceData
+	for _, a := range assignments {
+		t, ok := cv.variables[a.variable]
+		if !ok {
+			cv.issue(c, "variable %q does not map to a stat and was ignored", a.variable)
+			continue
+		}
+		out = append(out, ConsequenceData{Type: string(t), Value: a.delta})
+	}
+	return out
+}
+
+// actFor returns the order of the act built from c, queueing it if needed.
+func (cv *inkConverter) actFor(c *inkContainer) int {
+	if order, ok := cv.acts[c]; ok {
+		return order
+	}
+	order := len(cv.acts) + 1
+	cv.acts[c] = order
+	cv.queue = append(cv.queue, c)
+	return order
+}
+
+func (cv *inkConverter) buildAct(c *inkContainer) ActData {
+	var flow inkFlow
+	cv.walk(c, &flow)
+	if cv.choiceBodies[c] {
+		// Already turned into consequences on the option leading here.
+		flow.assignments = nil
+	}
+	return cv.actFromFlow(c, &flow)
+}
+
+func (cv *inkConverter) actFromFlow(c *inkContainer, flow *inkFlow) ActData {
+	act := ActData{Order: cv.acts[c], Text: strings.TrimSpace(flow.text.String())}
+
+	if len(flow.assignments) > 0 {
+		cv.issue(c, "assignments outside of a choice were ignored")
+	}
+	if act.Text == "" {
+		cv.issue(c, "act has no text of its own")
+		act.Text = "..."
+	}
+
+	for _, choice := range flow.choices {
+		act.Options = append(act.Options, cv.buildOption(choice))
+	}
+	if len(flow.choices) == 0 && flow.divert != nil {
+		next := cv.actFor(flow.divert)
+		act.Options = append(act.Options, OptionData{Text: inkContinueText, NextActOrder: &next})
+	}
+	return act
+}
+
+func (cv *inkConverter) buildOption(choice inkChoice) OptionData {
+	option := OptionData{Text: choice.text}
+	if choice.condition {
+		cv.issue(choice.target, "condition on choice %q was ignored", choice.text)
+	}
+
+	var body inkFlow
+	cv.walk(choice.target, &body)
+	option.Consequences = cv.consequences(choice.target, body.assignments)
+
+	// A choice that prints text or offers nested choices needs an act of its
+	// own to hold them.
+	if strings.TrimSpace(body.text.String()) != "" || len(body.choices) > 0 {
+		cv.choiceBodies[choice.target] = true
+		next := cv.actFor(choice.target)
+		option.NextActOrder = &next
+		return option
+	}
+
+	if body.divert != nil {
+		next := cv.actFor(body.divert)
+		option.NextActOrder = &next
+	}
+	return option
+}
+
+// ConvertInk turns a compiled ink story into StoryData, returning the list
+// of ink features that had to be dropped or approximated.
+func ConvertInk(req InkImportRequest) (StoryData, []InkIssue, error) {
+	story := StoryData{
+		HolderName:          req.HolderName,
+		Title:               req.Title,
+		Description:         req.Description,
+		MisfortuneThreshold: req.MisfortuneThreshold,
+		Visibility:          req.Visibility,
+		src:                 source{file: "ink"},
+	}
+
+	var doc struct {
+		InkVersion int `json:"inkVersion"`
+		Root       any `json:"root"`
+	}
+	if err := json.Unmarshal(req.Ink, &doc); err != nil {
+		return story, nil, fmt.Errorf("invalid ink JSON: %w", err)
+	}
+	if doc.InkVersion == 0 || doc.Root == nil {
+		return story, nil, fmt.Errorf("invalid ink JSON: missing inkVersion or root")
+	}
+
+	root, err := parseInkContainer(doc.Root, "", nil)
+	if err != nil {
+		return story, nil, fmt.Errorf("invalid ink JSON: %w", err)
+	}
+
+	cv := &inkConverter{
+		root:         root,
+		variables:    make(map[string]ConsequenceType),
+		acts:         make(map[*inkContainer]int),
+		choiceBodies: make(map[*inkContainer]bool),
+	}
+	for _, t := range []ConsequenceType{TypeLocura, TypePanico, TypeAnsiedad, TypeBrillantes, TypeMisfortune} {
+		cv.variables[string(t)] = t
+	}
+	for name, t := range req.Variables {
+		if !ConsequenceType(t).IsValid() || ConsequenceType(t) == TypeItem {
+			return story, nil, fmt.Errorf("variable %q maps to unknown stat %q", name, t)
+		}
+		cv.variables[name] = ConsequenceType(t)
+	}
+
+	cv.checkGlobals()
+
+	// The top-level flow is an act only if it says or offers something;
+	// usually it just diverts to the first knot.
+	var start inkFlow
+	cv.walk(root, &start)
+	switch {
+	case strings.TrimSpace(start.text.String()) != "" || len(start.choices) > 0:
+		cv.actFor(root)
+	case start.divert != nil:
+		cv.actFor(start.divert)
+	default:
+		return story, cv.issues, fmt.Errorf("ink story has no content")
+	}
+
+	for len(cv.queue) > 0 {
+		c := cv.queue[0]
+		cv.queue = cv.queue[1:]
+		cv.storyActs = append(cv.storyActs, cv.buildAct(c))
+	}
+
+	cv.reportUnreachable()
+
+	sort.SliceStable(cv.storyActs, func(i, j int) bool { return cv.storyActs[i].Order < cv.storyActs[j].Order })
+	story.Acts = cv.storyActs
+	setSource([]StoryData{story}, "ink")
+	return story, cv.issues, nil
+}
+
+// checkGlobals reports stats that ink starts at a non-zero value, since
+// characters always start at zero here.
+func (cv *inkConverter) checkGlobals() {
+	decl := cv.root.named["global decl"]
+	if decl == nil {
+		return
+	}
+	var last any
+	for _, item := range decl.content {
+		obj, ok := item.(map[string]any)
+		if !ok {
+			last = item
+			continue
+		}
+		name, _ := obj["VAR="].(string)
+		if name == "" {
+			continue
+		}
+		if _, mapped := cv.variables[name]; !mapped {
+			cv.issue(decl, "variable %q does not map to a stat", name)
+		} else if value, ok := last.(float64); !ok || value != 0 {
+			cv.issue(decl, "initial value of %q was ignored; stats always start at 0", name)
+		}
+	}
+}
+
+func (cv *inkConverter) reportUnreachable() {
+	var names []string
+	for name := range cv.root.named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		knot := cv.root.named[name]
+		if name == "global decl" {
+			continue
+		}
+		if _, ok := cv.acts[knot]; ok {
+			continue
+		}
+		reached := false
+		for c := range cv.acts {
+			for p := c; p != nil; p = p.parent {
+				if p == knot {
+					reached = true
+				}
+			}
+		}
+		if !reached {
+			cv.issue(knot, "knot is never reached and was not imported")
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package story
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// describeActs writes acts as one line per option, to compare them without
+// the source positions kept for error messages.
+func describeActs(acts []ActData) []string {
+	var lines []string
+	for _, act := range acts {
+		lines = append(lines, fmt.Sprintf("%d: %s", act.Order, act.Text))
+		for _, o := range act.Options {
+			next := "end"
+			if o.NextActOrder != nil {
+				next = fmt.Sprint(*o.NextActOrder)
+			}
+			var consequences []string
+			for _, c := range o.Consequences {
+				consequences = append(consequences, fmt.Sprintf("%s %g", c.Type, c.Value))
+			}
+			lines = append(lines, fmt.Sprintf("  %s -> %s [%s]", o.Text, next, strings.Join(consequences, ", ")))
+		}
+	}
+	return lines
+}
+
+func TestConvertInk(t *testing.T) {
+	compiled, err := os.ReadFile("testdata/despertar.ink.json")
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+
+	story, issues, err := ConvertInk(InkImportRequest{
+		HolderName:          "despertar",
+		Title:               "Despertar",
+		MisfortuneThreshold: 5,
+		Variables:           map[string]string{"miedo": "panico"},
+		Ink:                 compiled,
+	})
+	if err != nil {
+		t.Fatalf("ConvertInk: %v", err)
+	}
+	if story.HolderName != "despertar" || story.Title != "Despertar" || story.MisfortuneThreshold != 5 {
+		t.Errorf("story is %s %q with threshold %g", story.HolderName, story.Title, story.MisfortuneThreshold)
+	}
+
+	want := []string{
+		"1: Despiertas en una habitación oscura.",
+		"  Encender la luz -> 2 [locura 1]",
+		"  Gritar -> 3 [panico -2]",
+		"2: Un pasillo largo.",
+		"  Continuar -> 1 []",
+		"3: Gritar con fuerza.",
+	}
+	if got := describeActs(story.Acts); !slices.Equal(got, want) {
+		t.Errorf("acts are\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	wantIssues := []InkIssue{
+		{Path: "global decl", Message: `initial value of "miedo" was ignored; stats always start at 0`},
+		{Path: "pasillo", Message: `tag "musica: lluvia" was ignored`},
+		{Path: "sotano", Message: "knot is never reached and was not imported"},
+	}
+	slices.SortFunc(issues, func(a, b InkIssue) int { return strings.Compare(a.Path, b.Path) })
+	if !slices.Equal(issues, wantIssues) {
+		t.Errorf("issues are %+v, want %+v", issues, wantIssues)
+	}
+
+	if errs := validateStories([]StoryData{story}); len(errs) > 0 {
+		t.Errorf("converted story does not validate: %+v", errs)
+	}
+}
+
+func TestConvertInkRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		ink       string
+		variables map[string]string
+	}{
+		{"not JSON", `{"inkVersion":`, nil},
+		{"no version", `{"root":[["done",null]]}`, nil},
+		{"no root", `{"inkVersion":21}`, nil},
+		{"root is not a container", `{"inkVersion":21,"root":{"a":1}}`, nil},
+		{"nothing to play", `{"inkVersion":21,"root":[["done",null],"done",null]}`, nil},
+		{"variable mapped to an unknown stat", `{"inkVersion":21,"root":[["^Hola.","\n","end",null],"done",null]}`, map[string]string{"miedo": "terror"}},
+		{"variable mapped to items", `{"inkVersion":21,"root":[["^Hola.","\n","end",null],"done",null]}`, map[string]string{"llave": string(TypeItem)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ConvertInk(InkImportRequest{HolderName: "h", Title: "T", Variables: tt.variables, Ink: json.RawMessage(tt.ink)})
+			if err == nil {
+				t.Error("ConvertInk accepted the story")
+			}
+		})
+	}
+}
@@ -1,26 +1,41 @@
 package story
 
 type StoryData struct {
-	HolderName          string    `json:"holderName"`
-	Title               string    `json:"title"`
-	Description         string    `json:"description"`
-	MisfortuneThreshold float64   `json:"misfortuneThreshold"`
-	Acts                []ActData `json:"acts"`
+	HolderName          string    `json:"holderName" yaml:"holderName"`
+	Title               string    `json:"title" yaml:"title"`
+	Description         string    `json:"description" yaml:"description"`
+	MisfortuneThreshold float64   `json:"misfortuneThreshold" yaml:"misfortuneThreshold"`
+	Visibility          string    `json:"visibility" yaml:"visibility"`
+	Acts                []ActData `json:"acts" yaml:"acts"`
+
+	src source
 }
 
 type ActData struct {
-	Order   int          `json:"order"`
-	Text    string       `json:"text"`
-	Options []OptionData `json:"options"`
+	Order   int          `json:"order" yaml:"order"`
+	Text    string       `json:"text" yaml:"text"`
+	Options []OptionData `json:"options" yaml:"options"`
+
+	src source
 }
 
 type OptionData struct {
-	Text         string            `json:"text"`
-	NextActOrder *int              `json:"nextActOrder"`
-	Consequences []ConsequenceData `json:"consequences"`
+	Text         string            `json:"text" yaml:"text"`
+	NextActOrder *int              `json:"nextActOrder" yaml:"nextActOrder"`
+	Consequences []ConsequenceData `json:"consequences" yaml:"consequences"`
+
+	src source
 }
 
 type ConsequenceData struct {
-	Type  string  `json:"type"`
-	Value float64 `json:"value"`
+	Type  string  `json:"type" yaml:"type"`
+	Item  string  `json:"item,omitempty" yaml:"item,omitempty"`
+	Value float64 `json:"value" yaml:"value"`
+}
+
+// source records where a piece of story data was read from so validation
+// errors can point back to it.
+type source struct {
+	file string
+	line int
 }
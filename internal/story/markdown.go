@@ -0,0 +1,204 @@
+package story
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Markdown story documents start with YAML front matter between "---" lines.
+//
+// A story document has holderName/title/description/misfortuneThreshold in
+// its front matter and one "# ..." heading per act, ending in the act's
+// order ("# Act 2", "# Acto 2" or just "# 2"). Prose before the first heading
+// becomes the description when the front matter has none.
+//
+// An act document has "order" in its front matter and no headings; it
+// belongs to the story file in the same directory.
+//
+// In both, option lines are list items of the form
+//
+//	- [Open the door](#2) {locura: 1, panico: -0.5}
+//
+// where the link target is the next act's order and the optional trailing
+// flow mapping lists consequences by type; items are written as
+// "objeto/<name>: <quantity>". Every other line is act text.
+
+var (
+	actHeadingPattern = regexp.MustCompile(`^#\s+(?:.*\s)?(-?\d+)\s*$`)
+	optionPattern     = regexp.MustCompile(`^[-*]\s+\[(.+?)\](?:\(#(-?\d+)\))?\s*(\{.*\})?\s*$`)
+)
+
+type markdownFrontMatter struct {
+	HolderName          string  `yaml:"holderName"`
+	Title               string  `yaml:"title"`
+	Description         string  `yaml:"description"`
+	MisfortuneThreshold float64 `yaml:"misfortuneThreshold"`
+	Visibility          string  `yaml:"visibility"`
+	Order               *int    `yaml:"order"`
+}
+
+func parseMarkdownDocument(name string, data []byte) ([]StoryData, *ActData, ParseErrors) {
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "---" {
+		return nil, nil, ParseErrors{{File: name, Line: 1, Message: "missing front matter: the file must start with ---"}}
+	}
+	end := -1
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "---" {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return nil, nil, ParseErrors{{File: name, Line: 1, Message: "front matter is not closed with ---"}}
+	}
+
+	var fm markdownFrontMatter
+	if err := yaml.Unmarshal([]byte(strings.Join(lines[1:end], "\n")), &fm); err != nil {
+		return nil, nil, yamlErrors(name, 1, err)
+	}
+
+	body := lines[end+1:]
+	bodyStart := end + 2 // 1-based line number of body[0]
+
+	if fm.Order != nil && fm.HolderName == "" {
+		act := &ActData{Order: *fm.Order, src: source{line: 1}}
+		if errs := parseActBody(name, act, body, bodyStart, false); len(errs) > 0 {
+			return nil, nil, errs
+		}
+		return nil, act, nil
+	}
+
+	story := StoryData{
+		HolderName:          fm.HolderName,
+		Title:               fm.Title,
+		Description:         fm.Description,
+		MisfortuneThreshold: fm.MisfortuneThreshold,
+		Visibility:          fm.Visibility,
+		src:                 source{line: 1},
+	}
+
+	var errs ParseErrors
+	var preamble []string
+	var current *ActData
+	var currentLines []string
+	currentStart := 0
+
+	flush := func() {
+		if current == nil {
+			return
+		}
+		errs = append(errs, parseActBody(name, current, currentLines, currentStart, true)...)
+		story.Acts = append(story.Acts, *current)
+	}
+
+	for i, line := range body {
+		lineNo := bodyStart + i
+		if strings.HasPrefix(line, "# ") {
+			flush()
+			m := actHeadingPattern.FindStringSubmatch(line)
+			if m == nil {
+				errs = append(errs, ParseError{File: name, Line: lineNo, Message: "act heading must end with the act order, e.g. \"# Act 1\""})
+				current = nil
+				continue
+			}
+			order, _ := strconv.Atoi(m[1])
+			current = &ActData{Order: order, src: source{line: lineNo}}
+			currentLines = nil
+			currentStart = lineNo + 1
+			continue
+		}
+		if current == nil {
+			preamble = append(preamble, line)
+			continue
+		}
+		currentLines = append(currentLines, line)
+	}
+	flush()
+
+	if story.Description == "" {
+		story.Description = joinProse(preamble)
+	}
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+	return []StoryData{story}, nil, nil
+}
+
+// parseActBody fills in an act's text and options from its Markdown lines.
+func parseActBody(name string, act *ActData, lines []string, firstLine int, inStory bool) ParseErrors {
+	var errs ParseErrors
+	var text []string
+
+	for i, line := range lines {
+		lineNo := firstLine + i
+		trimmed := strings.TrimSpace(line)
+
+		if !inStory && strings.HasPrefix(trimmed, "# ") {
+			errs = append(errs, ParseError{File: name, Line: lineNo, Message: "act files cannot contain act headings"})
+			continue
+		}
+
+		if !strings.HasPrefix(trimmed, "- [") && !strings.HasPrefix(trimmed, "* [") {
+			text = append(text, line)
+			continue
+		}
+
+		m := optionPattern.FindStringSubmatch(trimmed)
+		if m == nil {
+			errs = append(errs, ParseError{File: name, Line: lineNo, Message: "malformed option, expected \"- [text](#next) {type: value}\""})
+			continue
+		}
+
+		option := OptionData{Text: strings.TrimSpace(m[1]), src: source{line: lineNo}}
+		if m[2] != "" {
+			next, _ := strconv.Atoi(m[2])
+			option.NextActOrder = &next
+		}
+		if m[3] != "" {
+			consequences, err := parseConsequenceMap(m[3])
+			if err != nil {
+				errs = append(errs, ParseError{File: name, Line: lineNo, Message: err.Error()})
+				continue
+			}
+			option.Consequences = consequences
+		}
+		act.Options = append(act.Options, option)
+	}
+
+	act.Text = joinProse(text)
+	return errs
+}
+
+func parseConsequenceMap(flow string) ([]ConsequenceData, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal([]byte(flow), &node); err != nil || len(node.Content) == 0 || node.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("consequences must be a mapping like {locura: 1}")
+	}
+
+	mapping := node.Content[0]
+	var consequences []ConsequenceData
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i].Value, mapping.Content[i+1].Value
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("consequence %q must be a number, got %q", key, value)
+		}
+		consequence := ConsequenceData{Type: key, Value: v}
+		if item, ok := strings.CutPrefix(key, string(TypeItem)+"/"); ok {
+			consequence.Type, consequence.Item = string(TypeItem), item
+		}
+		consequences = append(consequences, consequence)
+	}
+	return consequences, nil
+}
+
+// joinProse trims surrounding blank lines but keeps paragraph breaks.
+func joinProse(lines []string) string {
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
@@ -8,18 +8,38 @@ import (
 )
 
 type StoryBase struct {
-	ID        uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 }
 
+// Visibility controls who can start a story: hidden stories are only seen
+// by admins, assigned stories are started by an admin for a player, and open
+// stories appear in the player library.
+type Visibility string
+
+const (
+	VisibilityHidden   Visibility = "hidden"
+	VisibilityAssigned Visibility = "assigned"
+	VisibilityOpen     Visibility = "open"
+)
+
+func (v Visibility) IsValid() bool {
+	switch v {
+	case VisibilityHidden, VisibilityAssigned, VisibilityOpen:
+		return true
+	}
+	return false
+}
+
 type Story struct {
 	StoryBase
 	HolderName          string `gorm:"uniqueIndex;not null"`
 	Title               string `gorm:"not null"`
 	Description         string
-	MisfortuneThreshold float64 `gorm:"not null"`
+	MisfortuneThreshold float64    `gorm:"not null"`
+	Visibility          Visibility `gorm:"not null;default:assigned"`
 	Acts                []Act
 }
 
@@ -47,11 +67,23 @@ const (
 	TypeAnsiedad   ConsequenceType = "ansiedad"
 	TypeBrillantes ConsequenceType = "brillantes"
 	TypeMisfortune ConsequenceType = "desgracia"
+	// TypeItem adds (or with a negative value, removes) Value units of Item
+	// to the character's inventory.
+	TypeItem ConsequenceType = "objeto"
 )
 
+func (t ConsequenceType) IsValid() bool {
+	switch t {
+	case TypeLocura, TypePanico, TypeAnsiedad, TypeBrillantes, TypeMisfortune, TypeItem:
+		return true
+	}
+	return false
+}
+
 type Consequence struct {
 	gorm.Model
 	OptionID uuid.UUID       `gorm:"type:uuid;not null"`
 	Type     ConsequenceType `gorm:"not null"`
-	Value    float64         `gorm:"not null"`
+	Item     string
+	Value    float64 `gorm:"not null"`
 }
@@ -2,12 +2,20 @@ package story
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/dberr"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// ErrHolderNameTaken is returned when saving a story with the holder name
+// of another.
+var ErrHolderNameTaken = errors.New("a story with this holder name already exists")
+
 type Repository struct {
 	db *gorm.DB
 }
@@ -20,14 +28,26 @@ func NewRepository(db *gorm.DB) *Repository {
 
 func (r *Repository) SaveStory(ctx context.Context, story *Story) error {
 	if err := r.db.WithContext(ctx).Save(story).Error; err != nil {
-		return fmt.Errorf("error saving story: %w", err)
+		return storyWriteError(story.HolderName, err)
 	}
 	return nil
 }
 
+func storyWriteError(holderName string, err error) error {
+	if dberr.Violates(err, "idx_stories_holder_name", "stories.holder_name") {
+		return fmt.Errorf("%w: %s", ErrHolderNameTaken, holderName)
+	}
+	return fmt.Errorf("error saving story %s: %w", holderName, dberr.Classify(err))
+}
+
 func (r *Repository) GetStoryByID(ctx context.Context, storyID uuid.UUID) (*Story, error) {
 	var story Story
-	if err := r.db.WithContext(ctx).Preload("Acts.Options.Consequences").First(&story, "id = ?", storyID).Error; err != nil {
+	err := r.db.WithContext(ctx).
+		Preload("Acts", func(db *gorm.DB) *gorm.DB { return db.Order("\"order\"") }).
+		Preload("Acts.Options", func(db *gorm.DB) *gorm.DB { return db.Order("created_at") }).
+		Preload("Acts.Options.Consequences").
+		First(&story, "id = ?", storyID).Error
+	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, nil // Retorna nil si no se encuentra.
 		}
@@ -38,7 +58,11 @@ func (r *Repository) GetStoryByID(ctx context.Context, storyID uuid.UUID) (*Stor
 
 func (r *Repository) GetStoryActByID(ctx context.Context, actID uuid.UUID) (*Act, error) {
 	var act Act
-	if err := r.db.WithContext(ctx).Preload("Options.Consequences").First(&act, "id = ?", actID).Error; err != nil {
+	err := r.db.WithContext(ctx).
+		Preload("Options", func(db *gorm.DB) *gorm.DB { return db.Order("created_at") }).
+		Preload("Options.Consequences").
+		First(&act, "id = ?", actID).Error
+	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, nil
 		}
@@ -55,7 +79,255 @@ func (r *Repository) GetAllStories(ctx context.Context) ([]Story, error) {
 	return stories, nil
 }
 
-func (r *Repository) LoadStoriesFromData(ctx context.Context, storiesData []StoryData) error {
+type StorySummary struct {
+	ID          uuid.UUID
+	HolderName  string
+	Title       string
+	Description string
+	Visibility  Visibility
+	ActCount    int64
+	CreatedAt   time.Time
+}
+
+func (r *Repository) summaryQuery(ctx context.Context) *gorm.DB {
+	return r.db.WithContext(ctx).Model(&Story{}).
+		Select("stories.id, stories.holder_name, stories.title, stories.description, stories.visibility, stories.created_at, " +
+			"(SELECT COUNT(*) FROM acts WHERE acts.story_id = stories.id AND acts.deleted_at IS NULL) AS act_count").
+		Order("stories.created_at DESC")
+}
+
+func (r *Repository) GetStorySummaries(ctx context.Context) ([]StorySummary, error) {
+	var summaries []StorySummary
+	if err := r.summaryQuery(ctx).Scan(&summaries).Error; err != nil {
+		return nil, fmt.Errorf("error getting story summaries: %w", err)
+	}
+	return summaries, nil
+}
+
+func (r *Repository) GetOpenStorySummaries(ctx context.Context) ([]StorySummary, error) {
+	var summaries []StorySummary
+	if err := r.summaryQuery(ctx).Where("stories.visibility = ?", VisibilityOpen).Scan(&summaries).Error; err != nil {
+		return nil, fmt.Errorf("error getting open stories: %w", err)
+	}
+	return summaries, nil
+}
+
+// UpdateVisibility returns false if the story does not exist.
+func (r *Repository) UpdateVisibility(ctx context.Context, storyID uuid.UUID, visibility Visibility) (bool, error) {
+	result := r.db.WithContext(ctx).Model(&Story{}).Where("id = ?", storyID).Update("visibility", visibility)
+	if result.Error != nil {
+		return false, fmt.Errorf("error updating story visibility: %w", result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// GetStoryInfo returns a story without its acts, or nil if it does not
+// exist.
+func (r *Repository) GetStoryInfo(ctx context.Context, storyID uuid.UUID) (*Story, error) {
+	var story Story
+	if err := r.db.WithContext(ctx).First(&story, "id = ?", storyID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting story info: %w", err)
+	}
+	return &story, nil
+}
+
+// GetFirstAct returns the act with the lowest order, or nil if the story
+// has no acts.
+func (r *Repository) GetFirstAct(ctx context.Context, storyID uuid.UUID) (*Act, error) {
+	return FirstActTx(r.db.WithContext(ctx), storyID)
+}
+
+// FirstActTx is GetFirstAct for callers that are inside a transaction.
+func FirstActTx(tx *gorm.DB, storyID uuid.UUID) (*Act, error) {
+	var act Act
+	if err := tx.Where("story_id = ?", storyID).Order("\"order\"").First(&act).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting first act: %w", err)
+	}
+	return &act, nil
+}
+
+// IsAssignable reports whether a player can be put in the story by an
+// invite: it must exist, not be hidden and have at least one act.
+func (r *Repository) IsAssignable(ctx context.Context, storyID uuid.UUID) (bool, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&Act{}).
+		Joins("JOIN stories ON stories.id = acts.story_id AND stories.deleted_at IS NULL").
+		Where("acts.story_id = ? AND stories.visibility <> ?", storyID, VisibilityHidden).
+		Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("error checking story: %w", err)
+	}
+	return count > 0, nil
+}
+
+// UpdateActText changes the text of an act. It returns nil if the act does
+// not belong to the story.
+func (r *Repository) UpdateActText(ctx context.Context, storyID, actID uuid.UUID, text string) (*Act, error) {
+	var act Act
+	if err := r.db.WithContext(ctx).First(&act, "id = ? AND story_id = ?", actID, storyID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting act: %w", err)
+	}
+
+	act.Text = text
+	if err := r.db.WithContext(ctx).Save(&act).Error; err != nil {
+		return nil, fmt.Errorf("error updating act: %w", err)
+	}
+	return &act, nil
+}
+
+// OptionUpdate lists the option fields to change; nil fields are left as
+// they are. ClearNextAct removes the link to the next act.
+type OptionUpdate struct {
+	Text         *string
+	NextActID    *uuid.UUID
+	ClearNextAct bool
+	Consequences *[]ConsequenceData
+}
+
+var ErrNextActNotInStory = errors.New("next act does not belong to the story")
+
+// UpdateOption applies an OptionUpdate to an option of the given story. It
+// returns nil if the option does not belong to the story.
+func (r *Repository) UpdateOption(ctx context.Context, storyID, optionID uuid.UUID, update OptionUpdate) (*Option, error) {
+	var option Option
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Joins("JOIN acts ON acts.id = options.act_id").
+			Preload("Consequences").
+			Where("options.id = ? AND acts.story_id = ?", optionID, storyID).
+			First(&option).Error
+		if err != nil {
+			return err
+		}
+
+		if update.Text != nil {
+			option.Text = *update.Text
+		}
+		if update.ClearNextAct {
+			option.NextAct = nil
+		} else if update.NextActID != nil {
+			var count int64
+			if err := tx.Model(&Act{}).Where("id = ? AND story_id = ?", *update.NextActID, storyID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count == 0 {
+				return ErrNextActNotInStory
+			}
+			option.NextAct = update.NextActID
+		}
+		if err := tx.Save(&option).Error; err != nil {
+			return err
+		}
+
+		if update.Consequences != nil {
+			if err := tx.Unscoped().Where("option_id = ?", option.ID).Delete(&Consequence{}).Error; err != nil {
+				return err
+			}
+			option.Consequences = nil
+			for _, c := range *update.Consequences {
+				consequence := Consequence{OptionID: option.ID, Type: ConsequenceType(c.Type), Item: c.Item, Value: c.Value}
+				if err := tx.Create(&consequence).Error; err != nil {
+					return err
+				}
+				option.Consequences = append(option.Consequences, consequence)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		if errors.Is(err, ErrNextActNotInStory) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error updating option: %w", err)
+	}
+	return &option, nil
+}
+
+// ActOrders returns the order of every act of a story, keyed by act ID.
+func (r *Repository) ActOrders(ctx context.Context, storyID uuid.UUID) (map[uuid.UUID]int, error) {
+	var acts []Act
+	if err := r.db.WithContext(ctx).Select("id", "\"order\"").Where("story_id = ?", storyID).Find(&acts).Error; err != nil {
+		return nil, fmt.Errorf("error getting act orders: %w", err)
+	}
+	orderByAct := make(map[uuid.UUID]int, len(acts))
+	for _, a := range acts {
+		orderByAct[a.ID] = a.Order
+	}
+	return orderByAct, nil
+}
+
+// StoryInUseError is returned by DeleteStory for a story that characters
+// are still playing.
+type StoryInUseError struct {
+	Players int64
+}
+
+func (e *StoryInUseError) Error() string {
+	return fmt.Sprintf("story has %d characters in it", e.Players)
+}
+
+// DeleteStory removes a story with its acts, options and consequences,
+// unless a character is in it. The rows are deleted for good so the holder
+// name can be loaded again. The story row stays locked from the check to
+// the delete, and starting a story locks it too (see
+// character.StartStoryTx), so no run can begin in between.
+func (r *Repository) DeleteStory(ctx context.Context, storyID uuid.UUID) error {
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var story Story
+		if err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&story, "id = ?", storyID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil
+			}
+			return err
+		}
+
+		var players int64
+		if err := tx.Table("characters").Where("current_story_id = ? AND deleted_at IS NULL", storyID).Count(&players).Error; err != nil {
+			return err
+		}
+		if players > 0 {
+			return &StoryInUseError{Players: players}
+		}
+
+		actIDs := tx.Unscoped().Model(&Act{}).Select("id").Where("story_id = ?", storyID)
+		optionIDs := tx.Unscoped().Model(&Option{}).Select("id").Where("act_id IN (?)", actIDs)
+
+		if err := tx.Unscoped().Where("option_id IN (?)", optionIDs).Delete(&Consequence{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("act_id IN (?)", actIDs).Delete(&Option{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("story_id = ?", storyID).Delete(&Act{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&Story{}, "id = ?", storyID).Error
+	})
+	var inUse *StoryInUseError
+	if errors.As(err, &inUse) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error deleting story: %w", err)
+	}
+	return nil
+}
+
+// LoadStoriesFromData saves the stories and returns their IDs, in the
+// order given.
+func (r *Repository) LoadStoriesFromData(ctx context.Context, storiesData []StoryData) ([]uuid.UUID, error) {
+	storyIDs := make([]uuid.UUID, 0, len(storiesData))
 	for _, storyData := range storiesData {
 		// Crea la historia principal
 		story := Story{
@@ -63,6 +335,7 @@ func (r *Repository) LoadStoriesFromData(ctx context.Context, storiesData []Stor
 			Title:               storyData.Title,
 			Description:         storyData.Description,
 			MisfortuneThreshold: storyData.MisfortuneThreshold,
+			Visibility:          Visibility(storyData.Visibility),
 		}
 
 		// Mapea y enlaza los actos
@@ -90,19 +363,18 @@ func (r *Repository) LoadStoriesFromData(ctx context.Context, storiesData []Stor
 					consequence := Consequence{
 						OptionID: option.ID,
 						Type:     ConsequenceType(consequenceData.Type),
+						Item:     consequenceData.Item,
 						Value:    consequenceData.Value,
 					}
 					consequences = append(consequences, consequence)
 				}
 				option.Consequences = consequences
-				options = append(options, option)
 			}
 
 			act.Options = make([]Option, len(options))
 			for i, optPtr := range options {
 				act.Options[i] = *optPtr
 			}
-			acts = append(acts, act)
 		}
 		story.Acts = make([]Act, len(acts))
 		for i, actPtr := range acts {
@@ -112,8 +384,9 @@ func (r *Repository) LoadStoriesFromData(ctx context.Context, storiesData []Stor
 		// GORM no puede predecir IDs en cascada sin una operación de guardado,
 		// por lo que el mapeo NextAct se hace después.
 		if err := r.db.WithContext(ctx).Save(&story).Error; err != nil {
-			return fmt.Errorf("error saving story %s: %w", story.Title, err)
+			return nil, storyWriteError(story.HolderName, err)
 		}
+		storyIDs = append(storyIDs, story.ID)
 	}
 
 	// Segundo bucle para enlazar NextAct ahora que los UUIDs existen
@@ -139,5 +412,5 @@ func (r *Repository) LoadStoriesFromData(ctx context.Context, storiesData []Stor
 		}
 	}
 
-	return nil
+	return storyIDs, nil
 }
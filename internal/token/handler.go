@@ -3,68 +3,333 @@ package token
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/apierror"
+	"github.com/nicolas-camacho/thrg/internal/audit"
 	"github.com/nicolas-camacho/thrg/internal/contextutil"
-	"github.com/nicolas-camacho/thrg/internal/core"
+	"github.com/nicolas-camacho/thrg/internal/csvsafe"
+	"github.com/nicolas-camacho/thrg/internal/listing"
+	"github.com/nicolas-camacho/thrg/internal/ratelimit"
+	"github.com/nicolas-camacho/thrg/internal/session"
+	"github.com/nicolas-camacho/thrg/web"
 )
 
+var batchSheetTmpl *template.Template
+
+func init() {
+	var err error
+	batchSheetTmpl, err = template.ParseFS(web.Templates, "token_batch.html")
+	if err != nil {
+		log.Fatalf("Failed to parse token batch template: %v", err)
+	}
+}
+
+// UserLookup resolves the users a token list refers to.
 type UserLookup interface {
-	GetUserByID(ctx context.Context, userID uuid.UUID) (*core.UserLookupModel, error)
+	// GetUsernames returns the usernames of the given users, deleted ones
+	// included, in a single query.
+	GetUsernames(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID]string, error)
+	// SearchUserIDs returns the IDs of users whose username contains term.
+	SearchUserIDs(ctx context.Context, term string) ([]uuid.UUID, error)
+	// GetUserIDByUsername returns uuid.Nil if there is no such user.
+	GetUserIDByUsername(ctx context.Context, username string) (uuid.UUID, error)
+}
+
+const (
+	MaxTokenUses         = 1000
+	MaxTokenLifetimeDays = 365
+	MaxBatchSize         = 500
+)
+
+// generateTokenRequest is optional: without a body the token is single-use,
+// never expires and makes a plain player.
+type generateTokenRequest struct {
+	MaxUses       int `json:"maxUses"`
+	ExpiresInDays int `json:"expiresInDays"`
+	Invite
+}
+
+// batchTokenRequest creates Count tokens under a label, each set up like a
+// single generated token.
+type batchTokenRequest struct {
+	Count int    `json:"count"`
+	Label string `json:"label"`
+	generateTokenRequest
+}
+
+// RoleGranter reports whether an admin may invite users with a role.
+type RoleGranter interface {
+	CanGrantRole(ctx context.Context, adminID uuid.UUID, role string) (bool, error)
+}
+
+// StoryChecker reports whether invited players can be put in a story.
+type StoryChecker interface {
+	IsAssignable(ctx context.Context, storyID uuid.UUID) (bool, error)
 }
 
-func GenerateTokenHandler(repo *Repository) http.HandlerFunc {
+// A refused token is answered with a code that tells the player why. Tokens
+// that exist but can no longer be used are 410 Gone.
+func init() {
+	apierror.Register(ErrTokenNotFound, apierror.New(http.StatusUnauthorized, "token_not_found", "This token does not exist"))
+	apierror.Register(ErrTokenExpired, apierror.New(http.StatusGone, "token_expired", "This token has expired"))
+	apierror.Register(ErrTokenRevoked, apierror.New(http.StatusGone, "token_revoked", "This token has been revoked"))
+	apierror.Register(ErrTokenExhausted, apierror.New(http.StatusGone, "token_exhausted", "This token has already been used"))
+}
+
+func GenerateTokenHandler(repo *Repository, roles RoleGranter, stories StoryChecker, auditLog *audit.Log) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		ctx := r.Context()
 		adminID, ok := contextutil.GetUserIDFromContext(ctx)
 
 		if !ok || adminID == uuid.Nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			apierror.Write(w, apierror.Unauthorized("Unauthorized"))
+			return
+		}
+
+		var req generateTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
+			return
+		}
+		spec, ok := tokenSpec(w, r, adminID, req, roles, stories)
+		if !ok {
 			return
 		}
 
-		tokenValue, err := repo.CreateNewToken(ctx, adminID)
+		token, err := repo.CreateNewToken(ctx, adminID, spec)
 		if err != nil {
 			log.Printf("Error generating token: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			apierror.Write(w, apierror.ErrInternal)
 			return
 		}
+		auditLog.Record(r, audit.ActionTokenGenerate, audit.Target{Type: audit.TargetToken, ID: token.ID.String()}, specMetadata(spec))
 
 		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(map[string]string{
-			"token":   tokenValue,
-			"message": "Token generated successfully shared with a new player.",
+		json.NewEncoder(w).Encode(map[string]any{
+			"token":     token.Value,
+			"maxUses":   spec.MaxUses,
+			"expiresAt": spec.ExpiresAt,
+			"invite":    spec.Invite,
+			"message":   "Token generated successfully shared with a new player.",
+		})
+	}
+}
+
+// tokenSpec validates the options of a token request and fills in their
+// defaults. It writes the error response itself when they are invalid.
+func tokenSpec(w http.ResponseWriter, r *http.Request, adminID uuid.UUID, req generateTokenRequest, roles RoleGranter, stories StoryChecker) (TokenSpec, bool) {
+	ctx := r.Context()
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+	if req.MaxUses < 0 || req.MaxUses > MaxTokenUses {
+		apierror.Write(w, apierror.BadRequest("maxUses must be between 1 and 1000"))
+		return TokenSpec{}, false
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > MaxTokenLifetimeDays {
+		apierror.Write(w, apierror.BadRequest("expiresInDays must be between 0 (never) and 365"))
+		return TokenSpec{}, false
+	}
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	req.Party = strings.TrimSpace(req.Party)
+	req.SuggestedUsername = strings.TrimSpace(req.SuggestedUsername)
+	if req.Role != "" {
+		allowed, err := roles.CanGrantRole(ctx, adminID, req.Role)
+		if err != nil {
+			log.Printf("Error checking invite role: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return TokenSpec{}, false
+		}
+		if !allowed {
+			apierror.Write(w, apierror.Forbidden("You cannot invite users with that role"))
+			return TokenSpec{}, false
+		}
+	}
+	if req.StoryID != nil {
+		assignable, err := stories.IsAssignable(ctx, *req.StoryID)
+		if err != nil {
+			log.Printf("Error checking invite story: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return TokenSpec{}, false
+		}
+		if !assignable {
+			apierror.Write(w, apierror.BadRequest("Story not found, hidden or without acts"))
+			return TokenSpec{}, false
+		}
+	}
+
+	return TokenSpec{MaxUses: req.MaxUses, ExpiresAt: expiresAt, Invite: req.Invite}, true
+}
+
+// GenerateTokenBatchHandler creates many tokens at once, for handing out
+// invites at an event. The response links to the batch export.
+func GenerateTokenBatchHandler(repo *Repository, roles RoleGranter, stories StoryChecker, auditLog *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminID, ok := contextutil.GetUserIDFromContext(r.Context())
+		if !ok || adminID == uuid.Nil {
+			apierror.Write(w, apierror.Unauthorized("Unauthorized"))
+			return
+		}
+
+		var req batchTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
+			return
+		}
+		req.Label = strings.TrimSpace(req.Label)
+		if req.Label == "" {
+			apierror.Write(w, apierror.BadRequest("A label is required"))
+			return
+		}
+		if req.Count < 1 || req.Count > MaxBatchSize {
+			apierror.Write(w, apierror.BadRequest("count must be between 1 and 500"))
+			return
+		}
+		spec, ok := tokenSpec(w, r, adminID, req.generateTokenRequest, roles, stories)
+		if !ok {
+			return
+		}
+
+		batchID, tokens, err := repo.CreateTokenBatch(r.Context(), adminID, req.Label, req.Count, spec)
+		if err != nil {
+			log.Printf("Error generating token batch: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+		meta := specMetadata(spec)
+		meta["label"] = req.Label
+		meta["count"] = req.Count
+		auditLog.Record(r, audit.ActionTokenBatchGenerate, audit.Target{Type: audit.TargetTokenBatch, ID: batchID.String()}, meta)
+
+		values := make([]string, len(tokens))
+		for i, t := range tokens {
+			values[i] = t.Value
+		}
+		exportURL := "/admin/api/tokens/batch/" + batchID.String() + "/export"
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"message":   "Token batch generated successfully",
+			"batchId":   batchID,
+			"label":     req.Label,
+			"tokens":    values,
+			"csvUrl":    exportURL + "?format=csv",
+			"printUrl":  exportURL + "?format=html",
+			"expiresAt": spec.ExpiresAt,
 		})
 	}
 }
 
+// specMetadata describes generated tokens for the audit log. Token values
+// are left out: they are as good as an account.
+func specMetadata(spec TokenSpec) audit.Metadata {
+	meta := audit.Metadata{"maxUses": spec.MaxUses}
+	if spec.ExpiresAt != nil {
+		meta["expiresAt"] = spec.ExpiresAt
+	}
+	if spec.Invite.Role != "" {
+		meta["role"] = spec.Invite.Role
+	}
+	if spec.Invite.StoryID != nil {
+		meta["storyId"] = spec.Invite.StoryID
+	}
+	if spec.Invite.Party != "" {
+		meta["party"] = spec.Invite.Party
+	}
+	return meta
+}
+
+// ListTokensHandler returns one page of tokens, newest first. Tokens of a
+// batch are created together, so they stay next to each other. The query
+// can filter by status, creator (a username), batch label, creation date
+// (from, to) and search (the suggested username or the player who used the
+// token); the cursor of the next page is in the X-Next-Cursor header.
 func ListTokensHandler(tokenRepo *Repository, userLookup UserLookup) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tokens, err := tokenRepo.GetAllTokens(r.Context())
+		page, err := listing.PageFromRequest(r)
 		if err != nil {
-			log.Printf("Error retrieving tokens: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			apierror.Write(w, apierror.BadRequest(err.Error()))
+			return
+		}
+		filter, ok := tokenFilter(w, r, userLookup)
+		if !ok {
 			return
 		}
 
+		var tokens []RegistrationToken
+		var next *listing.Cursor
+		if filter != nil {
+			tokens, next, err = tokenRepo.ListTokens(r.Context(), *filter, page)
+			if err != nil {
+				log.Printf("Error retrieving tokens: %v", err)
+				apierror.Write(w, apierror.ErrInternal)
+				return
+			}
+		}
+
+		var usedByIDs []uuid.UUID
+		for _, t := range tokens {
+			if t.UsedByID != nil {
+				usedByIDs = append(usedByIDs, *t.UsedByID)
+			}
+		}
+		usernames := map[uuid.UUID]string{}
+		if len(usedByIDs) > 0 {
+			usernames, err = userLookup.GetUsernames(r.Context(), usedByIDs)
+			if err != nil {
+				log.Printf("Error retrieving users for tokens: %v", err)
+				apierror.Write(w, apierror.ErrInternal)
+				return
+			}
+		}
+
+		now := time.Now()
 		tokenDTOs := make([]TokenDTO, 0, len(tokens))
 		for _, t := range tokens {
 			dto := TokenDTO{
+				ID:        t.ID,
 				Value:     t.Value,
 				IsUsed:    t.IsUsed,
+				Status:    t.Status(now),
+				UseCount:  t.UseCount,
+				MaxUses:   t.MaxUses,
 				CreatedAt: t.CreatedAt,
+				ExpiresAt: t.ExpiresAt,
+				RevokedAt: t.RevokedAt,
+				Invite: Invite{
+					Role:              t.Role,
+					StoryID:           t.StoryID,
+					Party:             t.Party,
+					SuggestedUsername: t.SuggestedUsername,
+				},
+				BatchID:    t.BatchID,
+				BatchLabel: t.BatchLabel,
 			}
 
-			if t.IsUsed && t.UsedByID != nil {
-				playerModel, lookupErr := userLookup.GetUserByID(r.Context(), *t.UsedByID)
-				if lookupErr != nil {
-					log.Printf("Error retrieving user for token %s: %v", t.Value, lookupErr)
-					dto.UsedByUsername = "Error fetching user"
-				} else if playerModel != nil {
-					dto.UsedByUsername = playerModel.Username
+			if t.UsedByID != nil {
+				if username, found := usernames[*t.UsedByID]; found {
+					dto.UsedByUsername = username
 				} else {
 					dto.UsedByUsername = "Unknown"
 				}
@@ -74,6 +339,7 @@ func ListTokensHandler(tokenRepo *Repository, userLookup UserLookup) http.Handle
 			tokenDTOs = append(tokenDTOs, dto)
 		}
 
+		listing.WriteNext(w, next)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 
@@ -82,3 +348,326 @@ func ListTokensHandler(tokenRepo *Repository, userLookup UserLookup) http.Handle
 		}
 	}
 }
+
+// tokenFilter reads the list filters from the query. A nil filter with ok
+// set means nothing can match, such as a creator that does not exist; on
+// bad input the error is written and ok is false.
+func tokenFilter(w http.ResponseWriter, r *http.Request, userLookup UserLookup) (filter *TokenFilter, ok bool) {
+	query := r.URL.Query()
+	created, err := listing.DateRangeFromRequest(r)
+	if err != nil {
+		apierror.Write(w, apierror.BadRequest(err.Error()))
+		return nil, false
+	}
+	filter = &TokenFilter{
+		Status:     query.Get("status"),
+		BatchLabel: strings.TrimSpace(query.Get("label")),
+		Search:     strings.TrimSpace(query.Get("search")),
+		Created:    created,
+	}
+	if filter.Status != "" && !ValidStatus(filter.Status) {
+		apierror.Write(w, apierror.BadRequest("status must be available, expired, revoked or exhausted"))
+		return nil, false
+	}
+
+	if creator := strings.TrimSpace(query.Get("creator")); creator != "" {
+		creatorID, err := userLookup.GetUserIDByUsername(r.Context(), creator)
+		if err != nil {
+			log.Printf("Error looking up token creator %q: %v", creator, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return nil, false
+		}
+		if creatorID == uuid.Nil {
+			return nil, true
+		}
+		filter.CreatedByID = &creatorID
+	}
+	if filter.Search != "" {
+		filter.UsedByIDs, err = userLookup.SearchUserIDs(r.Context(), filter.Search)
+		if err != nil {
+			log.Printf("Error searching token users: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return nil, false
+		}
+	}
+	return filter, true
+}
+
+// PublicURLFromEnv reads PUBLIC_URL, the address players open the app at,
+// such as https://thrg.example.com. It returns nil if PUBLIC_URL is not set.
+// Links in batch exports are built from it rather than from the request,
+// which behind a proxy carries the internal address, and whose Host header
+// is whatever the client sent.
+func PublicURLFromEnv() (*url.URL, error) {
+	raw := os.Getenv("PUBLIC_URL")
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("PUBLIC_URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("PUBLIC_URL must be an http or https address without a query, such as https://thrg.example.com; got %q", raw)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
+
+func registrationLink(publicURL *url.URL, token string) string {
+	link := publicURL.JoinPath("player", "register")
+	link.RawQuery = url.Values{"token": {token}}.Encode()
+	return link.String()
+}
+
+type batchSheet struct {
+	Label     string
+	ExpiresAt *time.Time
+	Invites   []batchInvite
+}
+
+type batchInvite struct {
+	Token string
+	URL   string
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// BatchDTO is a batch summary as the admin batch list shows it.
+type BatchDTO struct {
+	BatchSummary
+	CreatedByUsername string
+}
+
+// ListBatchesHandler returns one page of batches, newest first, each with
+// its token counts by status; the cursor of the next page is in the
+// X-Next-Cursor header.
+func ListBatchesHandler(repo *Repository, userLookup UserLookup) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, err := listing.PageFromRequest(r)
+		if err != nil {
+			apierror.Write(w, apierror.BadRequest(err.Error()))
+			return
+		}
+
+		batches, next, err := repo.ListBatches(r.Context(), page)
+		if err != nil {
+			log.Printf("Error retrieving token batches: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		creatorIDs := make([]uuid.UUID, 0, len(batches))
+		for _, b := range batches {
+			creatorIDs = append(creatorIDs, b.CreatedByID)
+		}
+		usernames := map[uuid.UUID]string{}
+		if len(creatorIDs) > 0 {
+			usernames, err = userLookup.GetUsernames(r.Context(), creatorIDs)
+			if err != nil {
+				log.Printf("Error retrieving users for token batches: %v", err)
+				apierror.Write(w, apierror.ErrInternal)
+				return
+			}
+		}
+
+		batchDTOs := make([]BatchDTO, 0, len(batches))
+		for _, b := range batches {
+			dto := BatchDTO{BatchSummary: b, CreatedByUsername: usernames[b.CreatedByID]}
+			if dto.CreatedByUsername == "" {
+				dto.CreatedByUsername = "Unknown"
+			}
+			batchDTOs = append(batchDTOs, dto)
+		}
+
+		listing.WriteNext(w, next)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		if err := json.NewEncoder(w).Encode(batchDTOs); err != nil {
+			log.Printf("Error encoding token batches to JSON: %v", err)
+		}
+	}
+}
+
+// ExportBatchHandler exports a batch as CSV (format=csv, the default) with
+// every token and its status, or as a printable HTML sheet (format=html)
+// with one card per token that can still be used. Registration links point
+// to publicURL; without one, exports are disabled.
+func ExportBatchHandler(repo *Repository, publicURL *url.URL) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if publicURL == nil {
+			apierror.Write(w, apierror.New(http.StatusNotFound, "batch_export_disabled", "Batch export is disabled"))
+			return
+		}
+		batchID, err := uuid.Parse(chi.URLParam(r, "batchID"))
+		if err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid batch ID"))
+			return
+		}
+
+		tokens, err := repo.GetBatchTokens(r.Context(), batchID)
+		if err != nil {
+			log.Printf("Error retrieving token batch: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+		if len(tokens) == 0 {
+			apierror.Write(w, apierror.NotFound("Batch not found"))
+			return
+		}
+
+		switch r.URL.Query().Get("format") {
+		case "", "csv":
+			writeBatchCSV(w, publicURL, tokens)
+		case "html":
+			writeBatchSheet(w, publicURL, tokens)
+		default:
+			apierror.Write(w, apierror.BadRequest("format must be csv or html"))
+		}
+	}
+}
+
+func writeBatchCSV(w http.ResponseWriter, publicURL *url.URL, tokens []RegistrationToken) {
+	filename := unsafeFilenameChars.ReplaceAllString(tokens[0].BatchLabel, "-")
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="tokens-%s.csv"`, filename))
+
+	now := time.Now()
+	cw := csvsafe.NewWriter(w)
+	cw.Write([]string{"label", "token", "registration_url", "status", "use_count", "max_uses", "expires_at"})
+	for _, t := range tokens {
+		expiresAt := ""
+		if t.ExpiresAt != nil {
+			expiresAt = t.ExpiresAt.Format(time.RFC3339)
+		}
+		cw.Write([]string{
+			t.BatchLabel,
+			t.Value,
+			registrationLink(publicURL, t.Value),
+			t.Status(now),
+			strconv.Itoa(t.UseCount),
+			strconv.Itoa(t.MaxUses),
+			expiresAt,
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Error writing token batch CSV: %v", err)
+	}
+}
+
+func writeBatchSheet(w http.ResponseWriter, publicURL *url.URL, tokens []RegistrationToken) {
+	now := time.Now()
+	sheet := batchSheet{Label: tokens[0].BatchLabel, ExpiresAt: tokens[0].ExpiresAt}
+	for _, t := range tokens {
+		if t.Status(now) == StatusAvailable {
+			sheet.Invites = append(sheet.Invites, batchInvite{Token: t.Value, URL: registrationLink(publicURL, t.Value)})
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := batchSheetTmpl.Execute(w, sheet); err != nil {
+		log.Printf("Failed to render token batch sheet: %v", err)
+	}
+}
+
+func RevokeTokenHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenID, err := uuid.Parse(chi.URLParam(r, "tokenID"))
+		if err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid token ID"))
+			return
+		}
+
+		found, err := repo.RevokeToken(r.Context(), tokenID)
+		if err != nil {
+			log.Printf("Error revoking token: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+		if !found {
+			apierror.Write(w, apierror.NotFound("Token not found"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Token revoked successfully",
+		})
+	}
+}
+
+// RevokeBatchHandler revokes every token of a batch that can still be
+// used, such as the leftover invites of an event that is over.
+func RevokeBatchHandler(repo *Repository, auditLog *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		batchID, err := uuid.Parse(chi.URLParam(r, "batchID"))
+		if err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid batch ID"))
+			return
+		}
+
+		revoked, found, err := repo.RevokeBatch(r.Context(), batchID)
+		if err != nil {
+			log.Printf("Error revoking token batch: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+		if !found {
+			apierror.Write(w, apierror.NotFound("Batch not found"))
+			return
+		}
+		auditLog.Record(r, audit.ActionTokenBatchRevoke, audit.Target{Type: audit.TargetTokenBatch, ID: batchID.String()}, audit.Metadata{"revoked": revoked})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]any{
+			"message": "Token batch revoked successfully",
+			"revoked": revoked,
+		})
+	}
+}
+
+// InviteHandler tells the registration page what an invite link sets up, so
+// it can suggest the username. Unknown tokens count as failed attempts, like
+// registrations with them do.
+func InviteHandler(repo *Repository, guard *ratelimit.Guard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		value := r.URL.Query().Get("token")
+		if value == "" {
+			apierror.Write(w, apierror.BadRequest("A token is required"))
+			return
+		}
+
+		ip := session.ClientIP(r)
+		if wait, err := guard.Check(r.Context(), ip, ""); err != nil {
+			log.Printf("Failed to check registration attempts: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		} else if wait > 0 {
+			ratelimit.WriteTooManyAttempts(w, wait)
+			return
+		}
+
+		t, err := repo.GetAvailableToken(r.Context(), value)
+		if err != nil {
+			if errors.Is(err, ErrTokenNotFound) {
+				if _, failErr := guard.Fail(r.Context(), ip, ""); failErr != nil {
+					log.Printf("Failed to record registration attempt: %v", failErr)
+				}
+			}
+			apierror.Write(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]any{
+			"suggestedUsername": t.SuggestedUsername,
+			"party":             t.Party,
+			"assignsStory":      t.StoryID != nil,
+		})
+	}
+}
@@ -8,12 +8,22 @@ import (
 )
 
 type TokenModelBase struct {
-	ID        uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 }
 
+// Token statuses, as shown in the admin token list.
+const (
+	StatusAvailable = "available"
+	StatusExpired   = "expired"
+	StatusRevoked   = "revoked"
+	StatusExhausted = "exhausted"
+)
+
+// RegistrationToken lets up to MaxUses players register. IsUsed is set once
+// the last use is spent; UsedByID is the player who registered last.
 type RegistrationToken struct {
 	TokenModelBase
 	Value       string `gorm:"uniqueIndex;not null"`
@@ -21,4 +31,49 @@ type RegistrationToken struct {
 	UsedByID    *uuid.UUID
 	ExpiresAt   *time.Time
 	CreatedByID uuid.UUID
+	MaxUses     int `gorm:"not null;default:1"`
+	UseCount    int `gorm:"not null;default:0"`
+	RevokedAt   *time.Time
+
+	// Invite payload, applied when a player registers with the token. An
+	// empty Role means a plain player.
+	Role              string
+	StoryID           *uuid.UUID `gorm:"type:uuid"`
+	Party             string
+	SuggestedUsername string
+
+	// Tokens generated together share a batch, so they can be listed and
+	// exported as a group.
+	BatchID    *uuid.UUID `gorm:"type:uuid;index"`
+	BatchLabel string
+}
+
+// TokenSpec describes the tokens to create: MaxUses players can register
+// with each one until ExpiresAt, or forever if it is nil, and the invite is
+// applied to each of them.
+type TokenSpec struct {
+	MaxUses   int
+	ExpiresAt *time.Time
+	Invite    Invite
+}
+
+// Invite is what a token sets up for the players who register with it.
+type Invite struct {
+	Role              string     `json:"role"`
+	StoryID           *uuid.UUID `json:"storyId"`
+	Party             string     `json:"party"`
+	SuggestedUsername string     `json:"suggestedUsername"`
+}
+
+// Status reports why the token can no longer be used, or StatusAvailable.
+func (t *RegistrationToken) Status(now time.Time) string {
+	switch {
+	case t.RevokedAt != nil:
+		return StatusRevoked
+	case t.IsUsed || t.UseCount >= t.MaxUses:
+		return StatusExhausted
+	case t.ExpiresAt != nil && !now.Before(*t.ExpiresAt):
+		return StatusExpired
+	}
+	return StatusAvailable
 }
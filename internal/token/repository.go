@@ -2,11 +2,23 @@ package token
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/dberr"
+	"github.com/nicolas-camacho/thrg/internal/listing"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrTokenNotFound  = errors.New("token not found")
+	ErrTokenExpired   = errors.New("token has expired")
+	ErrTokenRevoked   = errors.New("token has been revoked")
+	ErrTokenExhausted = errors.New("token has already been used")
 )
 
 type Repository struct {
@@ -14,67 +26,338 @@ type Repository struct {
 }
 
 type TokenDTO struct {
-	Value          string    `json:"Value"`
-	IsUsed         bool      `json:"IsUsed"`
-	UsedByUsername string    `json:"UsedByUsername"`
-	CreatedAt      time.Time `json:"CreatedAt"`
+	ID             uuid.UUID  `json:"ID"`
+	Value          string     `json:"Value"`
+	IsUsed         bool       `json:"IsUsed"`
+	Status         string     `json:"Status"`
+	UseCount       int        `json:"UseCount"`
+	MaxUses        int        `json:"MaxUses"`
+	UsedByUsername string     `json:"UsedByUsername"`
+	CreatedAt      time.Time  `json:"CreatedAt"`
+	ExpiresAt      *time.Time `json:"ExpiresAt"`
+	RevokedAt      *time.Time `json:"RevokedAt"`
+	Invite         Invite     `json:"Invite"`
+	BatchID        *uuid.UUID `json:"BatchID"`
+	BatchLabel     string     `json:"BatchLabel"`
 }
 
 func NewRepository(db *gorm.DB) *Repository {
 	return &Repository{db: db}
 }
 
-func (r *Repository) CreateNewToken(ctx context.Context, adminID uuid.UUID) (string, error) {
+func statusError(status string) error {
+	switch status {
+	case StatusRevoked:
+		return ErrTokenRevoked
+	case StatusExhausted:
+		return ErrTokenExhausted
+	case StatusExpired:
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+func newToken(adminID uuid.UUID, spec TokenSpec) (RegistrationToken, error) {
 	tokenUUID, err := uuid.NewRandom()
 	if err != nil {
-		return "", fmt.Errorf("error generating UUID: %w", err)
+		return RegistrationToken{}, fmt.Errorf("error generating UUID: %w", err)
 	}
-	tokenValue := tokenUUID.String()
 
-	newToken := RegistrationToken{
-		Value:       tokenValue,
+	return RegistrationToken{
+		Value:       tokenUUID.String(),
 		CreatedByID: adminID,
+		MaxUses:     spec.MaxUses,
+		ExpiresAt:   spec.ExpiresAt,
+
+		Role:              spec.Invite.Role,
+		StoryID:           spec.Invite.StoryID,
+		Party:             spec.Invite.Party,
+		SuggestedUsername: spec.Invite.SuggestedUsername,
+	}, nil
+}
+
+func (r *Repository) CreateNewToken(ctx context.Context, adminID uuid.UUID, spec TokenSpec) (*RegistrationToken, error) {
+	token, err := newToken(adminID, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	result := r.db.WithContext(ctx).Create(&token)
+	if result.Error != nil {
+		return nil, fmt.Errorf("error creating token: %w", dberr.Classify(result.Error))
+	}
+	return &token, nil
+}
+
+// CreateTokenBatch creates count tokens under one batch ID and label in a
+// single insert, so a batch is either created whole or not at all. The
+// tokens share their creation time, which ListBatches groups them by.
+func (r *Repository) CreateTokenBatch(ctx context.Context, adminID uuid.UUID, label string, count int, spec TokenSpec) (uuid.UUID, []RegistrationToken, error) {
+	batchID := uuid.New()
+	createdAt := time.Now()
+	tokens := make([]RegistrationToken, count)
+	for i := range tokens {
+		token, err := newToken(adminID, spec)
+		if err != nil {
+			return uuid.Nil, nil, err
+		}
+		token.BatchID = &batchID
+		token.BatchLabel = label
+		token.CreatedAt = createdAt
+		tokens[i] = token
+	}
+
+	result := r.db.WithContext(ctx).Create(&tokens)
+	if result.Error != nil {
+		return uuid.Nil, nil, fmt.Errorf("error creating token batch: %w", dberr.Classify(result.Error))
 	}
+	return batchID, tokens, nil
+}
 
-	result := r.db.WithContext(ctx).Create(&newToken)
+// GetBatchTokens returns the tokens of a batch, or none if it does not
+// exist.
+func (r *Repository) GetBatchTokens(ctx context.Context, batchID uuid.UUID) ([]RegistrationToken, error) {
+	var tokens []RegistrationToken
+	result := r.db.WithContext(ctx).Where("batch_id = ?", batchID).Order("created_at, value").Find(&tokens)
 	if result.Error != nil {
-		return "", fmt.Errorf("error creating token: %w", result.Error)
+		return nil, fmt.Errorf("error retrieving token batch: %w", result.Error)
+	}
+	return tokens, nil
+}
+
+// BatchSummary counts the tokens of a batch by status. Uses adds up the
+// registrations made with them.
+type BatchSummary struct {
+	ID          uuid.UUID
+	Label       string
+	CreatedByID uuid.UUID
+	CreatedAt   time.Time
+	Count       int
+	Uses        int
+	Available   int
+	Exhausted   int
+	Expired     int
+	Revoked     int
+}
+
+// ListBatches returns one page of batch summaries, newest first, and the
+// cursor of the next page.
+func (r *Repository) ListBatches(ctx context.Context, page listing.Page) ([]BatchSummary, *listing.Cursor, error) {
+	const table = "batches"
+	columns := []string{
+		"batch_id AS id",
+		"batch_label AS label",
+		"created_by_id",
+		"created_at",
+		"COUNT(*) AS count",
+		"SUM(use_count) AS uses",
+	}
+	var args []any
+	for _, status := range []string{StatusAvailable, StatusExhausted, StatusExpired, StatusRevoked} {
+		condition, conditionArgs := statusCondition(status, time.Now())
+		columns = append(columns, fmt.Sprintf("SUM(CASE WHEN %s THEN 1 ELSE 0 END) AS %s", condition, status))
+		args = append(args, conditionArgs...)
+	}
+	batches := r.db.Model(&RegistrationToken{}).
+		Select(strings.Join(columns, ", "), args...).
+		Where("batch_id IS NOT NULL").
+		Group("batch_id, batch_label, created_by_id, created_at")
+
+	var summaries []BatchSummary
+	query := r.db.WithContext(ctx).Table("(?) AS "+table, batches)
+	if err := page.Apply(query, table).Find(&summaries).Error; err != nil {
+		return nil, nil, fmt.Errorf("error retrieving token batches: %w", err)
+	}
+	summaries, next := listing.Trim(summaries, page, func(b BatchSummary) listing.Cursor {
+		return listing.Cursor{CreatedAt: b.CreatedAt, ID: b.ID}
+	})
+	return summaries, next, nil
+}
+
+// RevokeBatch revokes the tokens of a batch that can still be used, leaving
+// the used ones as they are, and returns how many it revoked. It reports
+// whether the batch exists.
+func (r *Repository) RevokeBatch(ctx context.Context, batchID uuid.UUID) (int64, bool, error) {
+	var revoked int64
+	found := false
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&RegistrationToken{}).Where("batch_id = ?", batchID).Count(&count).Error; err != nil {
+			return fmt.Errorf("error retrieving token batch: %w", err)
+		}
+		if count == 0 {
+			return nil
+		}
+		found = true
+
+		result := tx.Model(&RegistrationToken{}).
+			Where("batch_id = ? AND revoked_at IS NULL AND NOT "+exhaustedCondition, batchID).
+			Update("revoked_at", time.Now())
+		if result.Error != nil {
+			return fmt.Errorf("error revoking token batch: %w", result.Error)
+		}
+		revoked = result.RowsAffected
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
 	}
-	return tokenValue, nil
+	return revoked, found, nil
 }
 
-func (r *Repository) ValidateAndUseToken(ctx context.Context, tokenValue string, usedByID uuid.UUID) (*RegistrationToken, error) {
+// ConsumeToken spends one use of the token for usedByID as part of tx, the
+// transaction that registers the player. The token row stays locked until
+// tx ends, so concurrent registrations with the same token queue up instead
+// of all reading the same use count; the conditional update keeps a token
+// from being overspent even where the database ignores the lock.
+func ConsumeToken(tx *gorm.DB, tokenValue string, usedByID uuid.UUID) (*RegistrationToken, error) {
 	var token RegistrationToken
 
-	result := r.db.WithContext(ctx).Where("value = ?", tokenValue).First(&token)
+	result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("value = ?", tokenValue).First(&token)
 	if result.Error != nil {
 		if result.Error == gorm.ErrRecordNotFound {
-			return nil, fmt.Errorf("token not found")
+			return nil, ErrTokenNotFound
 		}
 		return nil, fmt.Errorf("error retrieving token: %w", result.Error)
 	}
 
-	if token.IsUsed {
-		return nil, fmt.Errorf("token has already been used")
+	if err := statusError(token.Status(time.Now())); err != nil {
+		return nil, err
 	}
 
-	token.IsUsed = true
+	result = tx.Model(&RegistrationToken{}).
+		Where("id = ? AND use_count = ? AND revoked_at IS NULL", token.ID, token.UseCount).
+		Updates(map[string]any{
+			"use_count":  token.UseCount + 1,
+			"is_used":    token.UseCount+1 >= token.MaxUses,
+			"used_by_id": usedByID,
+		})
+	if result.Error != nil {
+		return nil, fmt.Errorf("error updating token as used: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrTokenExhausted
+	}
+
+	token.UseCount++
+	token.IsUsed = token.UseCount >= token.MaxUses
 	token.UsedByID = &usedByID
+	return &token, nil
+}
 
-	result = r.db.WithContext(ctx).Save(&token)
+// RevokeToken stops a token from being used again. It reports whether the
+// token exists; revoking a revoked token is not an error.
+func (r *Repository) RevokeToken(ctx context.Context, tokenID uuid.UUID) (bool, error) {
+	var token RegistrationToken
+	result := r.db.WithContext(ctx).Where("id = ?", tokenID).First(&token)
 	if result.Error != nil {
-		return nil, fmt.Errorf("error updating token as used: %w", result.Error)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error retrieving token: %w", result.Error)
 	}
+	if token.RevokedAt != nil {
+		return true, nil
+	}
+
+	result = r.db.WithContext(ctx).Model(&token).Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return false, fmt.Errorf("error revoking token: %w", result.Error)
+	}
+	return true, nil
+}
 
+// GetAvailableToken returns the token if players can still register with
+// it, or one of the token errors otherwise.
+func (r *Repository) GetAvailableToken(ctx context.Context, tokenValue string) (*RegistrationToken, error) {
+	var token RegistrationToken
+	result := r.db.WithContext(ctx).Where("value = ?", tokenValue).First(&token)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrTokenNotFound
+		}
+		return nil, fmt.Errorf("error retrieving token: %w", result.Error)
+	}
+	if err := statusError(token.Status(time.Now())); err != nil {
+		return nil, err
+	}
 	return &token, nil
 }
 
-func (r *Repository) GetAllTokens(ctx context.Context) ([]RegistrationToken, error) {
+// TokenFilter narrows the admin token list. Zero fields do not filter.
+type TokenFilter struct {
+	Status      string
+	CreatedByID *uuid.UUID
+	BatchLabel  string
+	Created     listing.DateRange
+
+	// Search matches the suggested username or, through UsedByIDs, the
+	// player who used the token.
+	Search    string
+	UsedByIDs []uuid.UUID
+}
+
+// ListTokens returns one page of tokens, newest first, and the cursor of
+// the next page.
+func (r *Repository) ListTokens(ctx context.Context, filter TokenFilter, page listing.Page) ([]RegistrationToken, *listing.Cursor, error) {
+	const table = "registration_tokens"
+	query := r.db.WithContext(ctx).Model(&RegistrationToken{})
+
+	if filter.Status != "" {
+		condition, args := statusCondition(filter.Status, time.Now())
+		query = query.Where(condition, args...)
+	}
+	if filter.CreatedByID != nil {
+		query = query.Where("created_by_id = ?", *filter.CreatedByID)
+	}
+	if filter.BatchLabel != "" {
+		query = query.Where("batch_label = ?", filter.BatchLabel)
+	}
+	if filter.Search != "" {
+		pattern := listing.ContainsPattern(filter.Search)
+		if len(filter.UsedByIDs) > 0 {
+			query = query.Where(`LOWER(suggested_username) LIKE ? ESCAPE '\' OR used_by_id IN ?`, pattern, filter.UsedByIDs)
+		} else {
+			query = query.Where(`LOWER(suggested_username) LIKE ? ESCAPE '\'`, pattern)
+		}
+	}
+	query = filter.Created.Apply(query, table)
+
 	var tokens []RegistrationToken
+	if err := page.Apply(query, table).Find(&tokens).Error; err != nil {
+		return nil, nil, fmt.Errorf("error retrieving tokens: %w", err)
+	}
+	tokens, next := listing.Trim(tokens, page, func(t RegistrationToken) listing.Cursor {
+		return listing.Cursor{CreatedAt: t.CreatedAt, ID: t.ID}
+	})
+	return tokens, next, nil
+}
 
-	result := r.db.WithContext(ctx).Order("created_at desc").Find(&tokens)
-	if result.Error != nil {
-		return nil, fmt.Errorf("error retrieving tokens: %w", result.Error)
+// statusCondition is RegistrationToken.Status as SQL, so the list can be
+// filtered by status in the database. Unknown statuses match available
+// tokens.
+func statusCondition(status string, now time.Time) (string, []any) {
+	const expired = "(expires_at IS NOT NULL AND expires_at <= ?)"
+	switch status {
+	case StatusRevoked:
+		return "revoked_at IS NOT NULL", nil
+	case StatusExhausted:
+		return "revoked_at IS NULL AND " + exhaustedCondition, nil
+	case StatusExpired:
+		return "revoked_at IS NULL AND NOT " + exhaustedCondition + " AND " + expired, []any{now}
+	default:
+		return "revoked_at IS NULL AND NOT " + exhaustedCondition + " AND NOT " + expired, []any{now}
 	}
-	return tokens, nil
+}
+
+// exhaustedCondition matches tokens with no uses left.
+const exhaustedCondition = "(is_used OR use_count >= max_uses)"
+
+// ValidStatus reports whether s is one of the token statuses.
+func ValidStatus(s string) bool {
+	switch s {
+	case StatusAvailable, StatusExpired, StatusRevoked, StatusExhausted:
+		return true
+	}
+	return false
 }
@@ -0,0 +1,267 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/apierror"
+	"github.com/nicolas-camacho/thrg/internal/audit"
+	"github.com/nicolas-camacho/thrg/internal/character"
+	"github.com/nicolas-camacho/thrg/internal/ratelimit"
+	"github.com/nicolas-camacho/thrg/internal/session"
+)
+
+// MaxDisplayNameLength is the longest display name, in characters.
+const MaxDisplayNameLength = 40
+
+type AccountDTO struct {
+	Username    string    `json:"username"`
+	DisplayName string    `json:"displayName"`
+	Role        string    `json:"role"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func accountDTO(user *User) AccountDTO {
+	return AccountDTO{
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		Role:        user.Role,
+		CreatedAt:   user.CreatedAt,
+	}
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type displayNameRequest struct {
+	DisplayName string `json:"displayName"`
+}
+
+type deleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// CharacterExporter gathers a player's game data for their data download.
+type CharacterExporter interface {
+	ExportUserData(ctx context.Context, userID uuid.UUID) (*character.DataExport, error)
+}
+
+// PlayerAccountHandler returns the logged-in player's profile.
+func PlayerAccountHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, repo)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(accountDTO(user))
+	}
+}
+
+// ChangePasswordHandler sets a new password for the logged-in player, who
+// must give their current one. Wrong passwords count as failed logins, so a
+// stolen session cannot be used to guess it. The player's other sessions
+// are closed; this one stays open.
+func ChangePasswordHandler(repo *Repository, sessions SessionRevoker, guard *ratelimit.Guard, playerSessionName string, auditLog *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, repo)
+		if !ok {
+			return
+		}
+
+		var req changePasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
+			return
+		}
+		if req.CurrentPassword == "" || req.NewPassword == "" {
+			apierror.Write(w, apierror.BadRequest("Current and new password are required"))
+			return
+		}
+
+		err := withPasswordGuard(w, r, guard, user, func() error {
+			return repo.ChangePassword(r.Context(), user.ID, req.CurrentPassword, req.NewPassword)
+		})
+		if err != nil {
+			return
+		}
+
+		if _, err := sessions.RevokeUserSessions(r.Context(), user.ID); err != nil {
+			log.Printf("Failed to revoke sessions of user %s: %v", user.ID, err)
+		}
+		if err := LoginPlayer(w, r, user.ID, playerSessionName); err != nil {
+			log.Printf("Failed to keep session of user %s: %v", user.ID, err)
+		}
+		auditLog.Record(r, audit.ActionPasswordChange, audit.Target{Type: audit.TargetUser, ID: user.ID.String()}, nil)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Password updated successfully"})
+	}
+}
+
+// SetDisplayNameHandler changes the name the logged-in player is shown by.
+// An empty name goes back to the username.
+func SetDisplayNameHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, repo)
+		if !ok {
+			return
+		}
+
+		var req displayNameRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
+			return
+		}
+		name := strings.TrimSpace(req.DisplayName)
+		if utf8.RuneCountInString(name) > MaxDisplayNameLength {
+			apierror.Write(w, apierror.BadRequest("The display name can be at most 40 characters long"))
+			return
+		}
+		if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+			apierror.Write(w, apierror.BadRequest("The display name contains invalid characters"))
+			return
+		}
+
+		if err := repo.SetDisplayName(r.Context(), user.ID, name); err != nil {
+			log.Printf("Failed to set display name of user %s: %v", user.ID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+		user.DisplayName = name
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(accountDTO(user))
+	}
+}
+
+// ExportAccountDataHandler downloads everything stored about the logged-in
+// player: their profile, their character and the journal and inventory of
+// every run.
+func ExportAccountDataHandler(repo *Repository, characters CharacterExporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, repo)
+		if !ok {
+			return
+		}
+
+		data, err := characters.ExportUserData(r.Context(), user.ID)
+		if err != nil {
+			log.Printf("Failed to export data of user %s: %v", user.ID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="thrg-account.json"`)
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(map[string]any{
+			"exportedAt": time.Now(),
+			"profile":    accountDTO(user),
+			"character":  data.Character,
+			"journal":    data.Journal,
+			"inventory":  data.Inventory,
+		}); err != nil {
+			log.Printf("Error encoding account data to JSON: %v", err)
+		}
+	}
+}
+
+// DeleteAccountHandler deletes the logged-in player's account once they
+// confirm it with their password, and logs them out everywhere. Their runs
+// are kept anonymously; see Repository.DeleteOwnAccount. Staff accounts are
+// deleted by an admin instead, so an owner cannot leave the game without
+// one by accident.
+func DeleteAccountHandler(repo *Repository, sessions SessionRevoker, guard *ratelimit.Guard, playerSessionName string, auditLog *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, repo)
+		if !ok {
+			return
+		}
+		if user.Role != RolePlayer {
+			apierror.Write(w, apierror.Forbidden("Only player accounts can be deleted here; ask an admin"))
+			return
+		}
+
+		var req deleteAccountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+			apierror.Write(w, apierror.BadRequest("Your password is required"))
+			return
+		}
+
+		err := withPasswordGuard(w, r, guard, user, func() error {
+			return repo.DeleteOwnAccount(r.Context(), user.ID, req.Password)
+		})
+		if err != nil {
+			return
+		}
+		auditLog.Record(r, audit.ActionAccountDelete, audit.Target{Type: audit.TargetUser, ID: user.ID.String()},
+			audit.Metadata{"username": user.Username})
+
+		if _, err := sessions.RevokeUserSessions(r.Context(), user.ID); err != nil {
+			log.Printf("Failed to revoke sessions of user %s: %v", user.ID, err)
+		}
+		if err := LogoutUser(w, r, playerSessionName); err != nil {
+			log.Printf("Failed to log out user: %v", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Account deleted"})
+	}
+}
+
+// withPasswordGuard runs change, which checks the user's current password,
+// behind the login rate limit. On any error the response has been written.
+func withPasswordGuard(w http.ResponseWriter, r *http.Request, guard *ratelimit.Guard, user *User, change func() error) error {
+	ip := session.ClientIP(r)
+	if wait, err := guard.Check(r.Context(), ip, user.Username); err != nil {
+		log.Printf("Failed to check login attempts: %v", err)
+		apierror.Write(w, apierror.ErrInternal)
+		return err
+	} else if wait > 0 {
+		ratelimit.WriteTooManyAttempts(w, wait)
+		return ErrWrongPassword
+	}
+
+	err := change()
+	if errors.Is(err, ErrWrongPassword) {
+		if wait, failErr := guard.Fail(r.Context(), ip, user.Username); failErr != nil {
+			log.Printf("Failed to record login attempt: %v", failErr)
+		} else if wait > 0 {
+			ratelimit.WriteTooManyAttempts(w, wait)
+			return err
+		}
+		apierror.Write(w, err)
+		return err
+	}
+	if writePasswordPolicyError(w, err) {
+		return err
+	}
+	if err != nil {
+		log.Printf("Failed to update account of user %s: %v", user.ID, err)
+		apierror.Write(w, apierror.ErrInternal)
+		return err
+	}
+
+	if err := guard.Succeed(r.Context(), user.Username); err != nil {
+		log.Printf("Failed to reset login attempts: %v", err)
+	}
+	return nil
+}
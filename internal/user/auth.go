@@ -1,26 +1,44 @@
 package user
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/sessions"
+	"github.com/nicolas-camacho/thrg/internal/apierror"
+	"github.com/nicolas-camacho/thrg/internal/apitoken"
 	"github.com/nicolas-camacho/thrg/internal/contextutil"
+	"github.com/nicolas-camacho/thrg/internal/session"
 )
 
 const (
 	SessionName = "admin_session"
-	userKey     = "user_id"
+	userKey     = session.UserIDKey
+
+	// pendingUserKey and pendingSinceKey hold an admin who passed the
+	// first login step but has not given their second factor yet, and
+	// pendingMethodKey how they passed it.
+	pendingUserKey   = "pending_2fa_user_id"
+	pendingSinceKey  = "pending_2fa_since"
+	pendingMethodKey = "pending_2fa_method"
+	pendingLifetime  = 5 * time.Minute
 )
 
-var Store *sessions.CookieStore
+var Store *session.Store
 
+// login authenticates the session as the user, under a new session ID.
 func login(w http.ResponseWriter, r *http.Request, userID uuid.UUID, sessionName string) error {
 	session, err := Store.Get(r, sessionName)
 	if err != nil {
 		return fmt.Errorf("error retrieving session: %w", err)
 	}
+	if err := Store.Renew(r, session); err != nil {
+		return fmt.Errorf("error renewing session: %w", err)
+	}
 
 	session.Values[userKey] = userID
 
@@ -38,6 +56,58 @@ func LoginPlayer(w http.ResponseWriter, r *http.Request, userID uuid.UUID, playe
 	return login(w, r, userID, playerSessionName)
 }
 
+func setPendingLogin(w http.ResponseWriter, r *http.Request, userID uuid.UUID, method string) error {
+	session, err := Store.Get(r, SessionName)
+	if err != nil {
+		return fmt.Errorf("error retrieving session: %w", err)
+	}
+
+	if err := Store.Renew(r, session); err != nil {
+		return fmt.Errorf("error renewing session: %w", err)
+	}
+
+	session.Values[pendingUserKey] = userID
+	session.Values[pendingSinceKey] = time.Now().Unix()
+	session.Values[pendingMethodKey] = method
+
+	if err := session.Save(r, w); err != nil {
+		return fmt.Errorf("error saving session: %w", err)
+	}
+	return nil
+}
+
+// pendingLogin returns the admin waiting to give their second factor and
+// how they passed the first step, one of the loginMethod values.
+func pendingLogin(r *http.Request) (uuid.UUID, string, bool) {
+	session, err := Store.Get(r, SessionName)
+	if err != nil {
+		return uuid.Nil, "", false
+	}
+
+	userID, ok := session.Values[pendingUserKey].(uuid.UUID)
+	since, _ := session.Values[pendingSinceKey].(int64)
+	if !ok || userID == uuid.Nil || time.Since(time.Unix(since, 0)) > pendingLifetime {
+		return uuid.Nil, "", false
+	}
+	method, _ := session.Values[pendingMethodKey].(string)
+	if method == "" {
+		method = loginMethodPassword
+	}
+	return userID, method, true
+}
+
+// clearPendingLogin forgets the pending login; the session is saved by the
+// login that follows.
+func clearPendingLogin(r *http.Request) {
+	session, err := Store.Get(r, SessionName)
+	if err != nil {
+		return
+	}
+	delete(session.Values, pendingUserKey)
+	delete(session.Values, pendingSinceKey)
+	delete(session.Values, pendingMethodKey)
+}
+
 func LogoutUser(w http.ResponseWriter, r *http.Request, sessionName string) error {
 	session, err := Store.Get(r, sessionName)
 	if err != nil {
@@ -51,9 +121,42 @@ func LogoutUser(w http.ResponseWriter, r *http.Request, sessionName string) erro
 	return nil
 }
 
-func AdminAuthMiddleware(adminSessionName string) func(next http.Handler) http.Handler {
+// TokenAuthenticator resolves a personal access token, returning nil if it
+// is unknown, expired or revoked.
+type TokenAuthenticator interface {
+	Authenticate(ctx context.Context, raw string) (*apitoken.AccessToken, error)
+}
+
+// AdminAuthMiddleware authenticates admins by their session cookie or, on
+// the admin API, by an "Authorization: Bearer" access token. A request that
+// sends a token is judged by the token alone, never by its cookie.
+func AdminAuthMiddleware(adminSessionName string, tokens TokenAuthenticator) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if raw, ok := apitoken.BearerToken(r); ok {
+				if !strings.HasPrefix(r.URL.Path, apitoken.PathPrefix) {
+					apierror.Write(w, apierror.Unauthorized("Access tokens are only accepted on "+apitoken.PathPrefix))
+					return
+				}
+
+				token, err := tokens.Authenticate(r.Context(), raw)
+				if err != nil {
+					log.Printf("Failed to authenticate access token: %v", err)
+					apierror.Write(w, apierror.ErrInternal)
+					return
+				}
+				if token == nil {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					apierror.Write(w, apierror.New(http.StatusUnauthorized, "invalid_token", "Invalid or expired access token"))
+					return
+				}
+
+				ctx := contextutil.SetUserIDInContext(r.Context(), token.UserID)
+				ctx = apitoken.WithToken(ctx, token)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
 			session, err := Store.Get(r, adminSessionName)
 			if err != nil {
 				http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
@@ -72,6 +175,19 @@ func AdminAuthMiddleware(adminSessionName string) func(next http.Handler) http.H
 	}
 }
 
+// SessionOnly rejects requests made with an access token. It guards account
+// settings, including the tokens themselves, so a leaked token cannot be
+// used to mint new ones or to turn off two-factor authentication.
+func SessionOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := apitoken.FromContext(r.Context()); ok {
+			apierror.Write(w, apierror.New(http.StatusForbidden, "session_required", "This endpoint requires a logged-in session"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func PlayerAuthMiddleware(playerSessionName string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
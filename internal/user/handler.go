@@ -3,39 +3,99 @@ package user
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/apierror"
+	"github.com/nicolas-camacho/thrg/internal/audit"
+	"github.com/nicolas-camacho/thrg/internal/contextutil"
+	"github.com/nicolas-camacho/thrg/internal/csrf"
+	"github.com/nicolas-camacho/thrg/internal/listing"
+	"github.com/nicolas-camacho/thrg/internal/password"
+	"github.com/nicolas-camacho/thrg/internal/ratelimit"
+	"github.com/nicolas-camacho/thrg/internal/session"
 	"github.com/nicolas-camacho/thrg/internal/token"
+	"github.com/nicolas-camacho/thrg/internal/totp"
+	"github.com/nicolas-camacho/thrg/web"
 )
 
 type LoginPageData struct {
-	Error string
+	Error     string
+	CSRFToken string
+	// Step is the login step to show: the password form when empty, or one
+	// of the loginStep values.
+	Step   string
+	Secret string
+	// OIDCName is the name of the OIDC provider to offer as a way to log
+	// in, or empty when OIDC login is off.
+	OIDCName string
+	// OTPAuthURI is a template.URL because html/template would otherwise
+	// replace the otpauth: scheme with a placeholder.
+	OTPAuthURI    template.URL
+	RecoveryCodes []string
 }
 
+const (
+	loginStepTOTP     = "totp"
+	loginStepEnroll   = "enroll"
+	loginStepRecovery = "recovery"
+)
+
 var loginTmpl *template.Template
 var dashboardTmpl *template.Template
+var pageTmpls *template.Template
+
+var errAdminExists = apierror.New(http.StatusConflict, "admin_exists", "Admin user already exists")
+
+// The repository's errors that handlers pass on to apierror.Write as they
+// come.
+func init() {
+	apierror.Register(ErrUserDisabled, apierror.New(http.StatusForbidden, "account_disabled", "This account has been disabled"))
+	apierror.Register(ErrInvalidCredentials, apierror.New(http.StatusUnauthorized, "invalid_credentials", "Invalid username or password"))
+	apierror.Register(ErrUsernameTaken, apierror.New(http.StatusConflict, "username_taken", "Username already exists"))
+	apierror.Register(ErrWrongPassword, apierror.New(http.StatusForbidden, "wrong_password", "Your current password is incorrect"))
+	apierror.Register(ErrResetTokenInvalid, apierror.New(http.StatusBadRequest, "reset_link_invalid", "This link is invalid or has expired"))
+	apierror.Register(ErrNoPassword, apierror.New(http.StatusConflict, "no_password", "This account has no password, so it can only log in with OIDC"))
+	apierror.Register(ErrInvalidTOTPCode, apierror.New(http.StatusBadRequest, "invalid_code", "Invalid code"))
+	apierror.Register(ErrTOTPAlreadyEnabled, apierror.New(http.StatusConflict, "two_factor_enabled", "Two-factor authentication is already enabled"))
+	apierror.Register(ErrTOTPNotEnrolled, apierror.New(http.StatusConflict, "two_factor_not_set_up", "Two-factor authentication is not set up"))
+}
+
+// PageData is what the static pages need from the server.
+type PageData struct {
+	CSRFToken string
+}
 
 func init() {
 	var err error
-	loginTmpl, err = template.ParseFiles("web/login.html")
+	loginTmpl, err = template.ParseFS(web.Templates, "login.html")
 	if err != nil {
 		log.Fatalf("Failed to parse login template: %v", err)
 	}
 
-	dashboardTmpl, err = template.ParseFiles("web/dashboard.html")
+	dashboardTmpl, err = template.ParseFS(web.Templates, "dashboard.html")
 	if err != nil {
 		log.Fatalf("Failed to parse dashboard template: %v", err)
 	}
+
+	pageTmpls, err = template.ParseFS(web.Templates, "player_login.html", "player_register.html", "password_reset.html", "player_account.html")
+	if err != nil {
+		log.Fatalf("Failed to parse page templates: %v", err)
+	}
 }
 
-func ServeLoginPageHandler(repo *Repository) http.HandlerFunc {
+func ServeLoginPageHandler(repo *Repository, guard *ratelimit.Guard, require2FA bool, auditLog *audit.Log) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
-			loginTmpl.Execute(w, LoginPageData{Error: ""})
+			renderLogin(w, r, http.StatusOK, LoginPageData{})
 			return
 		}
 
@@ -46,34 +106,279 @@ func ServeLoginPageHandler(repo *Repository) http.HandlerFunc {
 				return
 			}
 
-			username := r.FormValue("username")
-			password := r.FormValue("password")
-
-			user, err := repo.Authenticate(r.Context(), username, password)
-			if err != nil {
-				data := LoginPageData{Error: "Invalid username or password"}
-				w.WriteHeader(http.StatusUnauthorized)
-				loginTmpl.Execute(w, data)
-				return
+			switch r.FormValue("step") {
+			case loginStepTOTP:
+				verifyLoginCode(w, r, repo, guard, auditLog)
+			case loginStepEnroll:
+				confirmLoginEnrollment(w, r, repo, guard, auditLog)
+			default:
+				checkLoginPassword(w, r, repo, guard, require2FA, auditLog)
 			}
+		}
+	}
+}
 
-			if user.Role != RoleAdmin {
-				data := LoginPageData{Error: "Access denied, admin only"}
-				w.WriteHeader(http.StatusForbidden)
-				loginTmpl.Execute(w, data)
-				return
-			}
+// checkLoginPassword is the first step of the admin login.
+func checkLoginPassword(w http.ResponseWriter, r *http.Request, repo *Repository, guard *ratelimit.Guard, require2FA bool, auditLog *audit.Log) {
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+	ip := session.ClientIP(r)
 
-			if err := LoginAdmin(w, r, user.ID, "admin_session"); err != nil {
-				log.Printf("Failed to log in user: %v", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
-			}
+	wait, err := guard.Check(r.Context(), ip, username)
+	if err != nil {
+		log.Printf("Failed to check login attempts: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		recordLoginFailure(r, auditLog, loginPortalAdmin, nil, username, loginFailedThrottled)
+		renderLogin(w, r, http.StatusTooManyRequests, LoginPageData{Error: ratelimit.TooManyAttemptsMessage(wait)})
+		return
+	}
+
+	user, err := repo.Authenticate(r.Context(), username, password)
+	if errors.Is(err, ErrUserDisabled) {
+		recordLoginFailure(r, auditLog, loginPortalAdmin, nil, username, loginFailedDisabled)
+		renderLogin(w, r, http.StatusForbidden, LoginPageData{Error: "This account has been disabled"})
+		return
+	}
+	if err != nil && !errors.Is(err, ErrInvalidCredentials) {
+		log.Printf("Failed to authenticate %q: %v", username, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		recordLoginFailure(r, auditLog, loginPortalAdmin, nil, username, loginFailedPassword)
+		data := LoginPageData{Error: "Invalid username or password"}
+		if wait, failErr := guard.Fail(r.Context(), ip, username); failErr != nil {
+			log.Printf("Failed to record login attempt: %v", failErr)
+		} else if wait > 0 {
+			data.Error = ratelimit.TooManyAttemptsMessage(wait)
+		}
+		renderLogin(w, r, http.StatusUnauthorized, data)
+		return
+	}
+
+	if !HasPermission(user.Role, PermDashboardView) {
+		recordLoginFailure(r, auditLog, loginPortalAdmin, &user.ID, username, loginFailedForbidden)
+		renderLogin(w, r, http.StatusForbidden, LoginPageData{Error: "Access denied, admin only"})
+		return
+	}
 
-			log.Printf("Admin %s logged in successfully (ID: %s)", user.Username, user.ID)
-			http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+	continueAdminLogin(w, r, repo, guard, user, require2FA, auditLog, loginMethodPassword)
+}
+
+// continueAdminLogin takes an admin who passed the first login step, by
+// method, to the second one if they have two-factor authentication or must
+// set it up, and logs them in otherwise.
+func continueAdminLogin(w http.ResponseWriter, r *http.Request, repo *Repository, guard *ratelimit.Guard, user *User, require2FA bool, auditLog *audit.Log, method string) {
+	if user.HasTOTP() {
+		if err := setPendingLogin(w, r, user.ID, method); err != nil {
+			log.Printf("Failed to save pending login: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
+		renderLogin(w, r, http.StatusOK, LoginPageData{Step: loginStepTOTP})
+		return
+	}
+
+	if require2FA {
+		secret, err := repo.BeginTOTPEnrollment(r.Context(), user.ID)
+		if err != nil {
+			log.Printf("Failed to start TOTP enrollment for %s: %v", user.Username, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if err := setPendingLogin(w, r, user.ID, method); err != nil {
+			log.Printf("Failed to save pending login: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		renderLogin(w, r, http.StatusOK, enrollPageData(user.Username, secret, ""))
+		return
+	}
+
+	if completeAdminLogin(w, r, guard, user, auditLog, method) {
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+	}
+}
+
+// pendingUser returns the admin who passed the first step in this session
+// and how, or nil if there is none or it took too long.
+func pendingUser(w http.ResponseWriter, r *http.Request, repo *Repository) (*User, string, bool) {
+	userID, method, ok := pendingLogin(r)
+	if ok {
+		user, err := repo.GetUser(r.Context(), userID)
+		if err != nil {
+			log.Printf("Failed to get pending user: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return nil, "", false
+		}
+		if user != nil && !user.IsDisabled() {
+			return user, method, true
+		}
+	}
+
+	renderLogin(w, r, http.StatusUnauthorized, LoginPageData{Error: "Your login has expired, please log in again"})
+	return nil, "", false
+}
+
+func verifyLoginCode(w http.ResponseWriter, r *http.Request, repo *Repository, guard *ratelimit.Guard, auditLog *audit.Log) {
+	user, method, ok := pendingUser(w, r, repo)
+	if !ok {
+		return
+	}
+
+	ip := session.ClientIP(r)
+	wait, err := guard.Check(r.Context(), ip, user.Username)
+	if err != nil {
+		log.Printf("Failed to check login attempts: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		recordLoginFailure(r, auditLog, loginPortalAdmin, &user.ID, user.Username, loginFailedThrottled)
+		renderLogin(w, r, http.StatusTooManyRequests, LoginPageData{Step: loginStepTOTP, Error: ratelimit.TooManyAttemptsMessage(wait)})
+		return
+	}
+
+	if err := repo.VerifySecondFactor(r.Context(), user.ID, r.FormValue("code")); err != nil {
+		if !errors.Is(err, ErrInvalidTOTPCode) {
+			log.Printf("Failed to verify second factor for %s: %v", user.Username, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		recordLoginFailure(r, auditLog, loginPortalAdmin, &user.ID, user.Username, loginFailedCode)
+		data := LoginPageData{Step: loginStepTOTP, Error: "Invalid code"}
+		if wait, failErr := guard.Fail(r.Context(), ip, user.Username); failErr != nil {
+			log.Printf("Failed to record login attempt: %v", failErr)
+		} else if wait > 0 {
+			data.Error = ratelimit.TooManyAttemptsMessage(wait)
+		}
+		renderLogin(w, r, http.StatusUnauthorized, data)
+		return
+	}
+
+	if completeAdminLogin(w, r, guard, user, auditLog, method) {
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+	}
+}
+
+// confirmLoginEnrollment finishes the mandatory two-factor setup of an admin
+// logging in without it, then shows their recovery codes.
+func confirmLoginEnrollment(w http.ResponseWriter, r *http.Request, repo *Repository, guard *ratelimit.Guard, auditLog *audit.Log) {
+	user, method, ok := pendingUser(w, r, repo)
+	if !ok {
+		return
+	}
+
+	ip := session.ClientIP(r)
+	wait, err := guard.Check(r.Context(), ip, user.Username)
+	if err != nil {
+		log.Printf("Failed to check login attempts: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		recordLoginFailure(r, auditLog, loginPortalAdmin, &user.ID, user.Username, loginFailedThrottled)
+		renderLogin(w, r, http.StatusTooManyRequests, enrollPageData(user.Username, user.TOTPSecret, ratelimit.TooManyAttemptsMessage(wait)))
+		return
+	}
+
+	codes, err := repo.EnableTOTP(r.Context(), user.ID, r.FormValue("code"))
+	switch {
+	case errors.Is(err, ErrInvalidTOTPCode):
+		recordLoginFailure(r, auditLog, loginPortalAdmin, &user.ID, user.Username, loginFailedCode)
+		data := enrollPageData(user.Username, user.TOTPSecret, "Invalid code")
+		if wait, failErr := guard.Fail(r.Context(), ip, user.Username); failErr != nil {
+			log.Printf("Failed to record login attempt: %v", failErr)
+		} else if wait > 0 {
+			data.Error = ratelimit.TooManyAttemptsMessage(wait)
+		}
+		renderLogin(w, r, http.StatusUnauthorized, data)
+		return
+	case errors.Is(err, ErrTOTPAlreadyEnabled):
+		renderLogin(w, r, http.StatusOK, LoginPageData{Step: loginStepTOTP})
+		return
+	case err != nil:
+		log.Printf("Failed to enable TOTP for %s: %v", user.Username, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if completeAdminLogin(w, r, guard, user, auditLog, method) {
+		renderLogin(w, r, http.StatusOK, LoginPageData{Step: loginStepRecovery, RecoveryCodes: codes})
+	}
+}
+
+// completeAdminLogin logs the admin in once every step has passed. method
+// is how they proved who they are, one of the loginMethod values.
+func completeAdminLogin(w http.ResponseWriter, r *http.Request, guard *ratelimit.Guard, user *User, auditLog *audit.Log, method string) bool {
+	// Failures are only cleared here, not after the password step, so the
+	// password cannot be used to reset the count of wrong codes.
+	if err := guard.Succeed(r.Context(), user.Username); err != nil {
+		log.Printf("Failed to reset login attempts: %v", err)
+	}
+
+	clearPendingLogin(r)
+	if err := LoginAdmin(w, r, user.ID, SessionName); err != nil {
+		log.Printf("Failed to log in user: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+
+	log.Printf("Admin %s logged in successfully (ID: %s)", user.Username, user.ID)
+	auditLog.RecordAs(r, &user.ID, audit.ActionLogin, audit.Target{Type: audit.TargetUser, ID: user.ID.String()},
+		audit.Metadata{"portal": loginPortalAdmin, "method": method})
+	return true
+}
+
+// Where a login happened and why it failed, as recorded in the audit log.
+const (
+	loginPortalAdmin  = "admin"
+	loginPortalPlayer = "player"
+
+	loginMethodPassword = "password"
+	loginMethodOIDC     = "oidc"
+
+	loginFailedPassword  = "invalid_credentials"
+	loginFailedCode      = "invalid_code"
+	loginFailedDisabled  = "disabled"
+	loginFailedForbidden = "forbidden"
+	loginFailedThrottled = "rate_limited"
+	loginFailedOIDC      = "oidc_rejected"
+	loginFailedNotLinked = "not_linked"
+)
+
+// recordLoginFailure audits a failed login. Nobody is logged in, so the
+// event has no actor; userID is the account tried, if it is known.
+func recordLoginFailure(r *http.Request, auditLog *audit.Log, portal string, userID *uuid.UUID, username, reason string) {
+	target := audit.Target{}
+	if userID != nil {
+		target = audit.Target{Type: audit.TargetUser, ID: userID.String()}
+	}
+	auditLog.RecordAs(r, nil, audit.ActionLoginFailed, target, audit.Metadata{
+		"portal":   portal,
+		"username": username,
+		"reason":   reason,
+	})
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request, status int, data LoginPageData) {
+	data.CSRFToken = csrf.Token(r)
+	if OIDC != nil {
+		data.OIDCName = OIDC.Name()
+	}
+	w.WriteHeader(status)
+	loginTmpl.Execute(w, data)
+}
+
+func enrollPageData(username, secret, errorMessage string) LoginPageData {
+	return LoginPageData{
+		Error:      errorMessage,
+		Step:       loginStepEnroll,
+		Secret:     secret,
+		OTPAuthURI: template.URL(totp.URI(totpIssuer, username, secret)),
 	}
 }
 
@@ -88,46 +393,58 @@ func SetupAdminHandler(repo *Repository) http.HandlerFunc {
 
 		exists, err := repo.CheckAdminExists(ctx)
 		if err != nil {
-			http.Error(w, "Failed to check admin existence", http.StatusInternalServerError)
+			log.Printf("Failed to check admin existence: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
 			return
 		}
 		if exists {
-			w.WriteHeader(http.StatusConflict)
-			w.Write([]byte(`{"error":"Admin user already exists"}`))
+			apierror.Write(w, errAdminExists)
 			return
 		}
 
 		var req setupAdminRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
 			return
 		}
 
 		if req.Username == "" || req.Password == "" {
-			http.Error(w, "Username and password are required", http.StatusBadRequest)
+			apierror.Write(w, apierror.BadRequest("Username and password are required"))
 			return
 		}
 
-		_, err = repo.CreateUser(ctx, req.Username, req.Password, RoleAdmin)
+		_, err = repo.CreateUser(ctx, req.Username, req.Password, RoleOwner)
+		if writePasswordPolicyError(w, err) {
+			return
+		}
 		if err != nil {
 			log.Printf("Failed to create admin user: %v", err)
-			http.Error(w, "Failed to create admin user", http.StatusInternalServerError)
+			apierror.Write(w, apierror.ErrInternal)
 			return
 		}
 
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte(`{"message":"Admin user created successfully"}`))
+		json.NewEncoder(w).Encode(map[string]string{"message": "Admin user created successfully"})
 	}
 }
 
 func DashboardHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "web/dashboard.html")
+		if err := dashboardTmpl.Execute(w, PageData{CSRFToken: csrf.Token(r)}); err != nil {
+			log.Printf("Failed to render dashboard: %v", err)
+		}
 	}
 }
 
-type RegistrationTokenRepository interface {
-	ValidateAndUseToken(ctx context.Context, tokenValue string, userID uuid.UUID) (*token.RegistrationToken, error)
+// ServePageHandler renders one of the player-facing pages (player_login.html,
+// player_register.html, password_reset.html).
+func ServePageHandler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := pageTmpls.ExecuteTemplate(w, name, PageData{CSRFToken: csrf.Token(r)}); err != nil {
+			log.Printf("Failed to render %s: %v", name, err)
+		}
+	}
 }
 
 type RegisterPlayerRequest struct {
@@ -136,40 +453,60 @@ type RegisterPlayerRequest struct {
 	Token    string `json:"token"`
 }
 
-func RegisterPlayerHandler(userRepo *Repository, tokenRepo *token.Repository) http.HandlerFunc {
+func RegisterPlayerHandler(userRepo *Repository, guard *ratelimit.Guard, auditLog *audit.Log) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req RegisterPlayerRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
 			return
 		}
 
 		if req.Username == "" || req.Password == "" || req.Token == "" {
-			http.Error(w, "Username, password, and token are required", http.StatusBadRequest)
+			apierror.Write(w, apierror.BadRequest("Username, password, and token are required"))
 			return
 		}
 
-		newUser, err := userRepo.CreateUser(r.Context(), req.Username, req.Password, RolePlayer)
-		if err != nil {
-			log.Printf("Failed to create player user: %v", err)
-			if err.Error() == "username already exists" {
-				http.Error(w, "Username already exists", http.StatusConflict)
-			} else {
-				http.Error(w, "Failed to create user", http.StatusInternalServerError)
-			}
+		// Failures are counted per IP only: they are about guessing tokens,
+		// not a particular account.
+		ip := session.ClientIP(r)
+		if wait, err := guard.Check(r.Context(), ip, ""); err != nil {
+			log.Printf("Failed to check registration attempts: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		} else if wait > 0 {
+			ratelimit.WriteTooManyAttempts(w, wait)
 			return
 		}
 
-		_, err = tokenRepo.ValidateAndUseToken(r.Context(), req.Token, newUser.ID)
-		if err != nil {
-			if deleteErr := userRepo.DeleteUser(r.Context(), newUser.ID); deleteErr != nil {
-				log.Printf("Failed to delete user after token validation failure: %v", deleteErr)
+		newUser, err := userRepo.RegisterPlayer(r.Context(), req.Username, req.Password, req.Token)
+		if isTokenError(err) {
+			if wait, failErr := guard.Fail(r.Context(), ip, ""); failErr != nil {
+				log.Printf("Failed to record registration attempt: %v", failErr)
+			} else if wait > 0 {
+				ratelimit.WriteTooManyAttempts(w, wait)
+				return
 			}
 
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+			apierror.Write(w, err)
+			return
+		}
+		if writePasswordPolicyError(w, err) {
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, ErrUsernameTaken) {
+				log.Printf("Failed to create player user: %v", err)
+			}
+			apierror.Write(w, err)
 			return
 		}
 
+		meta := audit.Metadata{"username": newUser.Username, "role": newUser.Role}
+		if newUser.InvitedByID != nil {
+			meta["invitedBy"] = newUser.InvitedByID
+		}
+		auditLog.RecordAs(r, &newUser.ID, audit.ActionPlayerRegister, audit.Target{Type: audit.TargetUser, ID: newUser.ID.String()}, meta)
+
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(map[string]string{
 			"message": "User registered successfully",
@@ -178,39 +515,100 @@ func RegisterPlayerHandler(userRepo *Repository, tokenRepo *token.Repository) ht
 	}
 }
 
+func isTokenError(err error) bool {
+	return errors.Is(err, token.ErrTokenNotFound) || errors.Is(err, token.ErrTokenExpired) ||
+		errors.Is(err, token.ErrTokenRevoked) || errors.Is(err, token.ErrTokenExhausted)
+}
+
+// writePasswordPolicyError answers 400 with the reason if err is a password
+// refused by the policy, and reports whether it did.
+func writePasswordPolicyError(w http.ResponseWriter, err error) bool {
+	var policyErr *password.PolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	apierror.Write(w, apierror.New(http.StatusBadRequest, "password_policy", policyErr.Message))
+	return true
+}
+
+// ListPlayersHandler returns one page of players, newest first. The query
+// can filter by status (active, disabled), creator (the username of the
+// admin who made their token), creation date (from, to) and search (part of
+// the username); the cursor of the next page is in the X-Next-Cursor
+// header.
 func ListPlayersHandler(userRepo *Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-
-		players, err := userRepo.GetAllPlayers(r.Context())
+		page, err := listing.PageFromRequest(r)
 		if err != nil {
-			log.Printf("Error al listar jugadores: %v", err)
-			http.Error(w, "Error interno al obtener la lista de jugadores.", http.StatusInternalServerError)
+			apierror.Write(w, apierror.BadRequest(err.Error()))
+			return
+		}
+		created, err := listing.DateRangeFromRequest(r)
+		if err != nil {
+			apierror.Write(w, apierror.BadRequest(err.Error()))
+			return
+		}
+		query := r.URL.Query()
+		filter := PlayerFilter{
+			Status:  query.Get("status"),
+			Search:  strings.TrimSpace(query.Get("search")),
+			Created: created,
+		}
+		if filter.Status != "" && filter.Status != PlayerStatusActive && filter.Status != PlayerStatusDisabled {
+			apierror.Write(w, apierror.BadRequest("status must be active or disabled"))
 			return
 		}
 
+		var players []User
+		var next *listing.Cursor
+		creatorFound := true
+		if creator := strings.TrimSpace(query.Get("creator")); creator != "" {
+			creatorID, err := userRepo.GetUserIDByUsername(r.Context(), creator)
+			if err != nil {
+				log.Printf("Failed to look up creator %q: %v", creator, err)
+				apierror.Write(w, apierror.ErrInternal)
+				return
+			}
+			creatorFound = creatorID != uuid.Nil
+			filter.InvitedByID = &creatorID
+		}
+		if creatorFound {
+			players, next, err = userRepo.ListPlayers(r.Context(), filter, page)
+			if err != nil {
+				log.Printf("Failed to list players: %v", err)
+				apierror.Write(w, apierror.ErrInternal)
+				return
+			}
+		}
+
+		listing.WriteNext(w, next)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 
 		// DTO para la respuesta JSON
 		type PlayerDTO struct {
-			ID        uuid.UUID `json:"ID"`
-			Username  string    `json:"Username"`
-			Role      string    `json:"Role"`
-			CreatedAt time.Time `json:"CreatedAt"`
+			ID          uuid.UUID `json:"ID"`
+			Username    string    `json:"Username"`
+			DisplayName string    `json:"DisplayName"`
+			Role        string    `json:"Role"`
+			Disabled    bool      `json:"Disabled"`
+			CreatedAt   time.Time `json:"CreatedAt"`
 		}
 
 		dtos := make([]PlayerDTO, len(players))
 		for i, p := range players {
 			dtos[i] = PlayerDTO{
-				ID:        p.ID,
-				Username:  p.Username,
-				Role:      p.Role,
-				CreatedAt: p.CreatedAt,
+				ID:          p.ID,
+				Username:    p.Username,
+				DisplayName: p.DisplayName,
+				Role:        p.Role,
+				Disabled:    p.IsDisabled(),
+				CreatedAt:   p.CreatedAt,
 			}
 		}
 
 		if err := json.NewEncoder(w).Encode(dtos); err != nil {
-			log.Printf("Error al codificar JSON de jugadores: %v", err)
+			log.Printf("Failed to encode players: %v", err)
 		}
 	}
 }
@@ -220,31 +618,66 @@ type PlayerLoginRequest struct {
 	Password string `json:"password"`
 }
 
-func PlayerLoginHandler(repo *Repository, playerSessionName string) http.HandlerFunc {
+func PlayerLoginHandler(repo *Repository, playerSessionName string, guard *ratelimit.Guard, auditLog *audit.Log) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req PlayerLoginRequest
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
+			return
+		}
+
+		ip := session.ClientIP(r)
+		if wait, err := guard.Check(r.Context(), ip, req.Username); err != nil {
+			log.Printf("Failed to check login attempts: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		} else if wait > 0 {
+			recordLoginFailure(r, auditLog, loginPortalPlayer, nil, req.Username, loginFailedThrottled)
+			ratelimit.WriteTooManyAttempts(w, wait)
 			return
 		}
 
 		user, err := repo.GetUserByUsername(r.Context(), req.Username)
 		if err != nil {
-			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+			log.Printf("Failed to get user %q: %v", req.Username, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		if user == nil || !repo.CheckPassword(r.Context(), user, req.Password) {
+			var userID *uuid.UUID
+			if user != nil {
+				userID = &user.ID
+			}
+			recordLoginFailure(r, auditLog, loginPortalPlayer, userID, req.Username, loginFailedPassword)
+			if wait, err := guard.Fail(r.Context(), ip, req.Username); err != nil {
+				log.Printf("Failed to record login attempt: %v", err)
+			} else if wait > 0 {
+				ratelimit.WriteTooManyAttempts(w, wait)
+				return
+			}
+			apierror.Write(w, ErrInvalidCredentials)
 			return
 		}
 
-		if !user.CheckPassword(req.Password) {
-			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		if err := guard.Succeed(r.Context(), req.Username); err != nil {
+			log.Printf("Failed to reset login attempts: %v", err)
+		}
+
+		if user.IsDisabled() {
+			recordLoginFailure(r, auditLog, loginPortalPlayer, &user.ID, req.Username, loginFailedDisabled)
+			apierror.Write(w, ErrUserDisabled)
 			return
 		}
 
 		if err := LoginPlayer(w, r, user.ID, playerSessionName); err != nil {
 			log.Printf("Failed to log in user: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			apierror.Write(w, apierror.ErrInternal)
 			return
 		}
+		auditLog.RecordAs(r, &user.ID, audit.ActionLogin, audit.Target{Type: audit.TargetUser, ID: user.ID.String()},
+			audit.Metadata{"portal": loginPortalPlayer})
 
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -254,3 +687,364 @@ func PlayerLoginHandler(repo *Repository, playerSessionName string) http.Handler
 		})
 	}
 }
+
+// SessionRevoker ends all of a user's sessions.
+type SessionRevoker interface {
+	RevokeUserSessions(ctx context.Context, userID uuid.UUID) (int64, error)
+}
+
+// targetUserID reads the user a request acts on and refuses requests where
+// an admin would act on their own account.
+func targetUserID(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	userID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		apierror.Write(w, apierror.BadRequest("Invalid user ID"))
+		return uuid.Nil, false
+	}
+
+	if adminID, _ := contextutil.GetUserIDFromContext(r.Context()); adminID == userID {
+		apierror.Write(w, apierror.BadRequest("You cannot do this to your own account"))
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// SetUserDisabledHandler disables or re-enables a user. Disabling also ends
+// every session the user has open.
+func SetUserDisabledHandler(repo *Repository, sessions SessionRevoker, disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := targetUserID(w, r)
+		if !ok {
+			return
+		}
+
+		if err := repo.SetDisabled(r.Context(), userID, disabled); err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				apierror.Write(w, apierror.NotFound("User not found"))
+				return
+			}
+			log.Printf("Failed to update user %s: %v", userID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		message := "User enabled successfully"
+		if disabled {
+			message = "User disabled successfully"
+			if _, err := sessions.RevokeUserSessions(r.Context(), userID); err != nil {
+				log.Printf("Failed to revoke sessions of user %s: %v", userID, err)
+				apierror.Write(w, apierror.ErrInternal)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": message})
+	}
+}
+
+// DeleteUserHandler soft-deletes a user and ends every session they have
+// open. The user can no longer log in, but their characters and journals are
+// kept for the records.
+func DeleteUserHandler(repo *Repository, sessions SessionRevoker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := targetUserID(w, r)
+		if !ok {
+			return
+		}
+
+		if err := repo.DeleteUser(r.Context(), userID); err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				apierror.Write(w, apierror.NotFound("User not found"))
+				return
+			}
+			log.Printf("Failed to delete user %s: %v", userID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		if _, err := sessions.RevokeUserSessions(r.Context(), userID); err != nil {
+			log.Printf("Failed to revoke sessions of user %s: %v", userID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type RoleDTO struct {
+	Role        string       `json:"Role"`
+	Permissions []Permission `json:"Permissions"`
+}
+
+func ListRolesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dtos := make([]RoleDTO, len(Roles))
+		for i, role := range Roles {
+			dtos[i] = RoleDTO{Role: role, Permissions: RolePermissions(role)}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(dtos); err != nil {
+			log.Printf("Error encoding roles to JSON: %v", err)
+		}
+	}
+}
+
+type UserDTO struct {
+	ID        uuid.UUID `json:"ID"`
+	Username  string    `json:"Username"`
+	Role      string    `json:"Role"`
+	Disabled  bool      `json:"Disabled"`
+	TwoFactor bool      `json:"TwoFactor"`
+	CreatedAt time.Time `json:"CreatedAt"`
+}
+
+func ListUsersHandler(userRepo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users, err := userRepo.GetAllUsers(r.Context())
+		if err != nil {
+			log.Printf("Error listing users: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		dtos := make([]UserDTO, len(users))
+		for i, u := range users {
+			dtos[i] = UserDTO{
+				ID:        u.ID,
+				Username:  u.Username,
+				Role:      u.Role,
+				Disabled:  u.IsDisabled(),
+				TwoFactor: u.HasTOTP(),
+				CreatedAt: u.CreatedAt,
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(dtos); err != nil {
+			log.Printf("Error encoding users to JSON: %v", err)
+		}
+	}
+}
+
+type setRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// SetUserRoleHandler assigns a role to a user. Admins cannot change their
+// own role, so there is always an owner left to manage the others.
+func SetUserRoleHandler(userRepo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := targetUserID(w, r)
+		if !ok {
+			return
+		}
+
+		var req setRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
+			return
+		}
+		if !IsValidRole(req.Role) {
+			apierror.Write(w, apierror.BadRequest("Invalid role"))
+			return
+		}
+
+		if err := userRepo.SetRole(r.Context(), userID, req.Role); err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				apierror.Write(w, apierror.NotFound("User not found"))
+				return
+			}
+			log.Printf("Failed to set role of user %s: %v", userID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Role updated successfully",
+			"role":    req.Role,
+		})
+	}
+}
+
+type createUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// CreateUserHandler adds a staff account. Without a password the user is
+// invited instead: the response carries a one-time link to set one.
+func CreateUserHandler(userRepo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminID, ok := contextutil.GetUserIDFromContext(r.Context())
+		if !ok || adminID == uuid.Nil {
+			apierror.Write(w, apierror.Unauthorized("Unauthorized"))
+			return
+		}
+
+		var req createUserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
+			return
+		}
+		if req.Username == "" {
+			apierror.Write(w, apierror.BadRequest("Username is required"))
+			return
+		}
+		if !IsValidRole(req.Role) || req.Role == RolePlayer {
+			apierror.Write(w, apierror.BadRequest("Role must be owner, game_master or author"))
+			return
+		}
+
+		var newUser *User
+		var err error
+		if req.Password != "" {
+			newUser, err = userRepo.CreateUser(r.Context(), req.Username, req.Password, req.Role)
+		} else {
+			newUser, err = userRepo.CreateInvitedUser(r.Context(), req.Username, req.Role)
+		}
+		if writePasswordPolicyError(w, err) {
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, ErrUsernameTaken) {
+				log.Printf("Failed to create user: %v", err)
+			}
+			apierror.Write(w, err)
+			return
+		}
+
+		response := map[string]string{
+			"message": "User created successfully",
+			"userId":  newUser.ID.String(),
+		}
+		if req.Password == "" {
+			token, err := userRepo.CreatePasswordReset(r.Context(), newUser.ID, adminID, false)
+			if err != nil {
+				log.Printf("Failed to create invite link for user %s: %v", newUser.ID, err)
+				apierror.Write(w, apierror.ErrInternal)
+				return
+			}
+			response["message"] = "User invited successfully"
+			response["inviteLink"] = passwordResetLink(r, token)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// passwordResetLink builds the absolute link to the password reset page, so
+// admins can hand it over as is.
+func passwordResetLink(r *http.Request, token string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/password/reset?token=%s", scheme, r.Host, url.QueryEscape(token))
+}
+
+// ForcePasswordResetHandler makes the user's current password stop working,
+// logs them out everywhere and returns a one-time link to set a new one.
+func ForcePasswordResetHandler(userRepo *Repository, sessions SessionRevoker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminID, _ := contextutil.GetUserIDFromContext(r.Context())
+		userID, ok := targetUserID(w, r)
+		if !ok {
+			return
+		}
+
+		token, err := userRepo.CreatePasswordReset(r.Context(), userID, adminID, true)
+		if err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				apierror.Write(w, apierror.NotFound("User not found"))
+				return
+			}
+			log.Printf("Failed to create password reset for user %s: %v", userID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		if _, err := sessions.RevokeUserSessions(r.Context(), userID); err != nil {
+			log.Printf("Failed to revoke sessions of user %s: %v", userID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"message":   "Password reset link created successfully",
+			"resetLink": passwordResetLink(r, token),
+			"expiresAt": time.Now().Add(PasswordResetLifetime),
+		})
+	}
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ResetPasswordHandler sets a new password from a reset link. Sessions
+// opened before the reset are ended.
+func ResetPasswordHandler(userRepo *Repository, sessions SessionRevoker, guard *ratelimit.Guard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req resetPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, apierror.BadRequest("Invalid request payload"))
+			return
+		}
+		if req.Token == "" || req.Password == "" {
+			apierror.Write(w, apierror.BadRequest("Token and password are required"))
+			return
+		}
+
+		ip := session.ClientIP(r)
+		if wait, err := guard.Check(r.Context(), ip, ""); err != nil {
+			log.Printf("Failed to check password reset attempts: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		} else if wait > 0 {
+			ratelimit.WriteTooManyAttempts(w, wait)
+			return
+		}
+
+		userID, err := userRepo.ResetPassword(r.Context(), req.Token, req.Password)
+		if err != nil {
+			if errors.Is(err, ErrResetTokenInvalid) {
+				if wait, failErr := guard.Fail(r.Context(), ip, ""); failErr != nil {
+					log.Printf("Failed to record password reset attempt: %v", failErr)
+				} else if wait > 0 {
+					ratelimit.WriteTooManyAttempts(w, wait)
+					return
+				}
+				apierror.Write(w, err)
+				return
+			}
+			if writePasswordPolicyError(w, err) {
+				return
+			}
+			log.Printf("Failed to reset password: %v", err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		if _, err := sessions.RevokeUserSessions(r.Context(), userID); err != nil {
+			log.Printf("Failed to revoke sessions of user %s: %v", userID, err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Password updated successfully"})
+	}
+}
@@ -4,17 +4,23 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/nicolas-camacho/thrg/internal/password"
 	"gorm.io/gorm"
 )
 
 const (
-	RoleAdmin  = "admin"
-	RolePlayer = "player"
+	RoleOwner      = "owner"
+	RoleGameMaster = "game_master"
+	RoleAuthor     = "author"
+	RolePlayer     = "player"
+
+	// RoleAdmin is the role admins had before fine-grained roles existed.
+	// MigrateLegacyRoles turns it into RoleOwner.
+	RoleAdmin = "admin"
 )
 
 type UserModelBase struct {
-	ID        uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
@@ -25,18 +31,92 @@ type User struct {
 	Username     string `gorm:"uniqueIndex;not null"`
 	PasswordHash string `gorm:"not null"`
 	Role         string `gorm:"default:player"`
+	DisabledAt   *time.Time
+
+	// DisplayName is the name players choose to be shown by. It is empty
+	// until they set one; Name falls back to the username.
+	DisplayName string
+
+	// OIDCIssuer and OIDCSubject link the user to an account at the OIDC
+	// provider. They are nil for users who only log in with a password.
+	OIDCIssuer  *string `gorm:"column:oidc_issuer;uniqueIndex:idx_users_oidc_identity"`
+	OIDCSubject *string `gorm:"column:oidc_subject;uniqueIndex:idx_users_oidc_identity"`
+
+	// InvitedByID is the admin who created the registration token the user
+	// signed up with.
+	InvitedByID *uuid.UUID `gorm:"type:uuid;index"`
+
+	// TOTPSecret is set when the user starts enrolling in two-factor
+	// authentication; it only protects the account once TOTPEnabledAt is
+	// set. TOTPLastStep is the last time step accepted, so a code cannot be
+	// used twice.
+	TOTPSecret    string
+	TOTPEnabledAt *time.Time
+	TOTPLastStep  int64
+}
+
+// Name is how the user is shown to others.
+func (u *User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
+}
+
+func (u *User) HasTOTP() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// RecoveryCode lets a user log in once without their authenticator app.
+type RecoveryCode struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
+	CreatedAt time.Time
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index"`
+	CodeHash  string    `gorm:"not null"`
+	UsedAt    *time.Time
+}
+
+// PasswordReset is a one-time link an admin hands to a user so they can set
+// a new password. Only the hash of the token is stored.
+type PasswordReset struct {
+	ID          uuid.UUID `gorm:"type:uuid;primaryKey"`
+	CreatedAt   time.Time
+	UserID      uuid.UUID `gorm:"type:uuid;not null;index"`
+	CreatedByID uuid.UUID `gorm:"type:uuid;not null"`
+	TokenHash   string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt   time.Time `gorm:"not null"`
+	UsedAt      *time.Time
+}
+
+func (u *User) IsDisabled() bool {
+	return u.DisabledAt != nil
 }
 
-func (u *User) SetPassword(password string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// unusablePasswordHash never matches a password; it is set for invited
+// users and for users whose password was reset by an admin.
+const unusablePasswordHash = "!"
+
+// PasswordPolicy and PasswordHasher are set from the environment by main.
+var (
+	PasswordPolicy = password.DefaultPolicy
+	PasswordHasher = password.DefaultHasher
+)
+
+// SetPassword checks the new password against PasswordPolicy, so set
+// Username first, and hashes it. A refused password is returned as a
+// *password.PolicyError.
+func (u *User) SetPassword(newPassword string) error {
+	if err := PasswordPolicy.Validate(newPassword, u.Username); err != nil {
+		return err
+	}
+	hash, err := PasswordHasher.Hash(newPassword)
 	if err != nil {
 		return err
 	}
-	u.PasswordHash = string(hash)
+	u.PasswordHash = hash
 	return nil
 }
 
 func (u *User) CheckPassword(password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password))
-	return err == nil
+	return PasswordHasher.Verify(u.PasswordHash, password)
 }
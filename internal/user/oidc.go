@@ -0,0 +1,332 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/apierror"
+	"github.com/nicolas-camacho/thrg/internal/audit"
+	"github.com/nicolas-camacho/thrg/internal/oidc"
+	"github.com/nicolas-camacho/thrg/internal/ratelimit"
+)
+
+// OIDC is the provider admins can log in with. It is set by main and nil
+// when OIDC login is off.
+var OIDC *oidc.Provider
+
+const (
+	// The keys below hold an OIDC login between leaving for the provider
+	// and coming back to the callback. oidcLinkUserKey is set when the flow
+	// links the account of a logged-in admin instead of logging in.
+	oidcStateKey     = "oidc_state"
+	oidcNonceKey     = "oidc_nonce"
+	oidcVerifierKey  = "oidc_verifier"
+	oidcSinceKey     = "oidc_since"
+	oidcLinkUserKey  = "oidc_link_user_id"
+	oidcFlowLifetime = 10 * time.Minute
+)
+
+type oidcFlow struct {
+	nonce      string
+	verifier   string
+	linkUserID uuid.UUID
+}
+
+// startOIDCFlow remembers a new flow in the admin session and returns the
+// provider URL to send the user to.
+func startOIDCFlow(w http.ResponseWriter, r *http.Request, linkUserID uuid.UUID) (string, error) {
+	var state, nonce, verifier string
+	for _, v := range []*string{&state, &nonce, &verifier} {
+		value, err := oidc.RandomValue()
+		if err != nil {
+			return "", err
+		}
+		*v = value
+	}
+	authURL, err := OIDC.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		return "", err
+	}
+
+	session, err := Store.Get(r, SessionName)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving session: %w", err)
+	}
+	session.Values[oidcStateKey] = state
+	session.Values[oidcNonceKey] = nonce
+	session.Values[oidcVerifierKey] = verifier
+	session.Values[oidcSinceKey] = time.Now().Unix()
+	session.Values[oidcLinkUserKey] = linkUserID
+	if err := session.Save(r, w); err != nil {
+		return "", fmt.Errorf("error saving session: %w", err)
+	}
+	return authURL, nil
+}
+
+// takeOIDCFlow returns the flow the callback belongs to and forgets it, so a
+// callback works once. It fails if the state does not match or the flow
+// took too long.
+func takeOIDCFlow(w http.ResponseWriter, r *http.Request) (oidcFlow, bool) {
+	session, err := Store.Get(r, SessionName)
+	if err != nil {
+		return oidcFlow{}, false
+	}
+	state, _ := session.Values[oidcStateKey].(string)
+	since, _ := session.Values[oidcSinceKey].(int64)
+	flow := oidcFlow{}
+	flow.nonce, _ = session.Values[oidcNonceKey].(string)
+	flow.verifier, _ = session.Values[oidcVerifierKey].(string)
+	flow.linkUserID, _ = session.Values[oidcLinkUserKey].(uuid.UUID)
+
+	if state == "" {
+		return oidcFlow{}, false
+	}
+	for _, key := range []string{oidcStateKey, oidcNonceKey, oidcVerifierKey, oidcSinceKey, oidcLinkUserKey} {
+		delete(session.Values, key)
+	}
+	if err := session.Save(r, w); err != nil {
+		log.Printf("Failed to clear OIDC login: %v", err)
+	}
+
+	if r.URL.Query().Get("state") != state || time.Since(time.Unix(since, 0)) > oidcFlowLifetime {
+		return oidcFlow{}, false
+	}
+	return flow, true
+}
+
+// OIDCLoginHandler sends the admin to the provider to log in.
+func OIDCLoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authURL, err := startOIDCFlow(w, r, uuid.Nil)
+		if err != nil {
+			log.Printf("Failed to start OIDC login: %v", err)
+			renderLogin(w, r, http.StatusBadGateway, LoginPageData{Error: OIDC.Name() + " is not available, please try again later"})
+			return
+		}
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+// OIDCCallbackHandler is where the provider sends the admin back. The ID
+// token is verified and the admin logged in as the user linked to their
+// subject.
+//
+// When the provider maps roles, an unknown subject with a role gets a new
+// user, and the role of known ones follows the provider. The provider only
+// stands in for the password: admins still go through the two-factor step.
+func OIDCCallbackHandler(repo *Repository, guard *ratelimit.Guard, require2FA bool, auditLog *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flow, ok := takeOIDCFlow(w, r)
+		if !ok {
+			renderLogin(w, r, http.StatusBadRequest, LoginPageData{Error: "Your login has expired, please log in again"})
+			return
+		}
+		if providerErr := r.URL.Query().Get("error"); providerErr != "" {
+			log.Printf("OIDC provider returned an error: %s %s", providerErr, r.URL.Query().Get("error_description"))
+			recordLoginFailure(r, auditLog, loginPortalAdmin, nil, "", loginFailedOIDC)
+			renderLogin(w, r, http.StatusUnauthorized, LoginPageData{Error: OIDC.Name() + " did not log you in"})
+			return
+		}
+
+		identity, err := OIDC.Exchange(r.Context(), r.URL.Query().Get("code"), flow.verifier, flow.nonce)
+		if err != nil {
+			log.Printf("OIDC login failed: %v", err)
+			recordLoginFailure(r, auditLog, loginPortalAdmin, nil, "", loginFailedOIDC)
+			renderLogin(w, r, http.StatusUnauthorized, LoginPageData{Error: "Could not verify your identity with " + OIDC.Name()})
+			return
+		}
+
+		if flow.linkUserID != uuid.Nil {
+			linkOIDCAccount(w, r, repo, auditLog, flow.linkUserID, identity)
+			return
+		}
+
+		user, message, err := oidcUser(r, repo, identity)
+		if err != nil {
+			log.Printf("Failed to find user for OIDC subject %s: %v", identity.Subject, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			recordLoginFailure(r, auditLog, loginPortalAdmin, nil, identity.Username, loginFailedNotLinked)
+			renderLogin(w, r, http.StatusForbidden, LoginPageData{Error: message})
+			return
+		}
+		if user.IsDisabled() {
+			recordLoginFailure(r, auditLog, loginPortalAdmin, &user.ID, user.Username, loginFailedDisabled)
+			renderLogin(w, r, http.StatusForbidden, LoginPageData{Error: "This account has been disabled"})
+			return
+		}
+		if !HasPermission(user.Role, PermDashboardView) {
+			recordLoginFailure(r, auditLog, loginPortalAdmin, &user.ID, user.Username, loginFailedForbidden)
+			renderLogin(w, r, http.StatusForbidden, LoginPageData{Error: "Access denied, admin only"})
+			return
+		}
+
+		continueAdminLogin(w, r, repo, guard, user, require2FA, auditLog, loginMethodOIDC)
+	}
+}
+
+// oidcUser finds or creates the user behind an identity and applies the
+// provider's role. A nil user comes with the reason to show instead.
+func oidcUser(r *http.Request, repo *Repository, identity *oidc.Identity) (*User, string, error) {
+	const notLinked = "This account is not linked to any user here. Log in with your password and link it from the dashboard."
+
+	user, err := repo.GetUserByOIDC(r.Context(), identity.Issuer, identity.Subject)
+	if err != nil {
+		return nil, "", err
+	}
+	if !OIDC.MapsRoles() {
+		if user == nil {
+			return nil, notLinked, nil
+		}
+		return user, "", nil
+	}
+
+	role := oidcRole(identity)
+	if role == "" {
+		if user == nil {
+			return nil, notLinked, nil
+		}
+		return nil, "Your account at " + OIDC.Name() + " has no role in this application", nil
+	}
+	if user == nil {
+		if identity.Username == "" {
+			return nil, OIDC.Name() + " did not give a username for your account", nil
+		}
+		user, err = repo.CreateOIDCUser(r.Context(), identity.Username, role, identity.Issuer, identity.Subject)
+		if errors.Is(err, ErrUsernameTaken) {
+			return nil, fmt.Sprintf("The username %q is already taken. Log in with your password and link your account from the dashboard.", identity.Username), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		log.Printf("Created user %s (%s) for OIDC subject %s", user.Username, role, identity.Subject)
+		return user, "", nil
+	}
+	if user.Role != role {
+		if err := repo.SetRole(r.Context(), user.ID, role); err != nil {
+			return nil, "", err
+		}
+		log.Printf("Role of %s changed from %s to %s by the OIDC provider", user.Username, user.Role, role)
+		user.Role = role
+	}
+	return user, "", nil
+}
+
+// oidcRole is the most privileged role the provider gives, or "" if it
+// gives none.
+func oidcRole(identity *oidc.Identity) string {
+	for _, role := range Roles {
+		if slices.Contains(identity.Roles, role) {
+			return role
+		}
+	}
+	return ""
+}
+
+// linkOIDCAccount ends a linking flow: the account at the provider is linked
+// to the admin who started it, if they are still logged in. The dashboard
+// shows the outcome from the oidc query parameter.
+func linkOIDCAccount(w http.ResponseWriter, r *http.Request, repo *Repository, auditLog *audit.Log, userID uuid.UUID, identity *oidc.Identity) {
+	session, err := Store.Get(r, SessionName)
+	if loggedIn, _ := session.Values[userKey].(uuid.UUID); err != nil || loggedIn != userID {
+		renderLogin(w, r, http.StatusUnauthorized, LoginPageData{Error: "Your login has expired, please log in again"})
+		return
+	}
+
+	outcome := "linked"
+	err = repo.LinkOIDC(r.Context(), userID, identity.Issuer, identity.Subject)
+	switch {
+	case errors.Is(err, ErrOIDCAlreadyLinked):
+		outcome = "taken"
+	case err != nil:
+		log.Printf("Failed to link OIDC account of user %s: %v", userID, err)
+		outcome = "failed"
+	default:
+		auditLog.Record(r, audit.ActionOIDCLink, audit.Target{Type: audit.TargetUser, ID: userID.String()},
+			audit.Metadata{"issuer": identity.Issuer, "subject": identity.Subject})
+	}
+	http.Redirect(w, r, "/admin/dashboard?oidc="+outcome, http.StatusSeeOther)
+}
+
+type OIDCStatusDTO struct {
+	Enabled  bool   `json:"enabled"`
+	Provider string `json:"provider"`
+	Linked   bool   `json:"linked"`
+}
+
+// OIDCStatusHandler tells the logged-in admin whether OIDC login is on and
+// their account linked.
+func OIDCStatusHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, repo)
+		if !ok {
+			return
+		}
+		status := OIDCStatusDTO{Enabled: OIDC != nil, Linked: user.OIDCSubject != nil}
+		if OIDC != nil {
+			status.Provider = OIDC.Name()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// LinkOIDCHandler starts linking the logged-in admin's account to the
+// provider. The response carries the URL to send them to.
+func LinkOIDCHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if OIDC == nil {
+			apierror.Write(w, apierror.New(http.StatusNotFound, "oidc_disabled", "OIDC login is not enabled"))
+			return
+		}
+		user, ok := currentUser(w, r, repo)
+		if !ok {
+			return
+		}
+		authURL, err := startOIDCFlow(w, r, user.ID)
+		if err != nil {
+			log.Printf("Failed to start OIDC linking: %v", err)
+			apierror.Write(w, apierror.New(http.StatusBadGateway, "oidc_unavailable", OIDC.Name()+" is not available, please try again later"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"url": authURL})
+	}
+}
+
+// UnlinkOIDCHandler removes the logged-in admin's link to the provider.
+func UnlinkOIDCHandler(repo *Repository, auditLog *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, repo)
+		if !ok {
+			return
+		}
+		err := repo.UnlinkOIDC(r.Context(), user.ID)
+		if errors.Is(err, ErrNoPassword) {
+			apierror.Write(w, err)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to unlink OIDC account of user %s: %v", user.ID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+		auditLog.Record(r, audit.ActionOIDCUnlink, audit.Target{Type: audit.TargetUser, ID: user.ID.String()}, nil)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "OIDC account unlinked"})
+	}
+}
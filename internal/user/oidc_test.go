@@ -0,0 +1,284 @@
+package user
+
+import (
+	"context"
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/audit"
+	"github.com/nicolas-camacho/thrg/internal/oidc"
+	"github.com/nicolas-camacho/thrg/internal/oidc/oidctest"
+	"github.com/nicolas-camacho/thrg/internal/ratelimit"
+	"github.com/nicolas-camacho/thrg/internal/session"
+	"github.com/nicolas-camacho/thrg/internal/totp"
+	"gorm.io/gorm"
+)
+
+const oidcTestRedirectURL = "http://thrg.test/admin/login/oidc/callback"
+
+// oidcTest is an admin linked to an account at a fake provider, and the
+// handlers of the admin login.
+type oidcTest struct {
+	db       *gorm.DB
+	repo     *Repository
+	provider *oidctest.Provider
+	admin    *User
+	guard    *ratelimit.Guard
+	auditLog *audit.Log
+}
+
+func newOIDCTest(t *testing.T) *oidcTest {
+	t.Helper()
+	gob.Register(uuid.UUID{})
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	provider := oidctest.NewProvider("thrg", "secret")
+	t.Cleanup(provider.Close)
+	provider.SetUser("subject-1", nil)
+
+	store, prevStore, prevOIDC := session.NewStore(session.NewMemoryBackend()), Store, OIDC
+	Store = store
+	OIDC = oidc.NewProvider(oidc.Config{
+		Issuer:       provider.Issuer(),
+		ClientID:     "thrg",
+		ClientSecret: "secret",
+		RedirectURL:  oidcTestRedirectURL,
+		Name:         "Test",
+	})
+	t.Cleanup(func() { Store, OIDC = prevStore, prevOIDC })
+
+	repo := NewRepository(db)
+	admin, err := repo.CreateUser(ctx, "owner", "Correct-horse-42", RoleOwner)
+	if err != nil {
+		t.Fatalf("create admin: %v", err)
+	}
+	if err := repo.LinkOIDC(ctx, admin.ID, provider.Issuer(), "subject-1"); err != nil {
+		t.Fatalf("link admin: %v", err)
+	}
+
+	return &oidcTest{
+		db:       db,
+		repo:     repo,
+		provider: provider,
+		admin:    admin,
+		guard:    ratelimit.NewGuard(ratelimit.NewMemoryStore(), "admin-login", ratelimit.IPPolicy, ratelimit.UsernamePolicy),
+		auditLog: audit.NewLog(db),
+	}
+}
+
+// start begins an OIDC login and returns the session cookies and the query
+// the provider sends the admin back with.
+func (ot *oidcTest) start(t *testing.T) ([]*http.Cookie, url.Values) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	OIDCLoginHandler()(rec, httptest.NewRequest(http.MethodGet, "/admin/login/oidc", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login returned %d, want a redirect to the provider", rec.Code)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(back.String(), oidcTestRedirectURL) {
+		t.Fatalf("provider redirected to %q, want the callback", resp.Header.Get("Location"))
+	}
+	return browserCookies(rec), back.Query()
+}
+
+func (ot *oidcTest) callback(t *testing.T, require2FA bool, cookies []*http.Cookie, query url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/admin/login/oidc/callback?"+query.Encode(), nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	OIDCCallbackHandler(ot.repo, ot.guard, require2FA, ot.auditLog)(rec, req)
+	return rec
+}
+
+// browserCookies returns the cookies the response leaves in the browser: when it
+// sets one more than once, the last value.
+func browserCookies(rec *httptest.ResponseRecorder) []*http.Cookie {
+	var kept []*http.Cookie
+	index := map[string]int{}
+	for _, c := range rec.Result().Cookies() {
+		if i, ok := index[c.Name]; ok {
+			kept[i] = c
+			continue
+		}
+		index[c.Name] = len(kept)
+		kept = append(kept, c)
+	}
+	return kept
+}
+
+// loggedIn returns the admin the response's session cookie is logged in
+// as, or uuid.Nil.
+func loggedIn(t *testing.T, rec *httptest.ResponseRecorder) uuid.UUID {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/admin/dashboard", nil)
+	for _, c := range browserCookies(rec) {
+		req.AddCookie(c)
+	}
+	session, err := Store.Get(req, SessionName)
+	if err != nil {
+		t.Fatalf("get session: %v", err)
+	}
+	userID, _ := session.Values[userKey].(uuid.UUID)
+	return userID
+}
+
+// loginMethod returns how the last login of the admin was made, as the
+// audit log recorded it.
+func (ot *oidcTest) loginMethod(t *testing.T) string {
+	t.Helper()
+	var event audit.Event
+	err := ot.db.Where("action = ? AND actor_id = ?", audit.ActionLogin, ot.admin.ID).Order("created_at DESC").First(&event).Error
+	if err != nil {
+		t.Fatalf("find login event: %v", err)
+	}
+	method, _ := event.Details()["method"].(string)
+	return method
+}
+
+func TestOIDCCallbackLogsIn(t *testing.T) {
+	ot := newOIDCTest(t)
+	cookies, query := ot.start(t)
+
+	rec := ot.callback(t, false, cookies, query)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/admin/dashboard" {
+		t.Fatalf("callback returned %d to %q, want 303 to the dashboard", rec.Code, rec.Header().Get("Location"))
+	}
+	if got := loggedIn(t, rec); got != ot.admin.ID {
+		t.Errorf("session is logged in as %s, want %s", got, ot.admin.ID)
+	}
+	if got := ot.loginMethod(t); got != loginMethodOIDC {
+		t.Errorf("login was recorded as %q, want %q", got, loginMethodOIDC)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(ot *oidcTest)
+		change func(t *testing.T, ot *oidcTest, query url.Values)
+		status int
+	}{
+		{
+			name:   "state mismatch",
+			change: func(_ *testing.T, _ *oidcTest, query url.Values) { query.Set("state", "another-state") },
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "code of another login",
+			change: func(t *testing.T, ot *oidcTest, query url.Values) {
+				_, other := ot.start(t)
+				query.Set("code", other.Get("code"))
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "provider error",
+			change: func(_ *testing.T, _ *oidcTest, query url.Values) {
+				query.Del("code")
+				query.Set("error", "access_denied")
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "unlinked account",
+			setup:  func(ot *oidcTest) { ot.provider.SetUser("subject-2", nil) },
+			status: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ot := newOIDCTest(t)
+			if tt.setup != nil {
+				tt.setup(ot)
+			}
+			cookies, query := ot.start(t)
+			if tt.change != nil {
+				tt.change(t, ot, query)
+			}
+
+			rec := ot.callback(t, false, cookies, query)
+			if rec.Code != tt.status {
+				t.Errorf("callback returned %d, want %d", rec.Code, tt.status)
+			}
+			if got := loggedIn(t, rec); got != uuid.Nil {
+				t.Errorf("session is logged in as %s", got)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackAsksForSecondFactor(t *testing.T) {
+	ot := newOIDCTest(t)
+	ctx := context.Background()
+	secret, err := ot.repo.BeginTOTPEnrollment(ctx, ot.admin.ID)
+	if err != nil {
+		t.Fatalf("begin TOTP enrollment: %v", err)
+	}
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatalf("generate code: %v", err)
+	}
+	recoveryCodes, err := ot.repo.EnableTOTP(ctx, ot.admin.ID, code)
+	if err != nil {
+		t.Fatalf("enable TOTP: %v", err)
+	}
+
+	cookies, query := ot.start(t)
+	rec := ot.callback(t, false, cookies, query)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `name="step" value="totp"`) {
+		t.Fatalf("callback returned %d without the code step", rec.Code)
+	}
+	if got := loggedIn(t, rec); got != uuid.Nil {
+		t.Fatalf("session is logged in as %s before the second factor", got)
+	}
+
+	form := url.Values{"step": {loginStepTOTP}, "code": {recoveryCodes[0]}}
+	req := httptest.NewRequest(http.MethodPost, "/admin/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range browserCookies(rec) {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	ServeLoginPageHandler(ot.repo, ot.guard, false, ot.auditLog)(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("code step returned %d, want 303", rec.Code)
+	}
+	if got := loggedIn(t, rec); got != ot.admin.ID {
+		t.Errorf("session is logged in as %s, want %s", got, ot.admin.ID)
+	}
+	if got := ot.loginMethod(t); got != loginMethodOIDC {
+		t.Errorf("login was recorded as %q, want %q", got, loginMethodOIDC)
+	}
+}
+
+func TestOIDCCallbackRequiresEnrollment(t *testing.T) {
+	ot := newOIDCTest(t)
+	cookies, query := ot.start(t)
+
+	rec := ot.callback(t, true, cookies, query)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `name="step" value="enroll"`) {
+		t.Fatalf("callback returned %d without the enrollment step", rec.Code)
+	}
+	if got := loggedIn(t, rec); got != uuid.Nil {
+		t.Errorf("session is logged in as %s before setting up two-factor authentication", got)
+	}
+}
@@ -0,0 +1,109 @@
+package user
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/apierror"
+	"github.com/nicolas-camacho/thrg/internal/apitoken"
+	"github.com/nicolas-camacho/thrg/internal/contextutil"
+)
+
+// Permission names an action a role may perform.
+type Permission string
+
+const (
+	PermDashboardView      Permission = "dashboard:view"
+	PermTokensCreate       Permission = "tokens:create"
+	PermPlayersView        Permission = "players:view"
+	PermStoriesView        Permission = "stories:view"
+	PermStoriesImport      Permission = "stories:import"
+	PermStoriesEdit        Permission = "stories:edit"
+	PermCharactersOverride Permission = "characters:override"
+	PermUsersManage        Permission = "users:manage"
+	PermAuditView          Permission = "audit:view"
+	PermGamePlay           Permission = "game:play"
+)
+
+// rolePermissions maps each role to what it may do. Roles not listed here
+// have no permissions.
+var rolePermissions = map[string][]Permission{
+	RoleOwner: {
+		PermDashboardView, PermTokensCreate, PermPlayersView, PermStoriesView, PermStoriesImport,
+		PermStoriesEdit, PermCharactersOverride, PermUsersManage, PermAuditView, PermGamePlay,
+	},
+	RoleGameMaster: {
+		PermDashboardView, PermTokensCreate, PermPlayersView, PermStoriesView,
+		PermCharactersOverride, PermGamePlay,
+	},
+	RoleAuthor: {
+		PermDashboardView, PermStoriesView, PermStoriesImport, PermStoriesEdit, PermGamePlay,
+	},
+	RolePlayer: {
+		PermGamePlay,
+	},
+}
+
+// Roles lists the assignable roles, most privileged first.
+var Roles = []string{RoleOwner, RoleGameMaster, RoleAuthor, RolePlayer}
+
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func RolePermissions(role string) []Permission {
+	return rolePermissions[role]
+}
+
+func HasPermission(role string, perm Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleLookup returns a user's current role, or "" if the user does not exist
+// or is disabled.
+type RoleLookup interface {
+	GetActiveUserRole(ctx context.Context, userID uuid.UUID) (string, error)
+}
+
+// RequirePermission only lets through users whose role has perm. It must run
+// after an auth middleware has put the user ID in the context. The role is
+// read on every request so role changes apply immediately. Requests made
+// with an access token also need perm among the token's scopes.
+func RequirePermission(roles RoleLookup, perm Permission) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := contextutil.GetUserIDFromContext(r.Context())
+			if !ok || userID == uuid.Nil {
+				apierror.Write(w, apierror.Unauthorized("Unauthorized"))
+				return
+			}
+
+			role, err := roles.GetActiveUserRole(r.Context(), userID)
+			if err != nil {
+				log.Printf("Failed to look up role of user %s: %v", userID, err)
+				apierror.Write(w, apierror.ErrInternal)
+				return
+			}
+
+			if !HasPermission(role, perm) {
+				apierror.Write(w, apierror.Forbidden("Forbidden"))
+				return
+			}
+			if token, ok := apitoken.FromContext(r.Context()); ok && !token.HasScope(string(perm)) {
+				apierror.Write(w, apierror.New(http.StatusForbidden, "insufficient_scope", "Forbidden: token lacks the "+string(perm)+" scope").
+					WithDetail("scope", string(perm)))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
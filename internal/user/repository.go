@@ -2,16 +2,59 @@ package user
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/apitoken"
+	"github.com/nicolas-camacho/thrg/internal/character"
 	"github.com/nicolas-camacho/thrg/internal/core"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/nicolas-camacho/thrg/internal/dberr"
+	"github.com/nicolas-camacho/thrg/internal/listing"
+	"github.com/nicolas-camacho/thrg/internal/story"
+	"github.com/nicolas-camacho/thrg/internal/token"
+	"github.com/nicolas-camacho/thrg/internal/totp"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserDisabled = errors.New("user disabled")
+	// ErrInvalidCredentials is returned by Authenticate for an unknown
+	// username and for a wrong password alike, so callers cannot tell which.
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrUsernameTaken      = errors.New("username already exists")
+	// ErrWrongPassword is returned when a user confirming a change to their
+	// own account gives the wrong current password.
+	ErrWrongPassword = errors.New("wrong password")
+	// ErrResetTokenInvalid covers unknown, expired and already used
+	// password reset tokens alike.
+	ErrResetTokenInvalid = errors.New("invalid or expired password reset token")
+	// ErrOIDCAlreadyLinked is returned when linking an OIDC account that is
+	// linked to another user.
+	ErrOIDCAlreadyLinked = errors.New("this OIDC account is linked to another user")
+	ErrNoPassword        = errors.New("user has no password")
+
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnrolled    = errors.New("two-factor authentication enrollment has not been started")
+	ErrInvalidTOTPCode    = errors.New("invalid two-factor authentication code")
+)
+
+// recoveryCodeCount is how many recovery codes a user gets at a time.
+const recoveryCodeCount = 10
+
+// PasswordResetLifetime is how long a password reset link stays valid.
+const PasswordResetLifetime = 72 * time.Hour
+
 type UserRepositoryLookup interface {
 	GetUserByID(ctx context.Context, userID uuid.UUID) (*core.UserLookupModel, error)
 }
@@ -31,33 +74,93 @@ func NewUserRepositoryLookup(repo *Repository) UserRepositoryLookup {
 func (r *Repository) CheckAdminExists(ctx context.Context) (bool, error) {
 	var count int64
 
-	result := r.db.WithContext(ctx).Model(&User{}).Where("role = ?", RoleAdmin).Count(&count)
+	result := r.db.WithContext(ctx).Model(&User{}).Where("role IN ?", []string{RoleOwner, RoleAdmin}).Count(&count)
 	if result.Error != nil {
 		return false, fmt.Errorf("failed to check admin existence: %w", result.Error)
 	}
 	return count > 0, nil
 }
 
+// MigrateLegacyRoles gives the owner role to admins created before roles
+// existed.
+func (r *Repository) MigrateLegacyRoles(ctx context.Context) (int64, error) {
+	result := r.db.WithContext(ctx).Model(&User{}).Where("role = ?", RoleAdmin).Update("role", RoleOwner)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to migrate legacy roles: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+// BackfillInviters records who invited players registered before
+// InvitedByID existed, from the token they used. A token used several times
+// only remembers its last player, so earlier ones are left without an
+// inviter.
+func (r *Repository) BackfillInviters(ctx context.Context) (int64, error) {
+	result := r.db.WithContext(ctx).Model(&User{}).
+		Where("invited_by_id IS NULL").
+		Where("id IN (?)", r.db.Table("registration_tokens").Select("used_by_id")).
+		Update("invited_by_id", gorm.Expr(
+			"(SELECT created_by_id FROM registration_tokens WHERE registration_tokens.used_by_id = users.id ORDER BY created_at DESC LIMIT 1)",
+		))
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to backfill inviters: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
 func (r *Repository) Authenticate(ctx context.Context, username, password string) (*User, error) {
 	var user User
 	result := r.db.WithContext(ctx).Where("username = ?", username).First(&user)
 
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil, errors.New("user not found")
+			return nil, ErrInvalidCredentials
 		}
 
 		return nil, fmt.Errorf("failed to query user: %w", result.Error)
 	}
 
-	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
-	if err != nil {
-		return nil, errors.New("invalid password")
+	if !r.CheckPassword(ctx, &user, password) {
+		return nil, ErrInvalidCredentials
+	}
+
+	if user.IsDisabled() {
+		return nil, ErrUserDisabled
 	}
 
 	return &user, nil
 }
 
+// CheckPassword reports whether password is the user's. On a match, a hash
+// made with another algorithm or cost than PasswordHasher's is replaced by a
+// fresh one, so changing the hash settings upgrades accounts as they log in.
+// Failing to store the new hash is only logged.
+func (r *Repository) CheckPassword(ctx context.Context, user *User, password string) bool {
+	if !user.CheckPassword(password) {
+		return false
+	}
+	if !PasswordHasher.NeedsRehash(user.PasswordHash) {
+		return true
+	}
+
+	hash, err := PasswordHasher.Hash(password)
+	if err != nil {
+		log.Printf("Failed to rehash password of user %s: %v", user.ID, err)
+		return true
+	}
+	// Matching the old hash keeps a password changed meanwhile from being
+	// overwritten.
+	result := r.db.WithContext(ctx).Model(&User{}).
+		Where("id = ? AND password_hash = ?", user.ID, user.PasswordHash).
+		Update("password_hash", hash)
+	if result.Error != nil {
+		log.Printf("Failed to store rehashed password of user %s: %v", user.ID, result.Error)
+		return true
+	}
+	user.PasswordHash = hash
+	return true
+}
+
 func (r *Repository) CreateUser(ctx context.Context, username, password, role string) (*User, error) {
 	newUser := User{
 		Username: username,
@@ -68,23 +171,316 @@ func (r *Repository) CreateUser(ctx context.Context, username, password, role st
 		return nil, fmt.Errorf("failed to set password: %w", err)
 	}
 
-	result := r.db.WithContext(ctx).Create(&newUser)
-	if result.Error != nil {
-		if strings.Contains(result.Error.Error(), "UNIQUE constraint failed") {
-			return nil, errors.New("username already exists")
+	if err := r.db.WithContext(ctx).Create(&newUser).Error; err != nil {
+		return nil, userWriteError("failed to create user", err)
+	}
+	return &newUser, nil
+}
+
+// RegisterPlayer creates a player, spends one use of their registration
+// token and applies the token's invite (role, party and story) in a single
+// transaction: if any step fails nothing is written, so a refused token
+// leaves no user behind and a taken username does not use up the token.
+// Token errors are returned as the token package's sentinels.
+func (r *Repository) RegisterPlayer(ctx context.Context, username, password, tokenValue string) (*User, error) {
+	newUser := User{
+		UserModelBase: UserModelBase{ID: uuid.New()},
+		Username:      username,
+	}
+	if err := newUser.SetPassword(password); err != nil {
+		return nil, fmt.Errorf("failed to set password: %w", err)
+	}
+
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		invite, err := token.ConsumeToken(tx, tokenValue, newUser.ID)
+		if err != nil {
+			return err
+		}
+
+		newUser.Role = RolePlayer
+		newUser.InvitedByID = &invite.CreatedByID
+		if invite.Role != "" {
+			newUser.Role = invite.Role
+		}
+		if err := tx.Create(&newUser).Error; err != nil {
+			return userWriteError("failed to create user", err)
 		}
-		return nil, fmt.Errorf("failed to create user: %w", result.Error)
+
+		if invite.Party != "" {
+			if err := character.JoinPartyTx(tx, newUser.ID, invite.Party); err != nil {
+				return err
+			}
+		}
+		if invite.StoryID != nil {
+			firstAct, err := story.FirstActTx(tx, *invite.StoryID)
+			if err != nil {
+				return err
+			}
+			// The story may have lost its acts since the invite was made;
+			// the player then picks a story from the library instead.
+			if firstAct == nil {
+				log.Printf("Invite story %s has no acts; %s was not placed in it", *invite.StoryID, username)
+				return nil
+			}
+			if _, err := character.StartStoryTx(tx, newUser.ID, *invite.StoryID, firstAct.ID); errors.Is(err, character.ErrStoryDeleted) {
+				log.Printf("Invite story %s was deleted; %s was not placed in it", *invite.StoryID, username)
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return &newUser, nil
 }
 
+// CreateInvitedUser creates a user without a password. They set one through
+// a password reset link.
+func (r *Repository) CreateInvitedUser(ctx context.Context, username, role string) (*User, error) {
+	newUser := User{
+		Username:     username,
+		Role:         role,
+		PasswordHash: unusablePasswordHash,
+	}
+
+	if err := r.db.WithContext(ctx).Create(&newUser).Error; err != nil {
+		return nil, userWriteError("failed to create user", err)
+	}
+	return &newUser, nil
+}
+
+// CreatePasswordReset returns a new one-time reset token for the user. Any
+// earlier unused token for the user stops working. With invalidatePassword
+// the user's current password stops working too, forcing the reset.
+func (r *Repository) CreatePasswordReset(ctx context.Context, userID, createdByID uuid.UUID, invalidatePassword bool) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate reset token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if invalidatePassword {
+			result := tx.Model(&User{}).Where("id = ?", userID).Update("password_hash", unusablePasswordHash)
+			if result.Error != nil {
+				return fmt.Errorf("failed to invalidate password: %w", result.Error)
+			}
+			if result.RowsAffected == 0 {
+				return ErrUserNotFound
+			}
+		} else {
+			var count int64
+			if err := tx.Model(&User{}).Where("id = ?", userID).Count(&count).Error; err != nil {
+				return fmt.Errorf("failed to find user: %w", err)
+			}
+			if count == 0 {
+				return ErrUserNotFound
+			}
+		}
+
+		if err := tx.Model(&PasswordReset{}).
+			Where("user_id = ? AND used_at IS NULL", userID).
+			Update("expires_at", now).Error; err != nil {
+			return fmt.Errorf("failed to expire previous reset tokens: %w", err)
+		}
+
+		reset := PasswordReset{
+			UserID:      userID,
+			CreatedByID: createdByID,
+			TokenHash:   hashResetToken(token),
+			ExpiresAt:   now.Add(PasswordResetLifetime),
+		}
+		if err := tx.Create(&reset).Error; err != nil {
+			return fmt.Errorf("failed to create reset token: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ResetPassword sets a new password using a reset token and burns the
+// token. It returns the ID of the user whose password changed.
+func (r *Repository) ResetPassword(ctx context.Context, token, password string) (uuid.UUID, error) {
+	var userID uuid.UUID
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var reset PasswordReset
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashResetToken(token), time.Now()).
+			First(&reset)
+		if result.Error != nil {
+			if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+				return ErrResetTokenInvalid
+			}
+			return fmt.Errorf("failed to find reset token: %w", result.Error)
+		}
+
+		// The username is needed to check the password against the policy.
+		var u User
+		if err := tx.Select("username").Where("id = ?", reset.UserID).First(&u).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrResetTokenInvalid
+			}
+			return fmt.Errorf("failed to find user: %w", err)
+		}
+		if err := u.SetPassword(password); err != nil {
+			return fmt.Errorf("failed to set password: %w", err)
+		}
+		result = tx.Model(&User{}).Where("id = ?", reset.UserID).Update("password_hash", u.PasswordHash)
+		if result.Error != nil {
+			return fmt.Errorf("failed to update password: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrResetTokenInvalid
+		}
+
+		if err := tx.Model(&reset).Update("used_at", time.Now()).Error; err != nil {
+			return fmt.Errorf("failed to use reset token: %w", err)
+		}
+		userID = reset.UserID
+		return nil
+	})
+	return userID, err
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func (r *Repository) DeleteUser(ctx context.Context, userID uuid.UUID) error {
+	// Deleted users are only soft-deleted; their OIDC link is dropped so the
+	// account at the provider can be linked again.
+	if err := r.db.WithContext(ctx).Model(&User{}).Where("id = ?", userID).
+		Updates(map[string]any{"oidc_issuer": nil, "oidc_subject": nil}).Error; err != nil {
+		return fmt.Errorf("failed to unlink deleted user: %w", err)
+	}
 	result := r.db.WithContext(ctx).Delete(&User{}, userID)
 	if result.Error != nil {
 		return fmt.Errorf("failed to delete user: %w", result.Error)
 	}
 	if result.RowsAffected == 0 {
-		return fmt.Errorf("no user found with ID %d", userID)
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ChangePassword sets a new password for a user who knows their current
+// one.
+func (r *Repository) ChangePassword(ctx context.Context, userID uuid.UUID, currentPassword, newPassword string) error {
+	user, err := r.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrUserNotFound
+	}
+	if !r.CheckPassword(ctx, user, currentPassword) {
+		return ErrWrongPassword
+	}
+
+	if err := user.SetPassword(newPassword); err != nil {
+		return fmt.Errorf("failed to set password: %w", err)
+	}
+	result := r.db.WithContext(ctx).Model(&User{}).Where("id = ?", userID).Update("password_hash", user.PasswordHash)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update password: %w", result.Error)
+	}
+	return nil
+}
+
+// SetDisplayName changes the name a user is shown by. An empty name goes
+// back to the username.
+func (r *Repository) SetDisplayName(ctx context.Context, userID uuid.UUID, displayName string) error {
+	result := r.db.WithContext(ctx).Model(&User{}).Where("id = ?", userID).Update("display_name", displayName)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update display name: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// DeleteOwnAccount deletes the account of a user who confirmed it with
+// their password. Their personal data is wiped and the username freed, but
+// the user row is only soft-deleted and their characters, runs and journals
+// stay, now tied to an anonymous user, so story statistics and the audit log
+// keep adding up.
+func (r *Repository) DeleteOwnAccount(ctx context.Context, userID uuid.UUID, password string) error {
+	user, err := r.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrUserNotFound
+	}
+	if !user.CheckPassword(password) {
+		return ErrWrongPassword
+	}
+
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]any{
+			"username":        anonymousUsername(userID),
+			"display_name":    "",
+			"password_hash":   unusablePasswordHash,
+			"totp_secret":     "",
+			"totp_enabled_at": nil,
+			"deleted_at":      time.Now(),
+		})
+		if result.Error != nil {
+			return fmt.Errorf("failed to anonymize user: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrUserNotFound
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return fmt.Errorf("failed to delete recovery codes: %w", err)
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&PasswordReset{}).Error; err != nil {
+			return fmt.Errorf("failed to delete password resets: %w", err)
+		}
+		return character.AnonymizeTx(tx, userID)
+	})
+}
+
+// userWriteError turns a write that hit one of the users' unique indexes
+// into ErrUsernameTaken or ErrOIDCAlreadyLinked, and wraps any other error.
+func userWriteError(msg string, err error) error {
+	switch {
+	case dberr.Violates(err, "idx_users_username", "users.username"):
+		return ErrUsernameTaken
+	case dberr.Violates(err, "idx_users_oidc_identity", "users.oidc_issuer", "users.oidc_subject"):
+		return ErrOIDCAlreadyLinked
+	}
+	return fmt.Errorf("%s: %w", msg, dberr.Classify(err))
+}
+
+// anonymousUsername replaces the username of a deleted account; the user ID
+// keeps it unique.
+func anonymousUsername(userID uuid.UUID) string {
+	return "deleted-" + userID.String()
+}
+
+// SetDisabled disables or re-enables a user. Disabled users cannot log in.
+func (r *Repository) SetDisabled(ctx context.Context, userID uuid.UUID, disabled bool) error {
+	var disabledAt *time.Time
+	if disabled {
+		now := time.Now()
+		disabledAt = &now
+	}
+
+	result := r.db.WithContext(ctx).Model(&User{}).Where("id = ?", userID).Update("disabled_at", disabledAt)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update user: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
 	}
 	return nil
 }
@@ -92,7 +488,9 @@ func (r *Repository) DeleteUser(ctx context.Context, userID uuid.UUID) error {
 func (r *Repository) GetUserByID(ctx context.Context, userID uuid.UUID) (*core.UserLookupModel, error) {
 	var user User
 
-	result := r.db.WithContext(ctx).First(&user, "id = ?", userID)
+	// Deleted users are still looked up so records keep showing who they
+	// were.
+	result := r.db.WithContext(ctx).Unscoped().First(&user, "id = ?", userID)
 	if result.Error != nil {
 		if result.Error == gorm.ErrRecordNotFound {
 			return nil, nil
@@ -105,16 +503,343 @@ func (r *Repository) GetUserByID(ctx context.Context, userID uuid.UUID) (*core.U
 	}, nil
 }
 
-func (r *Repository) GetAllPlayers(ctx context.Context) ([]User, error) {
+// GetUsernames returns the usernames of the given users, deleted ones
+// included. Unknown IDs are left out of the map.
+func (r *Repository) GetUsernames(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID]string, error) {
+	var users []User
+	result := r.db.WithContext(ctx).Unscoped().Select("id", "username").Where("id IN ?", userIDs).Find(&users)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get usernames: %w", result.Error)
+	}
+	usernames := make(map[uuid.UUID]string, len(users))
+	for _, u := range users {
+		usernames[u.ID] = u.Username
+	}
+	return usernames, nil
+}
+
+// maxSearchMatches bounds SearchUserIDs, whose result ends up in an IN list.
+const maxSearchMatches = 500
+
+// SearchUserIDs returns the IDs of users, deleted ones included, whose
+// username contains term, ignoring case.
+func (r *Repository) SearchUserIDs(ctx context.Context, term string) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	result := r.db.WithContext(ctx).Unscoped().Model(&User{}).
+		Where(`LOWER(username) LIKE ? ESCAPE '\'`, listing.ContainsPattern(term)).
+		Limit(maxSearchMatches).
+		Pluck("id", &ids)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to search users: %w", result.Error)
+	}
+	return ids, nil
+}
+
+// GetUserIDByUsername returns uuid.Nil if there is no such user.
+func (r *Repository) GetUserIDByUsername(ctx context.Context, username string) (uuid.UUID, error) {
+	user, err := r.GetUserByUsername(ctx, username)
+	if err != nil || user == nil {
+		return uuid.Nil, err
+	}
+	return user.ID, nil
+}
+
+// GetActiveUserRole returns the user's role, or "" if the user does not
+// exist, was deleted or is disabled.
+func (r *Repository) GetActiveUserRole(ctx context.Context, userID uuid.UUID) (string, error) {
+	var roles []string
+	result := r.db.WithContext(ctx).Model(&User{}).
+		Where("id = ? AND disabled_at IS NULL", userID).
+		Limit(1).
+		Pluck("role", &roles)
+	if result.Error != nil {
+		return "", fmt.Errorf("failed to get user role: %w", result.Error)
+	}
+	if len(roles) == 0 {
+		return "", nil
+	}
+	return roles[0], nil
+}
+
+// GrantableScopes returns the permissions of the user's current role, which
+// are the scopes they may put on their access tokens.
+func (r *Repository) GrantableScopes(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	role, err := r.GetActiveUserRole(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	perms := RolePermissions(role)
+	scopes := make([]string, len(perms))
+	for i, p := range perms {
+		scopes[i] = string(p)
+	}
+	return scopes, nil
+}
+
+// CanGrantRole reports whether the admin may invite users with role: any
+// admin who can create tokens may invite players, but other roles need the
+// permission to manage users, and so does the access token the request was
+// made with, if any.
+func (r *Repository) CanGrantRole(ctx context.Context, adminID uuid.UUID, role string) (bool, error) {
+	if !IsValidRole(role) {
+		return false, nil
+	}
+	if role == RolePlayer {
+		return true, nil
+	}
+	if token, ok := apitoken.FromContext(ctx); ok && !token.HasScope(string(PermUsersManage)) {
+		return false, nil
+	}
+	adminRole, err := r.GetActiveUserRole(ctx, adminID)
+	if err != nil {
+		return false, err
+	}
+	return HasPermission(adminRole, PermUsersManage), nil
+}
+
+func (r *Repository) SetRole(ctx context.Context, userID uuid.UUID, role string) error {
+	result := r.db.WithContext(ctx).Model(&User{}).Where("id = ?", userID).Update("role", role)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update user role: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (r *Repository) GetAllUsers(ctx context.Context) ([]User, error) {
 	var users []User
 
-	result := r.db.WithContext(ctx).Where("role = ?", RolePlayer).Order("created_at DESC").Find(&users)
+	result := r.db.WithContext(ctx).Order("created_at ASC").Find(&users)
 	if result.Error != nil {
-		return nil, fmt.Errorf("failed to get all players: %w", result.Error)
+		return nil, fmt.Errorf("failed to get all users: %w", result.Error)
 	}
 	return users, nil
 }
 
+func (r *Repository) GetUser(ctx context.Context, userID uuid.UUID) (*User, error) {
+	var user User
+	result := r.db.WithContext(ctx).First(&user, "id = ?", userID)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get user: %w", result.Error)
+	}
+	return &user, nil
+}
+
+// BeginTOTPEnrollment stores a new TOTP secret for the user. It does not
+// protect the account until EnableTOTP confirms the user's app has it.
+func (r *Repository) BeginTOTPEnrollment(ctx context.Context, userID uuid.UUID) (string, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+
+	result := r.db.WithContext(ctx).Model(&User{}).
+		Where("id = ? AND totp_enabled_at IS NULL", userID).
+		Update("totp_secret", secret)
+	if result.Error != nil {
+		return "", fmt.Errorf("failed to store TOTP secret: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return "", ErrTOTPAlreadyEnabled
+	}
+	return secret, nil
+}
+
+// EnableTOTP turns on two-factor authentication once the user proves their
+// app produces valid codes, and returns their recovery codes.
+func (r *Repository) EnableTOTP(ctx context.Context, userID uuid.UUID, code string) ([]string, error) {
+	var codes []string
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, "id = ?", userID).Error; err != nil {
+			return fmt.Errorf("failed to get user: %w", err)
+		}
+		if user.HasTOTP() {
+			return ErrTOTPAlreadyEnabled
+		}
+		if user.TOTPSecret == "" {
+			return ErrTOTPNotEnrolled
+		}
+
+		step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+		if !ok {
+			return ErrInvalidTOTPCode
+		}
+
+		if err := tx.Model(&user).Updates(map[string]any{
+			"totp_enabled_at": time.Now(),
+			"totp_last_step":  step,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to enable TOTP: %w", err)
+		}
+
+		var err error
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifySecondFactor accepts either a current TOTP code or an unused
+// recovery code. Each code works only once.
+func (r *Repository) VerifySecondFactor(ctx context.Context, userID uuid.UUID, code string) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, "id = ?", userID).Error; err != nil {
+			return fmt.Errorf("failed to get user: %w", err)
+		}
+		if !user.HasTOTP() {
+			return ErrTOTPNotEnrolled
+		}
+
+		if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+			if step <= user.TOTPLastStep {
+				return ErrInvalidTOTPCode
+			}
+			if err := tx.Model(&user).Update("totp_last_step", step).Error; err != nil {
+				return fmt.Errorf("failed to record TOTP step: %w", err)
+			}
+			return nil
+		}
+
+		result := tx.Model(&RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashRecoveryCode(code)).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return fmt.Errorf("failed to use recovery code: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidTOTPCode
+		}
+		return nil
+	})
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes, used or not.
+func (r *Repository) RegenerateRecoveryCodes(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	var codes []string
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+func (r *Repository) CountRecoveryCodes(ctx context.Context, userID uuid.UUID) (int64, error) {
+	var count int64
+	result := r.db.WithContext(ctx).Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %w", result.Error)
+	}
+	return count, nil
+}
+
+// DisableTOTP removes two-factor authentication from the user, including any
+// pending enrollment and recovery codes.
+func (r *Repository) DisableTOTP(ctx context.Context, userID uuid.UUID) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]any{
+			"totp_secret":     "",
+			"totp_enabled_at": nil,
+			"totp_last_step":  0,
+		})
+		if result.Error != nil {
+			return fmt.Errorf("failed to disable TOTP: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrUserNotFound
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return fmt.Errorf("failed to delete recovery codes: %w", err)
+		}
+		return nil
+	})
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uuid.UUID) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	records := make([]RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+		records[i] = RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(raw)}
+	}
+
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, fmt.Errorf("failed to store recovery codes: %w", err)
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode ignores case, spaces and dashes so codes can be typed
+// loosely.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// Player statuses, as used by the player list filter.
+const (
+	PlayerStatusActive   = "active"
+	PlayerStatusDisabled = "disabled"
+)
+
+// PlayerFilter narrows the admin player list. Zero fields do not filter.
+type PlayerFilter struct {
+	Status      string
+	InvitedByID *uuid.UUID
+	Search      string
+	Created     listing.DateRange
+}
+
+// ListPlayers returns one page of players, newest first, and the cursor of
+// the next page.
+func (r *Repository) ListPlayers(ctx context.Context, filter PlayerFilter, page listing.Page) ([]User, *listing.Cursor, error) {
+	const table = "users"
+	query := r.db.WithContext(ctx).Where("role = ?", RolePlayer)
+
+	switch filter.Status {
+	case PlayerStatusActive:
+		query = query.Where("disabled_at IS NULL")
+	case PlayerStatusDisabled:
+		query = query.Where("disabled_at IS NOT NULL")
+	}
+	if filter.InvitedByID != nil {
+		query = query.Where("invited_by_id = ?", *filter.InvitedByID)
+	}
+	if filter.Search != "" {
+		query = query.Where(`LOWER(username) LIKE ? ESCAPE '\'`, listing.ContainsPattern(filter.Search))
+	}
+	query = filter.Created.Apply(query, table)
+
+	var users []User
+	if err := page.Apply(query, table).Find(&users).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to list players: %w", err)
+	}
+	users, next := listing.Trim(users, page, func(u User) listing.Cursor {
+		return listing.Cursor{CreatedAt: u.CreatedAt, ID: u.ID}
+	})
+	return users, next, nil
+}
+
 func (r *Repository) GetUserByUsername(ctx context.Context, username string) (*User, error) {
 	var user User
 	result := r.db.WithContext(ctx).First(&user, "username = ?", username)
@@ -126,3 +851,87 @@ func (r *Repository) GetUserByUsername(ctx context.Context, username string) (*U
 	}
 	return &user, nil
 }
+
+// GetUserByOIDC returns the user linked to an account at the OIDC provider,
+// or nil if there is none.
+func (r *Repository) GetUserByOIDC(ctx context.Context, issuer, subject string) (*User, error) {
+	var user User
+	result := r.db.WithContext(ctx).First(&user, "oidc_issuer = ? AND oidc_subject = ?", issuer, subject)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get user by OIDC subject: %w", result.Error)
+	}
+	return &user, nil
+}
+
+// CreateOIDCUser adds a user who logs in with the OIDC provider. They have
+// no password.
+func (r *Repository) CreateOIDCUser(ctx context.Context, username, role, issuer, subject string) (*User, error) {
+	var taken int64
+	if err := r.db.WithContext(ctx).Unscoped().Model(&User{}).Where("username = ?", username).Count(&taken).Error; err != nil {
+		return nil, fmt.Errorf("failed to check username: %w", err)
+	}
+	if taken > 0 {
+		return nil, ErrUsernameTaken
+	}
+
+	newUser := User{
+		Username:     username,
+		Role:         role,
+		PasswordHash: unusablePasswordHash,
+		OIDCIssuer:   &issuer,
+		OIDCSubject:  &subject,
+	}
+	if err := r.db.WithContext(ctx).Create(&newUser).Error; err != nil {
+		return nil, userWriteError("failed to create user", err)
+	}
+	return &newUser, nil
+}
+
+// LinkOIDC links a user to an account at the OIDC provider, replacing any
+// earlier link. An account can be linked to one user only.
+func (r *Repository) LinkOIDC(ctx context.Context, userID uuid.UUID, issuer, subject string) error {
+	var linked User
+	err := r.db.WithContext(ctx).Unscoped().Select("id").
+		First(&linked, "oidc_issuer = ? AND oidc_subject = ?", issuer, subject).Error
+	if err == nil && linked.ID != userID {
+		return ErrOIDCAlreadyLinked
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("failed to check OIDC link: %w", err)
+	}
+
+	result := r.db.WithContext(ctx).Model(&User{}).Where("id = ?", userID).
+		Updates(map[string]any{"oidc_issuer": issuer, "oidc_subject": subject})
+	if result.Error != nil {
+		return userWriteError("failed to link OIDC account", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// UnlinkOIDC removes the user's link to the OIDC provider. Users without a
+// password cannot unlink, as they would have no way left to log in.
+func (r *Repository) UnlinkOIDC(ctx context.Context, userID uuid.UUID) error {
+	user, err := r.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrUserNotFound
+	}
+	if user.PasswordHash == unusablePasswordHash {
+		return ErrNoPassword
+	}
+
+	result := r.db.WithContext(ctx).Model(&User{}).Where("id = ?", userID).
+		Updates(map[string]any{"oidc_issuer": nil, "oidc_subject": nil})
+	if result.Error != nil {
+		return fmt.Errorf("failed to unlink OIDC account: %w", result.Error)
+	}
+	return nil
+}
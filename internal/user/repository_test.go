@@ -0,0 +1,205 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicolas-camacho/thrg/internal/apitoken"
+	"github.com/nicolas-camacho/thrg/internal/audit"
+	"github.com/nicolas-camacho/thrg/internal/contextutil"
+	"github.com/nicolas-camacho/thrg/internal/database"
+	"github.com/nicolas-camacho/thrg/internal/migrate"
+	"github.com/nicolas-camacho/thrg/internal/password"
+	"github.com/nicolas-camacho/thrg/internal/story"
+	"github.com/nicolas-camacho/thrg/internal/token"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := database.Open(database.Config{
+		Driver: database.SQLite,
+		DSN:    filepath.Join(t.TempDir(), "thrg.db"),
+	})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	db.Logger = logger.Discard
+
+	migrator, err := migrate.New(db, database.SQLite)
+	if err != nil {
+		t.Fatalf("load migrations: %v", err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	hasher := PasswordHasher
+	PasswordHasher.BcryptCost = bcrypt.MinCost
+	t.Cleanup(func() { PasswordHasher = hasher })
+	return db
+}
+
+// TestRegisterPlayerUsesSingleUseTokenOnce registers a second player with a
+// token whose only use a first player spent after the second one read it.
+// SQLite runs one write transaction at a time, so that read is staged: the
+// token the second registration reads is rewound to how it was before the
+// first one committed, as PostgreSQL would show it without the row lock.
+func TestRegisterPlayerUsesSingleUseTokenOnce(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	repo := NewRepository(db)
+
+	admin, err := repo.CreateUser(ctx, "owner", "Correct-horse-42", RoleOwner)
+	if err != nil {
+		t.Fatalf("create admin: %v", err)
+	}
+	invite, err := token.NewRepository(db).CreateNewToken(ctx, admin.ID, token.TokenSpec{MaxUses: 1})
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+
+	if _, err := repo.RegisterPlayer(ctx, "gamer-01", "Correct-horse-42", invite.Value); err != nil {
+		t.Fatalf("first registration: %v", err)
+	}
+
+	stale, rewind := *invite, true
+	err = db.Callback().Query().After("gorm:query").Register("test:stale_token", func(tx *gorm.DB) {
+		if read, ok := tx.Statement.Dest.(*token.RegistrationToken); ok && rewind && read.ID == stale.ID {
+			read.UseCount, read.IsUsed, read.UsedByID = stale.UseCount, stale.IsUsed, stale.UsedByID
+		}
+	})
+	if err != nil {
+		t.Fatalf("register callback: %v", err)
+	}
+	if _, err := repo.RegisterPlayer(ctx, "gamer-02", "Correct-horse-42", invite.Value); !errors.Is(err, token.ErrTokenExhausted) {
+		t.Errorf("second registration returned %v, want %v", err, token.ErrTokenExhausted)
+	}
+	rewind = false
+
+	var stored token.RegistrationToken
+	if err := db.First(&stored, "id = ?", invite.ID).Error; err != nil {
+		t.Fatalf("reload token: %v", err)
+	}
+	if stored.UseCount != 1 {
+		t.Errorf("token use count is %d, want 1", stored.UseCount)
+	}
+
+	var usernames []string
+	if err := db.Model(&User{}).Where("id <> ?", admin.ID).Pluck("username", &usernames).Error; err != nil {
+		t.Fatalf("list users: %v", err)
+	}
+	if !slices.Equal(usernames, []string{"gamer-01"}) {
+		t.Errorf("registered players are %v, want [gamer-01]", usernames)
+	}
+}
+
+func TestInviteRoleNeedsUsersManageScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string // nil for a session login
+		role   string
+		status int
+	}{
+		{"session invites game master", nil, RoleGameMaster, http.StatusCreated},
+		{"token invites player", []string{string(PermTokensCreate)}, RolePlayer, http.StatusCreated},
+		{"token without users:manage invites game master", []string{string(PermTokensCreate)}, RoleGameMaster, http.StatusForbidden},
+		{"token without users:manage invites owner", []string{string(PermTokensCreate)}, RoleOwner, http.StatusForbidden},
+		{"token with users:manage invites game master", []string{string(PermTokensCreate), string(PermUsersManage)}, RoleGameMaster, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			ctx := context.Background()
+			repo := NewRepository(db)
+			owner, err := repo.CreateUser(ctx, "owner", "Correct-horse-42", RoleOwner)
+			if err != nil {
+				t.Fatalf("create owner: %v", err)
+			}
+
+			ctx = contextutil.SetUserIDInContext(ctx, owner.ID)
+			if tt.scopes != nil {
+				_, accessToken, err := apitoken.NewRepository(db).Create(ctx, owner.ID, "script", tt.scopes, time.Now().Add(time.Hour))
+				if err != nil {
+					t.Fatalf("create access token: %v", err)
+				}
+				ctx = apitoken.WithToken(ctx, accessToken)
+			}
+			body := strings.NewReader(`{"role":"` + tt.role + `"}`)
+			req := httptest.NewRequest(http.MethodPost, "/admin/api/tokens", body).WithContext(ctx)
+			rec := httptest.NewRecorder()
+			token.GenerateTokenHandler(token.NewRepository(db), repo, story.NewRepository(db), audit.NewLog(db))(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("inviting %s returned %d, want %d: %s", tt.role, rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+func TestCheckPasswordRehashesOnLogin(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewRepository(db)
+	ctx := context.Background()
+
+	created, err := repo.CreateUser(ctx, "ana", "Correct-horse-42", RoleAuthor)
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	bcryptHash := created.PasswordHash
+
+	PasswordHasher = password.Hasher{
+		Algorithm:  password.Argon2id,
+		BcryptCost: bcrypt.MinCost,
+		Argon2:     password.Argon2Params{MemoryKB: 64, Time: 1, Threads: 1},
+	}
+	stored := func() string {
+		t.Helper()
+		u, err := repo.GetUserByUsername(ctx, "ana")
+		if err != nil {
+			t.Fatalf("get user: %v", err)
+		}
+		return u.PasswordHash
+	}
+
+	u := *created
+	if repo.CheckPassword(ctx, &u, "Wrong-horse-42") {
+		t.Fatal("a wrong password matched")
+	}
+	if got := stored(); got != bcryptHash {
+		t.Fatalf("a failed check replaced the hash with %q", got)
+	}
+
+	if !repo.CheckPassword(ctx, &u, "Correct-horse-42") {
+		t.Fatal("the password no longer matches after switching to argon2id")
+	}
+	argonHash := stored()
+	if !strings.HasPrefix(argonHash, "$argon2id$") || u.PasswordHash != argonHash {
+		t.Fatalf("hash is %q after logging in, want argon2id", argonHash)
+	}
+
+	if !repo.CheckPassword(ctx, &u, "Correct-horse-42") {
+		t.Fatal("the password does not match its argon2id hash")
+	}
+	if got := stored(); got != argonHash {
+		t.Errorf("an up-to-date hash was replaced again")
+	}
+
+	PasswordHasher.Argon2.Time = 2
+	if !repo.CheckPassword(ctx, &u, "Correct-horse-42") {
+		t.Fatal("the password no longer matches after raising the cost")
+	}
+	if got := stored(); got == argonHash || !strings.Contains(got, ",t=2,") {
+		t.Errorf("hash is %q after raising the argon2 time, want it rehashed with t=2", got)
+	}
+}
@@ -0,0 +1,225 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/nicolas-camacho/thrg/internal/apierror"
+	"github.com/nicolas-camacho/thrg/internal/contextutil"
+	"github.com/nicolas-camacho/thrg/internal/totp"
+)
+
+// totpIssuer is the name authenticator apps show next to the account.
+const totpIssuer = "thrg"
+
+type TwoFactorStatusDTO struct {
+	Enabled           bool  `json:"enabled"`
+	Required          bool  `json:"required"`
+	RecoveryCodesLeft int64 `json:"recoveryCodesLeft"`
+}
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// currentUser loads the logged-in user for the account endpoints.
+func currentUser(w http.ResponseWriter, r *http.Request, repo *Repository) (*User, bool) {
+	userID, ok := contextutil.GetUserIDFromContext(r.Context())
+	if !ok || userID == uuid.Nil {
+		apierror.Write(w, apierror.Unauthorized("Unauthorized"))
+		return nil, false
+	}
+
+	user, err := repo.GetUser(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to get user %s: %v", userID, err)
+		apierror.Write(w, apierror.ErrInternal)
+		return nil, false
+	}
+	if user == nil {
+		apierror.Write(w, apierror.Unauthorized("Unauthorized"))
+		return nil, false
+	}
+	return user, true
+}
+
+func decodeCode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req twoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		apierror.Write(w, apierror.BadRequest("A code is required"))
+		return "", false
+	}
+	return req.Code, true
+}
+
+func writeRecoveryCodes(w http.ResponseWriter, status int, message string, codes []string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"message":       message,
+		"recoveryCodes": codes,
+	})
+}
+
+func TwoFactorStatusHandler(repo *Repository, required bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, repo)
+		if !ok {
+			return
+		}
+
+		status := TwoFactorStatusDTO{Enabled: user.HasTOTP(), Required: required}
+		if user.HasTOTP() {
+			left, err := repo.CountRecoveryCodes(r.Context(), user.ID)
+			if err != nil {
+				apierror.Write(w, err)
+				return
+			}
+			status.RecoveryCodesLeft = left
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// SetupTwoFactorHandler starts enrollment: it returns the secret and the
+// otpauth URI to show as a QR code. Nothing changes for the login until the
+// admin confirms with EnableTwoFactorHandler.
+func SetupTwoFactorHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, repo)
+		if !ok {
+			return
+		}
+
+		secret, err := repo.BeginTOTPEnrollment(r.Context(), user.ID)
+		if err != nil {
+			apierror.Write(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"secret":     secret,
+			"otpauthUri": totp.URI(totpIssuer, user.Username, secret),
+		})
+	}
+}
+
+func EnableTwoFactorHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, repo)
+		if !ok {
+			return
+		}
+		code, ok := decodeCode(w, r)
+		if !ok {
+			return
+		}
+
+		codes, err := repo.EnableTOTP(r.Context(), user.ID, code)
+		if err != nil {
+			apierror.Write(w, err)
+			return
+		}
+		writeRecoveryCodes(w, http.StatusOK, "Two-factor authentication enabled", codes)
+	}
+}
+
+// RegenerateRecoveryCodesHandler replaces the admin's recovery codes. It
+// asks for a current code so a stolen session alone cannot do it.
+func RegenerateRecoveryCodesHandler(repo *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, repo)
+		if !ok {
+			return
+		}
+		code, ok := decodeCode(w, r)
+		if !ok {
+			return
+		}
+
+		if err := repo.VerifySecondFactor(r.Context(), user.ID, code); err != nil {
+			apierror.Write(w, err)
+			return
+		}
+
+		codes, err := repo.RegenerateRecoveryCodes(r.Context(), user.ID)
+		if err != nil {
+			apierror.Write(w, err)
+			return
+		}
+		writeRecoveryCodes(w, http.StatusOK, "Recovery codes regenerated", codes)
+	}
+}
+
+// DisableTwoFactorHandler turns two-factor authentication off for the admin
+// after checking a current code. It is refused while 2FA is mandatory.
+func DisableTwoFactorHandler(repo *Repository, required bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if required {
+			apierror.Write(w, apierror.New(http.StatusConflict, "two_factor_required", "Two-factor authentication is mandatory"))
+			return
+		}
+
+		user, ok := currentUser(w, r, repo)
+		if !ok {
+			return
+		}
+		code, ok := decodeCode(w, r)
+		if !ok {
+			return
+		}
+
+		if err := repo.VerifySecondFactor(r.Context(), user.ID, code); err != nil {
+			apierror.Write(w, err)
+			return
+		}
+		if err := repo.DisableTOTP(r.Context(), user.ID); err != nil {
+			apierror.Write(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+	}
+}
+
+// ResetTwoFactorHandler removes another user's two-factor authentication,
+// for when they lose both their device and their recovery codes. Their
+// sessions are ended; if 2FA is mandatory they set it up again on their next
+// login.
+func ResetTwoFactorHandler(repo *Repository, sessions SessionRevoker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := targetUserID(w, r)
+		if !ok {
+			return
+		}
+
+		if err := repo.DisableTOTP(r.Context(), userID); err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				apierror.Write(w, apierror.NotFound("User not found"))
+				return
+			}
+			apierror.Write(w, err)
+			return
+		}
+
+		if _, err := sessions.RevokeUserSessions(r.Context(), userID); err != nil {
+			log.Printf("Failed to revoke sessions of user %s: %v", userID, err)
+			apierror.Write(w, apierror.ErrInternal)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication reset"})
+	}
+}
@@ -0,0 +1,8 @@
+// Package web holds the HTML templates of the pages the server renders,
+// embedded so the binary does not depend on the directory it runs from.
+package web
+
+import "embed"
+
+//go:embed *.html
+var Templates embed.FS